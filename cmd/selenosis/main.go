@@ -2,18 +2,25 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	logctx "github.com/alcounit/browser-controller/pkg/log"
 	"github.com/alcounit/browser-service/pkg/client"
 	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
+	"github.com/alcounit/selenosis/v2/pkg/admission"
 	"github.com/alcounit/selenosis/v2/pkg/auth"
 	"github.com/alcounit/selenosis/v2/pkg/env"
+	"github.com/alcounit/selenosis/v2/pkg/quota"
+	"github.com/alcounit/selenosis/v2/pkg/usage"
 	"github.com/alcounit/selenosis/v2/service"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
@@ -51,6 +58,24 @@ func main() {
 
 	svc := service.NewService(client, cfg)
 
+	// the background work outlives the signal, so that in-flight requests
+	// are still served by it while the server shuts down
+	runCtx, cancelRun := context.WithCancel(logctx.IntoContext(context.WithoutCancel(ctx), log))
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		svc.Run(runCtx)
+	}()
+
+	drainSignals := make(chan os.Signal, 1)
+	signal.Notify(drainSignals, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range drainSignals {
+			svc.SetDraining(sig == syscall.SIGUSR1)
+			log.Info().Bool("draining", svc.Draining()).Str("signal", sig.String()).Msg("drain mode changed")
+		}
+	}()
+
 	router := chi.NewRouter()
 	router.Use(func(next http.Handler) http.Handler {
 		fn := func(rw http.ResponseWriter, req *http.Request) {
@@ -95,7 +120,34 @@ func main() {
 
 	router.Mount("/mcp", mcp)
 
+	if cfg.DebugVars {
+		router.Get("/debug/vars", svc.DebugVars)
+	}
+
+	if cfg.DrainAPI {
+		router.Get("/selenosis/v1/drain", svc.Drain)
+		router.Put("/selenosis/v1/drain", svc.Drain)
+		router.Delete("/selenosis/v1/drain", svc.Drain)
+	}
+
+	if cfg.SessionEvents {
+		router.Get("/selenosis/v1/events", svc.SessionEvents)
+	}
+	if cfg.Usage != nil {
+		router.Get("/selenosis/v1/usage", svc.Usage)
+	}
+
+	if cfg.SessionsAPI {
+		router.Get("/selenosis/v1/sessions", svc.ListSessions)
+		router.Delete("/selenosis/v1/sessions", svc.DeleteSessions)
+		router.Post("/selenosis/v1/sessions", svc.CreateSessionAsync)
+	}
 	router.Route("/selenosis/v1/sessions/{sessionId}", func(r chi.Router) {
+		if cfg.SessionsAPI {
+			r.Get("/", svc.GetSession)
+			r.Delete("/", svc.DeleteSession)
+			r.Get("/startup", svc.SessionStartup)
+		}
 		r.Route("/proxy", func(r chi.Router) {
 			r.HandleFunc("/http/*", svc.RouteHTTP)
 		})
@@ -118,10 +170,42 @@ func main() {
 	stop()
 	log.Info().Msg("Shutting down HTTP server...")
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
-	defer shutdownCancel()
-	if err := srv.Shutdown(shutdownCtx); err != nil {
-		log.Err(err).Msg("HTTP server shutdown error")
+	var (
+		wg          sync.WaitGroup
+		shutdownErr error
+	)
+
+	// hijacked WebSocket connections are not waited for by srv.Shutdown
+	wg.Go(func() {
+		drainCtx, drainCancel := context.WithTimeout(context.WithoutCancel(ctx), cfg.WebSocketDrainTimeout)
+		defer drainCancel()
+		log.Info().Dur("timeout", cfg.WebSocketDrainTimeout).Msg("Draining WebSocket connections...")
+		if err := svc.ShutdownWebSockets(drainCtx); err != nil {
+			log.Warn().Err(err).Msg("WebSocket connections closed before they ended")
+		}
+	})
+
+	wg.Go(func() {
+		shutdownCtx, shutdownCancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer shutdownCancel()
+		shutdownErr = srv.Shutdown(shutdownCtx)
+	})
+
+	wg.Wait()
+
+	// wait for the pool drain and the last usage records before the usage
+	// file is closed
+	log.Info().Msg("Stopping background work...")
+	cancelRun()
+	<-runDone
+
+	if cfg.Usage != nil {
+		if err := cfg.Usage.Close(); err != nil {
+			log.Err(err).Msg("usage file close error")
+		}
+	}
+	if shutdownErr != nil {
+		log.Err(shutdownErr).Msg("HTTP server shutdown error")
 		os.Exit(1)
 	}
 }
@@ -137,7 +221,7 @@ func basicAuthMiddleware(authStore *auth.AuthStore, log zerolog.Logger) func(htt
 					return
 				}
 				req.URL.User = nil
-				req = req.WithContext(auth.WithOwner(req.Context(), auth.Owner{Name: user}))
+				req = req.WithContext(auth.WithOwner(req.Context(), auth.Owner{Name: user, Admin: authStore.IsAdmin(user)}))
 			}
 			next.ServeHTTP(rw, req)
 		})
@@ -156,13 +240,108 @@ func loadConfig() (service.ServiceConfig, *auth.AuthStore, string, string, error
 
 	cfg.SidecarPort = env.GetEnvOrDefault("PROXY_PORT", "4445")
 	cfg.BrowserStartTimeout = env.GetEnvDurationOrDefault("BROWSER_STARTUP_TIMEOUT", 3*time.Minute)
+	cfg.MaxBrowserStartTimeout = env.GetEnvDurationOrDefault("BROWSER_STARTUP_TIMEOUT_MAX", 0)
+	if cfg.BrowserStartTimeouts, err = service.ParseStartupTimeouts(env.GetEnvOrDefault("BROWSER_STARTUP_TIMEOUTS", "")); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("BROWSER_STARTUP_TIMEOUTS parse error: %v", err)
+	}
 	cfg.Namespace = env.GetEnvOrDefault("NAMESPACE", "selenosis")
+	cfg.IdempotencyTTL = env.GetEnvDurationOrDefault("IDEMPOTENCY_KEY_TTL", 10*time.Minute)
+	cfg.IdempotencyAbandonTimeout = env.GetEnvDurationOrDefault("IDEMPOTENCY_ABANDON_TIMEOUT", time.Minute)
+	cfg.MaxSessionLifetime = env.GetEnvDurationOrDefault("SESSION_MAX_LIFETIME", 0)
+	if cfg.SessionLifetimes, err = service.ParseSessionLifetimes(env.GetEnvOrDefault("SESSION_LIFETIMES", "")); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("SESSION_LIFETIMES parse error: %v", err)
+	}
+	cfg.LifetimeCheckInterval = env.GetEnvDurationOrDefault("SESSION_LIFETIME_CHECK_INTERVAL", 30*time.Second)
+	cfg.WebSocketDrainTimeout = env.GetEnvDurationOrDefault("WEBSOCKET_DRAIN_TIMEOUT", 20*time.Second)
+	cfg.DrainRetryAfter = env.GetEnvDurationOrDefault("DRAIN_RETRY_AFTER", 30*time.Second)
+	cfg.TeardownGrace = env.GetEnvDurationOrDefault("SESSION_TEARDOWN_GRACE", 5*time.Second)
+	if cfg.SessionRegistry, err = strconv.ParseBool(env.GetEnvOrDefault("SESSION_REGISTRY", "false")); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("SESSION_REGISTRY parse error: %v", err)
+	}
+	if cfg.EnforceOwnership, err = strconv.ParseBool(env.GetEnvOrDefault("SESSION_OWNERSHIP", "false")); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("SESSION_OWNERSHIP parse error: %v", err)
+	}
+	cfg.OwnerCacheTTL = env.GetEnvDurationOrDefault("SESSION_OWNER_CACHE_TTL", 10*time.Second)
+	if cfg.SidecarProbe.Enabled, err = strconv.ParseBool(env.GetEnvOrDefault("SIDECAR_READINESS_PROBE", "false")); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("SIDECAR_READINESS_PROBE parse error: %v", err)
+	}
+	cfg.SidecarProbe.Path = env.GetEnvOrDefault("SIDECAR_READINESS_PATH", "/status")
+	cfg.SidecarProbe.Interval = env.GetEnvDurationOrDefault("SIDECAR_READINESS_INTERVAL", 250*time.Millisecond)
+	cfg.SessionIDSecret = []byte(env.GetEnvOrDefault("SESSION_ID_SECRET", ""))
+	if cfg.LegacySessionIDs, err = strconv.ParseBool(env.GetEnvOrDefault("SESSION_ID_LEGACY", "false")); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("SESSION_ID_LEGACY parse error: %v", err)
+	}
+	if cfg.SessionEvents, err = strconv.ParseBool(env.GetEnvOrDefault("SESSION_EVENTS", "false")); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("SESSION_EVENTS parse error: %v", err)
+	}
+	if cfg.DrainAPI, err = strconv.ParseBool(env.GetEnvOrDefault("DRAIN_API", "false")); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("DRAIN_API parse error: %v", err)
+	}
+	if cfg.DebugVars, err = strconv.ParseBool(env.GetEnvOrDefault("DEBUG_VARS", "false")); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("DEBUG_VARS parse error: %v", err)
+	}
+	if cfg.SessionsAPI, err = strconv.ParseBool(env.GetEnvOrDefault("SESSIONS_API", "false")); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("SESSIONS_API parse error: %v", err)
+	}
+	if path := env.GetEnvOrDefault("USAGE_FILE", ""); path != "" {
+		if cfg.Usage, err = usage.Open(path, env.GetEnvDurationOrDefault("USAGE_RETENTION", 90*24*time.Hour)); err != nil {
+			return cfg, authStore, "", "", fmt.Errorf("USAGE_FILE open error: %v", err)
+		}
+	}
+	cfg.EventsMode = env.GetEnvOrDefault("BROWSER_EVENTS_MODE", service.EventsModePerRequest)
+	if cfg.EventsMode != service.EventsModeShared && cfg.EventsMode != service.EventsModePerRequest {
+		return cfg, authStore, "", "", fmt.Errorf("BROWSER_EVENTS_MODE must be %q or %q", service.EventsModeShared, service.EventsModePerRequest)
+	}
+
+	cfg.Queue.MaxSessions = env.GetEnvIntOrDefault("MAX_SESSIONS", 0)
+	cfg.Queue.MaxQueueSize = env.GetEnvIntOrDefault("QUEUE_MAX_SIZE", 0)
+	cfg.Queue.QueueTimeout = env.GetEnvDurationOrDefault("QUEUE_TIMEOUT", time.Minute)
+	cfg.Queue.RetryAfter = env.GetEnvDurationOrDefault("QUEUE_RETRY_AFTER", 10*time.Second)
+	cfg.Queue.CountTTL = env.GetEnvDurationOrDefault("QUEUE_COUNT_TTL", time.Second)
+	cfg.Queue.DefaultClass = env.GetEnvOrDefault("QUEUE_DEFAULT_PRIORITY_CLASS", "")
+	if cfg.Queue.Classes, err = admission.ParseClasses(env.GetEnvOrDefault("QUEUE_PRIORITY_CLASSES", "")); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("QUEUE_PRIORITY_CLASSES parse error: %v", err)
+	}
+	if _, ok := cfg.Queue.Classes[cfg.Queue.DefaultClass]; cfg.Queue.DefaultClass != "" && !ok {
+		return cfg, authStore, "", "", fmt.Errorf("QUEUE_DEFAULT_PRIORITY_CLASS %q is not defined in QUEUE_PRIORITY_CLASSES", cfg.Queue.DefaultClass)
+	}
+
+	if cfg.Quotas, err = quota.LoadRulesFromEnv("SESSION_QUOTAS"); err != nil {
+		return cfg, authStore, "", "", fmt.Errorf("SESSION_QUOTAS parse error: %v", err)
+	}
+
+	if pool := env.GetEnvOrDefault("BROWSER_POOL", ""); pool != "" {
+		if err = json.Unmarshal([]byte(pool), &cfg.Pool.Browsers); err != nil {
+			return cfg, authStore, "", "", fmt.Errorf("BROWSER_POOL parse error: %v", err)
+		}
+	}
+	cfg.Pool.RefreshInterval = env.GetEnvDurationOrDefault("BROWSER_POOL_REFRESH_INTERVAL", 10*time.Second)
+
+	cfg.Retry.MaxAttempts = env.GetEnvIntOrDefault("BROWSER_START_MAX_ATTEMPTS", 1)
+	cfg.Retry.Backoff = env.GetEnvDurationOrDefault("BROWSER_START_RETRY_BACKOFF", time.Second)
+	cfg.Retry.MaxBackoff = env.GetEnvDurationOrDefault("BROWSER_START_RETRY_MAX_BACKOFF", 10*time.Second)
+	cfg.Retry.Reasons = service.DefaultRetryReasons
+	if reasons, ok := os.LookupEnv("BROWSER_START_RETRY_REASONS"); ok {
+		cfg.Retry.Reasons = nil
+		for _, r := range strings.Split(reasons, ",") {
+			if r = strings.TrimSpace(r); r != "" {
+				cfg.Retry.Reasons = append(cfg.Retry.Reasons, r)
+			}
+		}
+	}
 
 	basicAuthFilePath := env.GetEnvOrDefault("BASIC_AUTH_FILE", "")
 	if basicAuthFilePath != "" {
 		if authStore, err = auth.LoadFromJSONFile(basicAuthFilePath); err != nil {
 			return cfg, authStore, "", "", fmt.Errorf("BASIC_AUTH_FILE file read error: %v", err)
 		}
+		// every session has an owner then, so members without one would
+		// never be claimed
+		for _, b := range cfg.Pool.Browsers {
+			if b.Owner == "" {
+				return cfg, authStore, "", "", fmt.Errorf("BROWSER_POOL entry %s/%s needs an owner when BASIC_AUTH_FILE is set", b.BrowserName, b.BrowserVersion)
+			}
+		}
 	}
 
 	return cfg, authStore, addr, apiURL, err
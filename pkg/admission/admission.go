@@ -0,0 +1,348 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueTimeout = errors.New("queue timeout")
+	ErrQueueFull    = errors.New("queue full")
+	ErrUnknownClass = errors.New("unknown priority class")
+)
+
+// Counter reports how many sessions are currently running.
+type Counter func(ctx context.Context) (int, error)
+
+type Config struct {
+	// MaxSessions is the number of running sessions plus admitted startups
+	// the queue allows at once. Zero disables admission control.
+	MaxSessions  int
+	MaxQueueSize int
+	QueueTimeout time.Duration
+	PollInterval time.Duration
+	// CountTTL is how long a running-session count is reused before the
+	// Counter is asked again. Defaults to PollInterval.
+	CountTTL   time.Duration
+	RetryAfter time.Duration
+	// Classes maps priority class names to priorities; higher goes first.
+	Classes      map[string]int
+	DefaultClass string
+}
+
+type Request struct {
+	Owner string
+	Class string
+}
+
+type Ticket struct {
+	q    *Queue
+	once sync.Once
+}
+
+// Release returns the slot held by an admitted startup. It is safe to call
+// more than once.
+func (t *Ticket) Release() {
+	if t == nil {
+		return
+	}
+	t.once.Do(func() {
+		t.q.mu.Lock()
+		t.q.inflight--
+		t.q.mu.Unlock()
+		t.q.invalidate()
+		t.q.notify()
+	})
+}
+
+type waiter struct {
+	owner    string
+	priority int
+	ready    chan struct{}
+	admitted bool
+}
+
+// class keeps one FIFO per owner and serves owners round-robin.
+type class struct {
+	owners  []string
+	pending map[string][]*waiter
+}
+
+type Queue struct {
+	cfg   Config
+	count Counter
+
+	// dispatchMu also guards the cached count
+	dispatchMu sync.Mutex
+	active     int
+	countedAt  time.Time
+	counted    bool
+
+	mu       sync.Mutex
+	classes  map[int]*class
+	waiting  int
+	inflight int
+	wake     chan struct{}
+}
+
+func New(cfg Config, count Counter) *Queue {
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+	if cfg.CountTTL <= 0 {
+		cfg.CountTTL = cfg.PollInterval
+	}
+	return &Queue{
+		cfg:     cfg,
+		count:   count,
+		classes: map[int]*class{},
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (q *Queue) RetryAfter() time.Duration {
+	return q.cfg.RetryAfter
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.waiting
+}
+
+// Acquire blocks until the request is admitted, the queue timeout expires or
+// ctx is done. The returned ticket must be released once the startup is over.
+func (q *Queue) Acquire(ctx context.Context, r Request) (*Ticket, error) {
+	priority, err := q.priority(r.Class)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &waiter{owner: r.Owner, priority: priority, ready: make(chan struct{})}
+
+	q.mu.Lock()
+	if q.cfg.MaxQueueSize > 0 && q.waiting >= q.cfg.MaxQueueSize {
+		q.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	q.push(w)
+	q.mu.Unlock()
+
+	q.dispatch(ctx)
+
+	var timeout <-chan time.Time
+	if q.cfg.QueueTimeout > 0 {
+		timer := time.NewTimer(q.cfg.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.ready:
+		return &Ticket{q: q}, nil
+	case <-timeout:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if w.admitted {
+		return &Ticket{q: q}, nil
+	}
+	q.remove(w)
+	return nil, err
+}
+
+// Run re-evaluates capacity periodically and whenever a ticket is released,
+// until ctx is done.
+func (q *Queue) Run(ctx context.Context) {
+	ticker := time.NewTicker(q.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-q.wake:
+		}
+		q.dispatch(ctx)
+	}
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) dispatch(ctx context.Context) {
+	q.dispatchMu.Lock()
+	defer q.dispatchMu.Unlock()
+
+	if q.Len() == 0 {
+		return
+	}
+
+	active, ok := q.running(ctx)
+	if !ok {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for free := q.cfg.MaxSessions - active - q.inflight; free > 0; free-- {
+		w := q.pop()
+		if w == nil {
+			return
+		}
+		w.admitted = true
+		q.inflight++
+		close(w.ready)
+	}
+}
+
+// running returns the number of running sessions, asking the Counter at
+// most once per CountTTL. When the Counter fails the last count is used; if
+// there is none, nobody is admitted until the next poll retries. Called with
+// dispatchMu held.
+func (q *Queue) running(ctx context.Context) (int, bool) {
+	if q.counted && time.Since(q.countedAt) < q.cfg.CountTTL {
+		return q.active, true
+	}
+
+	active, err := q.count(ctx)
+	if err != nil {
+		return q.active, q.counted
+	}
+	q.active, q.countedAt, q.counted = active, time.Now(), true
+	return active, true
+}
+
+// invalidate drops the cached count, as a released startup has either
+// become a running session or given up its slot.
+func (q *Queue) invalidate() {
+	q.dispatchMu.Lock()
+	defer q.dispatchMu.Unlock()
+	q.countedAt = time.Time{}
+}
+
+func (q *Queue) priority(name string) (int, error) {
+	if name == "" {
+		name = q.cfg.DefaultClass
+	}
+	if name == "" {
+		return 0, nil
+	}
+	p, ok := q.cfg.Classes[name]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrUnknownClass, name)
+	}
+	return p, nil
+}
+
+func (q *Queue) push(w *waiter) {
+	c, ok := q.classes[w.priority]
+	if !ok {
+		c = &class{pending: map[string][]*waiter{}}
+		q.classes[w.priority] = c
+	}
+	if len(c.pending[w.owner]) == 0 {
+		c.owners = append(c.owners, w.owner)
+	}
+	c.pending[w.owner] = append(c.pending[w.owner], w)
+	q.waiting++
+}
+
+func (q *Queue) pop() *waiter {
+	priorities := make([]int, 0, len(q.classes))
+	for p := range q.classes {
+		priorities = append(priorities, p)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(priorities)))
+
+	for _, p := range priorities {
+		c := q.classes[p]
+		if len(c.owners) == 0 {
+			continue
+		}
+
+		owner := c.owners[0]
+		c.owners = c.owners[1:]
+
+		w := c.pending[owner][0]
+		c.pending[owner] = c.pending[owner][1:]
+		if len(c.pending[owner]) > 0 {
+			c.owners = append(c.owners, owner)
+		} else {
+			delete(c.pending, owner)
+		}
+
+		q.waiting--
+		return w
+	}
+	return nil
+}
+
+func (q *Queue) remove(w *waiter) {
+	c, ok := q.classes[w.priority]
+	if !ok {
+		return
+	}
+
+	pending := c.pending[w.owner]
+	for i, pw := range pending {
+		if pw != w {
+			continue
+		}
+		c.pending[w.owner] = append(pending[:i:i], pending[i+1:]...)
+		q.waiting--
+		break
+	}
+
+	if len(c.pending[w.owner]) > 0 {
+		return
+	}
+
+	delete(c.pending, w.owner)
+	for i, o := range c.owners {
+		if o == w.owner {
+			c.owners = append(c.owners[:i:i], c.owners[i+1:]...)
+			break
+		}
+	}
+}
+
+// ParseClasses parses a priority class list such as "interactive=10,ci=0".
+func ParseClasses(s string) (map[string]int, error) {
+	classes := map[string]int{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid priority class %q", item)
+		}
+
+		p, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid priority for class %q: %w", name, err)
+		}
+		classes[name] = p
+	}
+	return classes, nil
+}
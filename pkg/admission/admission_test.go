@@ -0,0 +1,287 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func fixedCounter(n int) Counter {
+	return func(ctx context.Context) (int, error) { return n, nil }
+}
+
+func TestAcquireAdmitsWhenCapacityAvailable(t *testing.T) {
+	q := New(Config{MaxSessions: 2, QueueTimeout: time.Second}, fixedCounter(1))
+
+	ticket, err := q.Acquire(context.Background(), Request{})
+	if err != nil {
+		t.Fatalf("expected admission, got %v", err)
+	}
+	defer ticket.Release()
+
+	if q.Len() != 0 {
+		t.Fatalf("expected empty queue, got %d", q.Len())
+	}
+}
+
+func TestAcquireTimeout(t *testing.T) {
+	q := New(Config{MaxSessions: 1, QueueTimeout: 20 * time.Millisecond}, fixedCounter(1))
+
+	_, err := q.Acquire(context.Background(), Request{})
+	if !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("expected queue timeout, got %v", err)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("expected waiter to be removed, got %d", q.Len())
+	}
+}
+
+func TestAcquireContextDone(t *testing.T) {
+	q := New(Config{MaxSessions: 1, QueueTimeout: time.Second}, fixedCounter(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := q.Acquire(ctx, Request{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context cancelled, got %v", err)
+	}
+}
+
+func TestAcquireQueueFull(t *testing.T) {
+	q := New(Config{MaxSessions: 1, MaxQueueSize: 1, QueueTimeout: time.Second}, fixedCounter(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Acquire(ctx, Request{})
+
+	waitFor(t, func() bool { return q.Len() == 1 })
+
+	if _, err := q.Acquire(context.Background(), Request{}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected queue full, got %v", err)
+	}
+}
+
+func TestAcquireUnknownClass(t *testing.T) {
+	q := New(Config{MaxSessions: 1, Classes: map[string]int{"ci": 0}}, fixedCounter(0))
+
+	if _, err := q.Acquire(context.Background(), Request{Class: "nope"}); !errors.Is(err, ErrUnknownClass) {
+		t.Fatalf("expected unknown class error, got %v", err)
+	}
+}
+
+func TestReleaseAdmitsNextWaiter(t *testing.T) {
+	q := New(Config{MaxSessions: 1, QueueTimeout: time.Second, PollInterval: time.Hour}, fixedCounter(0))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	first, err := q.Acquire(context.Background(), Request{})
+	if err != nil {
+		t.Fatalf("expected admission, got %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		ticket, err := q.Acquire(context.Background(), Request{})
+		if err == nil {
+			ticket.Release()
+		}
+		done <- err
+	}()
+
+	waitFor(t, func() bool { return q.Len() == 1 })
+	first.Release()
+	first.Release()
+
+	if err := <-done; err != nil {
+		t.Fatalf("expected second waiter to be admitted, got %v", err)
+	}
+}
+
+func TestRunPollsCounter(t *testing.T) {
+	var active atomic.Int32
+	active.Store(1)
+	counter := func(ctx context.Context) (int, error) { return int(active.Load()), nil }
+
+	q := New(Config{MaxSessions: 1, QueueTimeout: time.Second, PollInterval: 5 * time.Millisecond}, counter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go q.Run(ctx)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := q.Acquire(context.Background(), Request{})
+		done <- err
+	}()
+
+	waitFor(t, func() bool { return q.Len() == 1 })
+	active.Store(0)
+
+	if err := <-done; err != nil {
+		t.Fatalf("expected admission after capacity freed, got %v", err)
+	}
+}
+
+func TestCounterErrorKeepsWaiting(t *testing.T) {
+	counter := func(ctx context.Context) (int, error) { return 0, errors.New("list failed") }
+	q := New(Config{MaxSessions: 1, QueueTimeout: 20 * time.Millisecond}, counter)
+
+	if _, err := q.Acquire(context.Background(), Request{}); !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("expected queue timeout, got %v", err)
+	}
+}
+
+func TestPriorityAndFairOrdering(t *testing.T) {
+	q := New(Config{
+		MaxSessions: 1,
+		Classes:     map[string]int{"ci": 0, "interactive": 10},
+	}, fixedCounter(0))
+
+	// occupy the only slot so that every request below has to queue
+	q.inflight = 1
+
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+
+	for _, r := range []struct{ id, owner, class string }{
+		{"a1", "alice", "ci"},
+		{"a2", "alice", "ci"},
+		{"a3", "alice", "ci"},
+		{"b1", "bob", "ci"},
+		{"i1", "carol", "interactive"},
+	} {
+		n := q.Len()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticket, err := q.Acquire(context.Background(), Request{Owner: r.owner, Class: r.class})
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", r.id, err)
+				return
+			}
+			mu.Lock()
+			order = append(order, r.id)
+			mu.Unlock()
+			ticket.Release()
+			q.dispatch(context.Background())
+		}()
+		waitFor(t, func() bool { return q.Len() == n+1 })
+	}
+
+	q.mu.Lock()
+	q.inflight = 0
+	q.mu.Unlock()
+	q.dispatch(context.Background())
+	wg.Wait()
+
+	expected := []string{"i1", "a1", "b1", "a2", "a3"}
+	if len(order) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestParseClasses(t *testing.T) {
+	classes, err := ParseClasses(" interactive=10, ci=0 ,")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if classes["interactive"] != 10 || classes["ci"] != 0 || len(classes) != 2 {
+		t.Fatalf("unexpected classes: %v", classes)
+	}
+
+	empty, err := ParseClasses("")
+	if err != nil || len(empty) != 0 {
+		t.Fatalf("expected empty classes, got %v %v", empty, err)
+	}
+
+	for _, bad := range []string{"ci", "=1", "ci=x"} {
+		if _, err := ParseClasses(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
+
+func TestCountIsCached(t *testing.T) {
+	var calls atomic.Int32
+	q := New(Config{MaxSessions: 10, QueueTimeout: time.Second, CountTTL: time.Hour}, func(ctx context.Context) (int, error) {
+		calls.Add(1)
+		return 0, nil
+	})
+
+	for range 5 {
+		ticket, err := q.Acquire(context.Background(), Request{})
+		if err != nil {
+			t.Fatalf("expected admission, got %v", err)
+		}
+		defer ticket.Release()
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected one count for five admissions, got %d", n)
+	}
+}
+
+func TestCountRefreshedOnRelease(t *testing.T) {
+	var calls atomic.Int32
+	q := New(Config{MaxSessions: 10, QueueTimeout: time.Second, CountTTL: time.Hour}, func(ctx context.Context) (int, error) {
+		calls.Add(1)
+		return 0, nil
+	})
+
+	ticket, _ := q.Acquire(context.Background(), Request{})
+	ticket.Release()
+	ticket, _ = q.Acquire(context.Background(), Request{})
+	ticket.Release()
+
+	if n := calls.Load(); n != 2 {
+		t.Fatalf("expected a fresh count after a release, got %d", n)
+	}
+}
+
+func TestCountErrorUsesLastCount(t *testing.T) {
+	var fail atomic.Bool
+	q := New(Config{MaxSessions: 2, QueueTimeout: time.Second, CountTTL: time.Nanosecond}, func(ctx context.Context) (int, error) {
+		if fail.Load() {
+			return 0, errors.New("list failed")
+		}
+		return 0, nil
+	})
+
+	ticket, err := q.Acquire(context.Background(), Request{})
+	if err != nil {
+		t.Fatalf("expected admission, got %v", err)
+	}
+	defer ticket.Release()
+
+	fail.Store(true)
+	ticket, err = q.Acquire(context.Background(), Request{})
+	if err != nil {
+		t.Fatalf("expected admission on the last count, got %v", err)
+	}
+	defer ticket.Release()
+}
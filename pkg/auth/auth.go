@@ -15,12 +15,15 @@ import (
 type User struct {
 	User string `json:"user"`
 	Pass string `json:"pass"`
+	// Admin users may manage the hub and the sessions of other users.
+	Admin bool `json:"admin,omitempty"`
 }
 
 type AuthStore struct {
-	mu    sync.RWMutex
-	users map[string]string
-	path  string
+	mu     sync.RWMutex
+	users  map[string]string
+	admins map[string]bool
+	path   string
 }
 
 func (s *AuthStore) Authenticate(user, pass string) bool {
@@ -30,6 +33,12 @@ func (s *AuthStore) Authenticate(user, pass string) bool {
 	return exists && pass == expected
 }
 
+func (s *AuthStore) IsAdmin(user string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.admins[user]
+}
+
 func reload(s *AuthStore) error {
 	data, err := os.ReadFile(s.path)
 	if err != nil {
@@ -42,11 +51,15 @@ func reload(s *AuthStore) error {
 	}
 
 	users := make(map[string]string, len(list))
+	admins := map[string]bool{}
 	for _, u := range list {
 		if u.User == "" {
 			continue
 		}
 		users[u.User] = u.Pass
+		if u.Admin {
+			admins[u.User] = true
+		}
 	}
 
 	if len(users) == 0 {
@@ -55,6 +68,7 @@ func reload(s *AuthStore) error {
 
 	s.mu.Lock()
 	s.users = users
+	s.admins = admins
 	s.mu.Unlock()
 	return nil
 }
@@ -44,6 +44,20 @@ func TestLoadFromJSONFileSuccess(t *testing.T) {
 	}
 }
 
+func TestLoadFromJSONFileAdmins(t *testing.T) {
+	path := writeTempFile(t, `[{"user":"alice","pass":"a","admin":true},{"user":"bob","pass":"b"}]`)
+	store, err := LoadFromJSONFile(path)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !store.IsAdmin("alice") {
+		t.Fatalf("expected alice to be an admin")
+	}
+	if store.IsAdmin("bob") || store.IsAdmin("carol") {
+		t.Fatalf("expected only alice to be an admin")
+	}
+}
+
 func TestLoadFromJSONFileSkipsEmptyUser(t *testing.T) {
 	path := writeTempFile(t, `[{"user":"","pass":"x"},{"user":"ok","pass":"p"}]`)
 	store, err := LoadFromJSONFile(path)
@@ -3,7 +3,8 @@ package auth
 import "context"
 
 type Owner struct {
-	Name string
+	Name  string
+	Admin bool
 }
 
 type ownerKeyType struct{}
@@ -18,3 +19,10 @@ func OwnerFrom(ctx context.Context) (Owner, bool) {
 	o, ok := ctx.Value(ownerKey).(Owner)
 	return o, ok
 }
+
+// IsAdmin reports whether the request in ctx may act for any owner. Without
+// an owner, that is with authentication disabled, every request may.
+func IsAdmin(ctx context.Context) bool {
+	o, ok := OwnerFrom(ctx)
+	return !ok || o.Admin
+}
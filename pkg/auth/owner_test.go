@@ -51,3 +51,15 @@ func TestWithOwnerDoesNotAffectParentContext(t *testing.T) {
 		t.Fatal("expected child context to contain owner")
 	}
 }
+
+func TestIsAdmin(t *testing.T) {
+	if !IsAdmin(context.Background()) {
+		t.Fatal("expected requests without owner to be admin")
+	}
+	if IsAdmin(WithOwner(context.Background(), Owner{Name: "alice"})) {
+		t.Fatal("expected regular owner not to be admin")
+	}
+	if !IsAdmin(WithOwner(context.Background(), Owner{Name: "root", Admin: true})) {
+		t.Fatal("expected admin owner to be admin")
+	}
+}
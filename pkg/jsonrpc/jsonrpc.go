@@ -9,21 +9,34 @@ import (
 // -32700/-32600/-32603 are reserved (parse error / invalid request / internal error);
 // -32000..-32099 are reserved for server-defined errors. SessionNotFound (-32001) matches
 // the MCP Streamable HTTP transport in the official SDK
-// (https://github.com/modelcontextprotocol/typescript-sdk).
+// (https://github.com/modelcontextprotocol/typescript-sdk). QuotaExceeded (-32002) is
+// selenosis-defined and returned when a session quota rejects initialize.
 const (
 	InvalidRequest  = -32600
 	InvalidParams   = -32602
 	InternalError   = -32603
 	SessionNotFound = -32001
+	QuotaExceeded   = -32002
 )
 
 // WriteError writes an MCP (JSON-RPC 2.0) error response with the given HTTP status and code.
 func WriteError(rw http.ResponseWriter, status, code int, message string) {
+	WriteErrorWithData(rw, status, code, message, nil)
+}
+
+// WriteErrorWithData is WriteError with the optional error "data" member set;
+// a nil data is omitted.
+func WriteErrorWithData(rw http.ResponseWriter, status, code int, message string, data any) {
+	errObj := map[string]any{"code": code, "message": message}
+	if data != nil {
+		errObj["data"] = data
+	}
+
 	rw.Header().Set("Content-Type", "application/json")
 	rw.WriteHeader(status)
 	json.NewEncoder(rw).Encode(map[string]any{
 		"jsonrpc": "2.0",
 		"id":      nil,
-		"error":   map[string]any{"code": code, "message": message},
+		"error":   errObj,
 	})
 }
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -58,3 +59,26 @@ func TestWriteError(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteErrorWithData(t *testing.T) {
+	rw := httptest.NewRecorder()
+	WriteErrorWithData(rw, http.StatusInternalServerError, InternalError, "Internal error", map[string]string{"reason": "Evicted"})
+
+	var body struct {
+		Error struct {
+			Data map[string]string `json:"data"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode body %q: %v", rw.Body.String(), err)
+	}
+	if body.Error.Data["reason"] != "Evicted" {
+		t.Fatalf("expected data reason Evicted, got %v", body.Error.Data)
+	}
+
+	rw = httptest.NewRecorder()
+	WriteError(rw, http.StatusInternalServerError, InternalError, "Internal error")
+	if strings.Contains(rw.Body.String(), `"data"`) {
+		t.Fatalf("expected no data member, got %s", rw.Body.String())
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var ErrShuttingDown = errors.New("websocket proxy shutting down")
+
+const trackerPollInterval = 100 * time.Millisecond
+
+// Tracker keeps the WebSocket connections proxied by one or more WSProxy, so
+// that they can be ended with a close frame on shutdown. http.Server.Shutdown
+// does not wait for hijacked connections.
+type Tracker struct {
+	mu       sync.Mutex
+	shutdown bool
+	pairs    map[*wsPair]struct{}
+}
+
+type wsPair struct {
+	client, upstream *websocket.Conn
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{pairs: map[*wsPair]struct{}{}}
+}
+
+func WithTracker(t *Tracker) WSProxyOption {
+	return func(p *WSProxy) { p.tracker = t }
+}
+
+// Active returns the number of proxied connections.
+func (t *Tracker) Active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pairs)
+}
+
+func (t *Tracker) accepting() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.shutdown
+}
+
+// track registers a proxied connection. It returns false once Shutdown was
+// called.
+func (t *Tracker) track(pair *wsPair) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shutdown {
+		return false
+	}
+	t.pairs[pair] = struct{}{}
+	return true
+}
+
+func (t *Tracker) untrack(pair *wsPair) {
+	t.mu.Lock()
+	delete(t.pairs, pair)
+	t.mu.Unlock()
+}
+
+// Shutdown stops accepting new connections and waits for the proxied ones
+// to end. When ctx is done first, the remaining ones are closed with 1001
+// (going away) sent to both peers, and ctx.Err() is returned.
+func (t *Tracker) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.shutdown = true
+	t.mu.Unlock()
+
+	ticker := time.NewTicker(trackerPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if t.Active() == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			t.closeAll()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *Tracker) closeAll() {
+	t.mu.Lock()
+	pairs := make([]*wsPair, 0, len(t.pairs))
+	for pair := range t.pairs {
+		pairs = append(pairs, pair)
+	}
+	t.mu.Unlock()
+
+	for _, pair := range pairs {
+		pair.goAway()
+	}
+}
+
+// goAway sends 1001 (going away) to both peers and closes the connections.
+func (p *wsPair) goAway() {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	deadline := time.Now().Add(time.Second)
+
+	_ = p.client.WriteControl(websocket.CloseMessage, msg, deadline)
+	_ = p.upstream.WriteControl(websocket.CloseMessage, msg, deadline)
+	_ = p.client.Close()
+	_ = p.upstream.Close()
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConnPair returns the server and client ends of a WebSocket connection.
+func wsConnPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+
+	serverConns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverConns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Close() })
+
+	server := <-serverConns
+	t.Cleanup(func() { _ = server.Close() })
+	return server, client
+}
+
+func TestTrackerShutdownWithoutConnections(t *testing.T) {
+	tr := NewTracker()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if tr.track(&wsPair{}) {
+		t.Fatal("expected tracker to refuse connections after shutdown")
+	}
+}
+
+func TestTrackerShutdownWaitsForConnections(t *testing.T) {
+	tr := NewTracker()
+	pair := &wsPair{}
+	tr.track(pair)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tr.untrack(pair)
+	}()
+
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("expected connections to end, got %v", err)
+	}
+}
+
+func TestTrackerShutdownSendsGoingAway(t *testing.T) {
+	clientSide, client := wsConnPair(t)
+	upstreamSide, upstream := wsConnPair(t)
+
+	tr := NewTracker()
+	tr.track(&wsPair{client: clientSide, upstream: upstreamSide})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err := tr.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+
+	for name, conn := range map[string]*websocket.Conn{"client": client, "upstream": upstream} {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Fatalf("expected %s to receive 1001, got %v", name, err)
+		}
+	}
+}
+
+func TestWSProxyRefusesAfterShutdown(t *testing.T) {
+	tr := NewTracker()
+	_ = tr.Shutdown(context.Background())
+
+	p := NewWebSocketReverseProxy(func(r *http.Request) (*url.URL, error) {
+		t.Fatal("expected no target to be resolved")
+		return nil, nil
+	}, WithTracker(tr))
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/ws", nil))
+
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", rw.Code)
+	}
+}
@@ -29,6 +29,12 @@ func WithOnClose(f func()) WSProxyOption {
 	return func(p *WSProxy) { p.onClose = f }
 }
 
+// WithUpgradeModifier lets f add headers to the upgrade response sent to the
+// client, once the upstream handshake succeeded.
+func WithUpgradeModifier(f func(upstream *http.Response, header http.Header)) WSProxyOption {
+	return func(p *WSProxy) { p.upgradeModifier = f }
+}
+
 func WithRetryTimeout(timeout time.Duration) WSProxyOption {
 	return func(p *WSProxy) {
 		p.dialRetryEnabled = true
@@ -47,6 +53,10 @@ type WSProxy struct {
 	onConnect func()
 	onMessage func()
 	onClose   func()
+
+	upgradeModifier func(upstream *http.Response, header http.Header)
+
+	tracker *Tracker
 }
 
 func NewWebSocketReverseProxy(resolver TargetResolver, opts ...WSProxyOption) *WSProxy {
@@ -86,6 +96,12 @@ func (p *WSProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		err          error
 	)
 
+	if p.tracker != nil && !p.tracker.accepting() {
+		log.Warn().Msg("websocket proxy shutting down, refusing connection")
+		http.Error(w, ErrShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	targetURL, err := p.Resolve(r)
 	if err != nil {
 		log.Error().Err(err).Msg("resolve target URL failed")
@@ -125,6 +141,10 @@ func (p *WSProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		upgradeHeaders.Set("Sec-WebSocket-Protocol", proto)
 	}
 
+	if p.upgradeModifier != nil {
+		p.upgradeModifier(resp, upgradeHeaders)
+	}
+
 	clientConn, err := p.Upgrader.Upgrade(w, r, upgradeHeaders)
 	if err != nil {
 		log.Error().Err(err).Msg("client websocket upgrade failed")
@@ -134,6 +154,16 @@ func (p *WSProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if p.tracker != nil {
+		pair := &wsPair{client: clientConn, upstream: upstreamConn}
+		if !p.tracker.track(pair) {
+			log.Warn().Msg("websocket proxy shutting down, closing connection")
+			pair.goAway()
+			return
+		}
+		defer p.tracker.untrack(pair)
+	}
+
 	if p.onConnect != nil {
 		p.onConnect()
 	}
@@ -260,18 +290,36 @@ func dialWithWait(ctx context.Context, target string, dialer *websocket.Dialer,
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	ticker := time.NewTicker(100 * time.Millisecond)
+	var (
+		conn *websocket.Conn
+		resp *http.Response
+	)
+	err := Retry(ctx, 100*time.Millisecond, func(ctx context.Context) error {
+		var err error
+		conn, resp, err = dialer.DialContext(ctx, target, headers)
+		return err
+	})
+	if err != nil {
+		return nil, resp, fmt.Errorf("could not connect to %s after %v: %w", target, timeout, err)
+	}
+	return conn, resp, nil
+}
+
+// Retry calls attempt every interval until it succeeds or ctx is done, in
+// which case the error of the last attempt is returned.
+func Retry(ctx context.Context, interval time.Duration, attempt func(context.Context) error) error {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
-		conn, resp, err := dialer.DialContext(ctx, target, headers)
+		err := attempt(ctx)
 		if err == nil {
-			return conn, resp, nil
+			return nil
 		}
 
 		select {
 		case <-ctx.Done():
-			return nil, resp, fmt.Errorf("could not connect to %s after %v: %w", target, timeout, err)
+			return err
 		case <-ticker.C:
 			continue
 		}
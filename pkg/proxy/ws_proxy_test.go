@@ -655,3 +655,33 @@ func readFramePayload(r io.Reader) ([]byte, byte, error) {
 	}
 	return payload, opcode, nil
 }
+
+func TestWithUpgradeModifierOption(t *testing.T) {
+	p := NewWebSocketReverseProxy(func(r *http.Request) (*url.URL, error) {
+		return url.Parse("ws://example.com")
+	}, WithUpgradeModifier(func(upstream *http.Response, header http.Header) {
+		header.Set("Server-Timing", "sidecar;dur=1")
+	}))
+
+	header := http.Header{}
+	p.upgradeModifier(&http.Response{}, header)
+	if header.Get("Server-Timing") != "sidecar;dur=1" {
+		t.Fatalf("expected modifier to set header, got %v", header)
+	}
+}
+
+func TestRetryReturnsLastError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var attempts int32
+	err := Retry(ctx, 10*time.Millisecond, func(ctx context.Context) error {
+		return fmt.Errorf("attempt %d", atomic.AddInt32(&attempts, 1))
+	})
+	if err == nil || err.Error() != fmt.Sprintf("attempt %d", atomic.LoadInt32(&attempts)) {
+		t.Fatalf("expected error of the last attempt, got %v", err)
+	}
+	if atomic.LoadInt32(&attempts) < 2 {
+		t.Fatalf("expected retries, got %d attempts", attempts)
+	}
+}
@@ -0,0 +1,158 @@
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Rule limits the number of concurrent sessions that match it. Empty
+// selectors match anything. With PerOwner set the limit applies to each
+// owner on its own, otherwise to all matching owners together.
+type Rule struct {
+	Name           string   `json:"name"`
+	Owners         []string `json:"owners,omitempty"`
+	BrowserName    string   `json:"browserName,omitempty"`
+	BrowserVersion string   `json:"browserVersion,omitempty"`
+	PerOwner       bool     `json:"perOwner,omitempty"`
+	MaxSessions    int      `json:"maxSessions"`
+}
+
+type Session struct {
+	Name           string
+	Owner          string
+	BrowserName    string
+	BrowserVersion string
+}
+
+type ExceededError struct {
+	Rule        string
+	MaxSessions int
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s: rule %q allows %d concurrent sessions", ErrQuotaExceeded, e.Rule, e.MaxSessions)
+}
+
+func (e *ExceededError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// Lister returns the sessions that currently count against quotas.
+type Lister func(ctx context.Context) ([]Session, error)
+
+func (r Rule) matches(s Session) bool {
+	if len(r.Owners) > 0 && !slices.Contains(r.Owners, s.Owner) {
+		return false
+	}
+	if r.BrowserName != "" && r.BrowserName != s.BrowserName {
+		return false
+	}
+	if r.BrowserVersion != "" && r.BrowserVersion != s.BrowserVersion {
+		return false
+	}
+	return true
+}
+
+type Enforcer struct {
+	rules []Rule
+	list  Lister
+
+	mu       sync.Mutex
+	inflight map[string]Session
+}
+
+func NewEnforcer(rules []Rule, list Lister) *Enforcer {
+	return &Enforcer{
+		rules:    rules,
+		list:     list,
+		inflight: map[string]Session{},
+	}
+}
+
+// Reserve checks s against every matching rule and, if it fits, holds a
+// place for it until release is called. Sessions that have been reserved
+// but are already returned by the lister are only counted once.
+func (e *Enforcer) Reserve(ctx context.Context, s Session) (func(), error) {
+	var applicable []Rule
+	for _, r := range e.rules {
+		if r.matches(s) {
+			applicable = append(applicable, r)
+		}
+	}
+
+	if len(applicable) == 0 {
+		return func() {}, nil
+	}
+
+	listed, err := e.list(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list sessions: %w", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	current := make([]Session, 0, len(listed)+len(e.inflight))
+	for _, l := range listed {
+		if _, ok := e.inflight[l.Name]; !ok {
+			current = append(current, l)
+		}
+	}
+	for _, r := range e.inflight {
+		current = append(current, r)
+	}
+
+	for _, r := range applicable {
+		var n int
+		for _, c := range current {
+			if r.matches(c) && (!r.PerOwner || c.Owner == s.Owner) {
+				n++
+			}
+		}
+		if n >= r.MaxSessions {
+			return nil, &ExceededError{Rule: r.Name, MaxSessions: r.MaxSessions}
+		}
+	}
+
+	e.inflight[s.Name] = s
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			e.mu.Lock()
+			delete(e.inflight, s.Name)
+			e.mu.Unlock()
+		})
+	}, nil
+}
+
+func LoadRulesFromEnv(envVarName string) ([]Rule, error) {
+	var rules []Rule
+
+	env := os.Getenv(envVarName)
+	if env == "" {
+		return rules, nil
+	}
+
+	if err := json.Unmarshal([]byte(env), &rules); err != nil {
+		return nil, fmt.Errorf("cannot parse JSON from %s: %w", envVarName, err)
+	}
+
+	for i, r := range rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("quota rule %d has no name", i)
+		}
+		if r.MaxSessions < 0 {
+			return nil, fmt.Errorf("quota rule %q has negative maxSessions", r.Name)
+		}
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,134 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+)
+
+func staticLister(sessions ...Session) Lister {
+	return func(ctx context.Context) ([]Session, error) { return sessions, nil }
+}
+
+func TestReserveNoMatchingRule(t *testing.T) {
+	e := NewEnforcer([]Rule{{Name: "firefox", BrowserName: "firefox", MaxSessions: 0}}, func(ctx context.Context) ([]Session, error) {
+		t.Fatal("lister must not be called without matching rules")
+		return nil, nil
+	})
+
+	release, err := e.Reserve(context.Background(), Session{Name: "a", BrowserName: "chrome"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	release()
+}
+
+func TestReservePerOwner(t *testing.T) {
+	rules := []Rule{{Name: "per-user", PerOwner: true, MaxSessions: 1}}
+	e := NewEnforcer(rules, staticLister(Session{Name: "x", Owner: "alice"}))
+
+	_, err := e.Reserve(context.Background(), Session{Name: "a", Owner: "alice"})
+	var exceeded *ExceededError
+	if !errors.As(err, &exceeded) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected quota exceeded, got %v", err)
+	}
+	if exceeded.Rule != "per-user" || exceeded.MaxSessions != 1 {
+		t.Fatalf("unexpected error details: %+v", exceeded)
+	}
+
+	release, err := e.Reserve(context.Background(), Session{Name: "b", Owner: "bob"})
+	if err != nil {
+		t.Fatalf("expected bob to be admitted, got %v", err)
+	}
+	release()
+}
+
+func TestReserveGroup(t *testing.T) {
+	rules := []Rule{{Name: "qa", Owners: []string{"alice", "bob"}, MaxSessions: 2}}
+	e := NewEnforcer(rules, staticLister(Session{Name: "x", Owner: "alice"}, Session{Name: "y", Owner: "carol"}))
+
+	release, err := e.Reserve(context.Background(), Session{Name: "a", Owner: "bob"})
+	if err != nil {
+		t.Fatalf("expected admission, got %v", err)
+	}
+
+	if _, err := e.Reserve(context.Background(), Session{Name: "b", Owner: "alice"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected in-flight reservation to count, got %v", err)
+	}
+
+	if _, err := e.Reserve(context.Background(), Session{Name: "c", Owner: "carol"}); err != nil {
+		t.Fatalf("expected owner outside the group to be admitted, got %v", err)
+	}
+
+	release()
+	release()
+
+	if _, err := e.Reserve(context.Background(), Session{Name: "d", Owner: "alice"}); err != nil {
+		t.Fatalf("expected admission after release, got %v", err)
+	}
+}
+
+func TestReserveBrowser(t *testing.T) {
+	rules := []Rule{{Name: "chrome-120", BrowserName: "chrome", BrowserVersion: "120", MaxSessions: 1}}
+	e := NewEnforcer(rules, staticLister(Session{Name: "x", BrowserName: "chrome", BrowserVersion: "120"}))
+
+	if _, err := e.Reserve(context.Background(), Session{Name: "a", BrowserName: "chrome", BrowserVersion: "120"}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected quota exceeded, got %v", err)
+	}
+	if _, err := e.Reserve(context.Background(), Session{Name: "b", BrowserName: "chrome", BrowserVersion: "121"}); err != nil {
+		t.Fatalf("expected other version to be admitted, got %v", err)
+	}
+}
+
+func TestReserveDoesNotDoubleCountListedReservation(t *testing.T) {
+	rules := []Rule{{Name: "all", MaxSessions: 2}}
+	var listed []Session
+	e := NewEnforcer(rules, func(ctx context.Context) ([]Session, error) { return listed, nil })
+
+	if _, err := e.Reserve(context.Background(), Session{Name: "a"}); err != nil {
+		t.Fatalf("expected admission, got %v", err)
+	}
+
+	listed = []Session{{Name: "a"}}
+	if _, err := e.Reserve(context.Background(), Session{Name: "b"}); err != nil {
+		t.Fatalf("expected reserved session to be counted once, got %v", err)
+	}
+}
+
+func TestReserveListError(t *testing.T) {
+	e := NewEnforcer([]Rule{{Name: "all", MaxSessions: 1}}, func(ctx context.Context) ([]Session, error) {
+		return nil, errors.New("boom")
+	})
+
+	_, err := e.Reserve(context.Background(), Session{Name: "a"})
+	if err == nil || errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected list error, got %v", err)
+	}
+}
+
+func TestLoadRulesFromEnv(t *testing.T) {
+	const name = "TEST_SESSION_QUOTAS"
+
+	os.Unsetenv(name)
+	rules, err := LoadRulesFromEnv(name)
+	if err != nil || len(rules) != 0 {
+		t.Fatalf("expected no rules, got %v %v", rules, err)
+	}
+
+	t.Setenv(name, `[{"name":"qa","owners":["alice"],"maxSessions":3}]`)
+	rules, err = LoadRulesFromEnv(name)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(rules) != 1 || rules[0].Owners[0] != "alice" || rules[0].MaxSessions != 3 {
+		t.Fatalf("unexpected rules: %+v", rules)
+	}
+
+	for _, bad := range []string{`{`, `[{"maxSessions":1}]`, `[{"name":"x","maxSessions":-1}]`} {
+		t.Setenv(name, bad)
+		if _, err := LoadRulesFromEnv(name); err == nil {
+			t.Fatalf("expected error for %s", bad)
+		}
+	}
+}
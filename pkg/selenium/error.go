@@ -35,6 +35,10 @@ func ErrBadRequest(err error) *SeleniumError {
 	return Error("bad request", err)
 }
 
+func ErrTimeout(err error) *SeleniumError {
+	return Error("timeout", err)
+}
+
 func ErrUnknown(err error) *SeleniumError {
 	return Error("unknown error", err)
 }
@@ -20,6 +20,7 @@ func TestErrorConstructors(t *testing.T) {
 		{ErrInvalidSessionId, "invalid session id"},
 		{ErrInvalidArgument, "invalid argument"},
 		{ErrBadRequest, "bad request"},
+		{ErrTimeout, "timeout"},
 		{ErrUnknown, "unknown error"},
 	}
 
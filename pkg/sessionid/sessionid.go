@@ -0,0 +1,105 @@
+package sessionid
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrMalformed = errors.New("malformed session id")
+	ErrForged    = errors.New("session id signature mismatch")
+)
+
+const (
+	version byte = 2
+	ivSize       = 12
+	tagSize      = 16
+)
+
+var encoding = base64.RawURLEncoding
+
+// Codec makes session ids that carry the pod IP of a session and a nonce of
+// its Browser, encrypted and authenticated with AES-GCM, so that ids reveal
+// nothing about the cluster. They are decoded without any state, so every
+// hub replica that shares the secret can route them. The IV is derived from
+// the content, so the same session always gets the same id.
+type Codec struct {
+	aead  cipher.AEAD
+	ivKey []byte
+}
+
+func New(secret []byte) *Codec {
+	encKey := derive(secret, "selenosis session id encryption")
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		// a 32 byte key is always valid
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &Codec{aead: aead, ivKey: derive(secret, "selenosis session id iv")}
+}
+
+func derive(secret []byte, label string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(label))
+	return h.Sum(nil)
+}
+
+// Encode returns the session id for the Browser with the given nonce at ip.
+func (c *Codec) Encode(ip net.IP, nonce uuid.UUID) (string, error) {
+	addr := ip.To4()
+	if addr == nil {
+		addr = ip.To16()
+	}
+	if addr == nil {
+		return "", errors.New("invalid IP (not IPv4/IPv6)")
+	}
+
+	plain := make([]byte, 0, len(addr)+len(nonce))
+	plain = append(plain, addr...)
+	plain = append(plain, nonce[:]...)
+
+	h := hmac.New(sha256.New, c.ivKey)
+	h.Write(plain)
+	iv := h.Sum(nil)[:ivSize]
+
+	raw := make([]byte, 0, 1+ivSize+len(plain)+tagSize)
+	raw = append(raw, version)
+	raw = append(raw, iv...)
+	raw = c.aead.Seal(raw, iv, plain, raw[:1])
+	return encoding.EncodeToString(raw), nil
+}
+
+// Decode returns the pod IP and Browser nonce of a session id made by
+// Encode. Ids not made with the same secret fail with ErrForged.
+func (c *Codec) Decode(id string) (net.IP, uuid.UUID, error) {
+	raw, err := encoding.DecodeString(id)
+	if err != nil {
+		return nil, uuid.UUID{}, ErrMalformed
+	}
+
+	var nonce uuid.UUID
+	addrLen := len(raw) - 1 - ivSize - len(nonce) - tagSize
+	if addrLen != net.IPv4len && addrLen != net.IPv6len || raw[0] != version {
+		return nil, uuid.UUID{}, ErrMalformed
+	}
+
+	plain, err := c.aead.Open(nil, raw[1:1+ivSize], raw[1+ivSize:], raw[:1])
+	if err != nil {
+		return nil, uuid.UUID{}, ErrForged
+	}
+
+	ip := net.IP(plain[:addrLen])
+	copy(nonce[:], plain[addrLen:])
+	return ip, nonce, nil
+}
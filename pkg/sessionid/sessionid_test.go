@@ -0,0 +1,105 @@
+package sessionid
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestEncodeDecodeRoundtrip(t *testing.T) {
+	c := New([]byte("secret"))
+	nonce := uuid.New()
+
+	for _, addr := range []string{"10.0.0.1", "2001:db8::1"} {
+		id, err := c.Encode(net.ParseIP(addr), nonce)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", addr, err)
+		}
+		if strings.Contains(id, addr) {
+			t.Fatalf("%s: expected address not to appear in id %q", addr, id)
+		}
+
+		ip, got, err := c.Decode(id)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", addr, err)
+		}
+		if !ip.Equal(net.ParseIP(addr)) || got != nonce {
+			t.Fatalf("%s: roundtrip failed: got %v %v", addr, ip, got)
+		}
+	}
+}
+
+func TestEncodeHidesIP(t *testing.T) {
+	c := New([]byte("secret"))
+	ip := net.ParseIP("10.0.0.1").To4()
+
+	a, _ := c.Encode(ip, uuid.UUID{})
+	b, _ := c.Encode(net.ParseIP("10.0.0.2"), uuid.UUID{})
+	rawA, _ := encoding.DecodeString(a)
+	rawB, _ := encoding.DecodeString(b)
+	if bytes.Contains(rawA, ip) || bytes.Equal(rawA[1+ivSize:1+ivSize+3], rawB[1+ivSize:1+ivSize+3]) {
+		t.Fatalf("expected the IP not to be readable from %q", a)
+	}
+
+	if again, _ := c.Encode(ip, uuid.UUID{}); again != a {
+		t.Fatal("expected the same session to get the same id")
+	}
+}
+
+func TestEncodeDiffersPerNonce(t *testing.T) {
+	c := New([]byte("secret"))
+	ip := net.ParseIP("10.0.0.1")
+
+	a, _ := c.Encode(ip, uuid.New())
+	b, _ := c.Encode(ip, uuid.New())
+	if a == b {
+		t.Fatal("expected ids of different Browsers at the same IP to differ")
+	}
+}
+
+func TestDecodeRejectsForgedIds(t *testing.T) {
+	c := New([]byte("secret"))
+	id, err := c.Encode(net.ParseIP("10.0.0.1"), uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := New([]byte("other")).Decode(id); !errors.Is(err, ErrForged) {
+		t.Fatalf("expected ErrForged for another secret, got %v", err)
+	}
+
+	raw, _ := encoding.DecodeString(id)
+	raw[len(raw)-1] ^= 1
+	if _, _, err := c.Decode(encoding.EncodeToString(raw)); !errors.Is(err, ErrForged) {
+		t.Fatalf("expected ErrForged for a tampered id, got %v", err)
+	}
+}
+
+func TestDecodeRejectsMalformedIds(t *testing.T) {
+	c := New([]byte("secret"))
+	id, _ := c.Encode(net.ParseIP("10.0.0.1"), uuid.New())
+	raw, _ := encoding.DecodeString(id)
+	raw[0] = 1 // ids signed before they were encrypted
+
+	for _, id := range []string{
+		"",
+		"not base64!",
+		uuid.NewString(),
+		encoding.EncodeToString(raw),
+		id[:len(id)-4],
+	} {
+		if _, _, err := c.Decode(id); !errors.Is(err, ErrMalformed) {
+			t.Fatalf("%q: expected ErrMalformed, got %v", id, err)
+		}
+	}
+}
+
+func TestEncodeInvalidIP(t *testing.T) {
+	if _, err := New([]byte("secret")).Encode(nil, uuid.New()); err == nil {
+		t.Fatal("expected error for nil IP")
+	}
+}
@@ -0,0 +1,332 @@
+package usage
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidGroupBy = errors.New(`groupBy must be "owner", "browser" or "label:KEY"`)
+
+type Session struct {
+	Name           string            `json:"name"`
+	Owner          string            `json:"owner,omitempty"`
+	BrowserName    string            `json:"browserName,omitempty"`
+	BrowserVersion string            `json:"browserVersion,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+}
+
+const (
+	opStart = "start"
+	opStop  = "stop"
+)
+
+// record is a line of the ledger file. Stop records only carry the name.
+type record struct {
+	Op   string    `json:"op"`
+	Time time.Time `json:"time"`
+	Session
+}
+
+type entry struct {
+	session Session
+	start   time.Time
+	end     time.Time
+}
+
+// compactInterval is how often a ledger with a retention drops the sessions
+// that ended before it.
+const compactInterval = time.Hour
+
+// Ledger accumulates the start and stop times of sessions. Every change is
+// appended to a file, which is replayed when the ledger is opened again.
+// With a retention, sessions that ended longer ago are dropped from memory
+// and the file is rewritten without them, at most once an hour.
+type Ledger struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	sessions  map[string]*entry
+	retention time.Duration
+	compacted time.Time
+}
+
+// Open replays the ledger file at path, creating it if needed, and opens it
+// for appending. A line that cannot be decoded, such as one cut short by a
+// crash, is skipped. A zero retention keeps every session.
+func Open(path string, retention time.Duration) (*Ledger, error) {
+	l := &Ledger{path: path, sessions: map[string]*entry{}, retention: retention}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.Name == "" {
+			continue
+		}
+		l.apply(r)
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	// terminate a line cut short, so that the next record starts afresh
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, info.Size()-1); err == nil && b[0] != '\n' {
+			if _, err := f.Write([]byte("\n")); err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+	}
+
+	l.file = f
+	if err := l.compactLocked(time.Now()); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("compact %s: %w", path, err)
+	}
+	return l, nil
+}
+
+// compactLocked drops the sessions that ended before the retention and
+// rewrites the file with the rest. The new file replaces the old one only
+// once it is complete.
+func (l *Ledger) compactLocked(now time.Time) error {
+	if l.retention <= 0 {
+		return nil
+	}
+	l.compacted = now
+
+	cutoff := now.Add(-l.retention)
+	dropped := 0
+	for name, e := range l.sessions {
+		if !e.end.IsZero() && e.end.Before(cutoff) {
+			delete(l.sessions, name)
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		return nil
+	}
+
+	entries := make([]*entry, 0, len(l.sessions))
+	for _, e := range l.sessions {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *entry) int {
+		return cmp.Or(a.start.Compare(b.start), cmp.Compare(a.session.Name, b.session.Name))
+	})
+
+	tmp := l.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		err = errors.Join(err, enc.Encode(record{Op: opStart, Time: e.start, Session: e.session}))
+		if !e.end.IsZero() {
+			err = errors.Join(err, enc.Encode(record{Op: opStop, Time: e.end, Session: Session{Name: e.session.Name}}))
+		}
+	}
+	if err = errors.Join(err, w.Flush(), f.Sync(), f.Close()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = file
+	return nil
+}
+
+func (l *Ledger) apply(r record) {
+	switch r.Op {
+	case opStart:
+		if _, ok := l.sessions[r.Name]; !ok {
+			l.sessions[r.Name] = &entry{session: r.Session, start: r.Time}
+		}
+	case opStop:
+		if e, ok := l.sessions[r.Name]; ok && e.end.IsZero() {
+			e.end = r.Time
+		}
+	}
+}
+
+func (l *Ledger) write(r record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(append(data, '\n'))
+	return err
+}
+
+// Start records that s started at t. A session that is already known is
+// left alone.
+func (l *Ledger) Start(s Session, t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.sessions[s.Name]; ok {
+		return nil
+	}
+	r := record{Op: opStart, Time: t, Session: s}
+	l.apply(r)
+	return l.write(r)
+}
+
+// Stop records that the named session stopped at t. Sessions that never
+// started or already stopped are left alone.
+func (l *Ledger) Stop(name string, t time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.sessions[name]
+	if !ok || !e.end.IsZero() {
+		return nil
+	}
+	r := record{Op: opStop, Time: t, Session: Session{Name: name}}
+	l.apply(r)
+	if err := l.write(r); err != nil {
+		return err
+	}
+
+	if now := time.Now(); l.retention > 0 && now.Sub(l.compacted) >= compactInterval {
+		return l.compactLocked(now)
+	}
+	return nil
+}
+
+// Running returns the names of the sessions that have not stopped.
+func (l *Ledger) Running() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var names []string
+	for name, e := range l.sessions {
+		if e.end.IsZero() {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// GroupBy is the key sessions are aggregated by: "owner", "browser" (name
+// and version) or "label:KEY".
+type GroupBy string
+
+func ParseGroupBy(v string) (GroupBy, error) {
+	switch {
+	case v == "owner", v == "browser":
+		return GroupBy(v), nil
+	case strings.HasPrefix(v, "label:") && len(v) > len("label:"):
+		return GroupBy(v), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidGroupBy, v)
+}
+
+func (g GroupBy) key(s Session) string {
+	switch {
+	case g == "browser":
+		if s.BrowserVersion == "" {
+			return s.BrowserName
+		}
+		return s.BrowserName + "/" + s.BrowserVersion
+	case strings.HasPrefix(string(g), "label:"):
+		return s.Labels[strings.TrimPrefix(string(g), "label:")]
+	}
+	return s.Owner
+}
+
+// Query selects the sessions that ran between From and To, a zero From
+// meaning since the first one. A non-empty Owner limits it to the sessions
+// of that owner.
+type Query struct {
+	From    time.Time
+	To      time.Time
+	GroupBy GroupBy
+	Owner   string
+}
+
+type Row struct {
+	Key            string  `json:"key"`
+	Sessions       int     `json:"sessions"`
+	BrowserMinutes float64 `json:"browserMinutes"`
+}
+
+// Report aggregates the sessions of q by its GroupBy. Only the part of a
+// session that falls into the window counts, and sessions that have not
+// stopped count up to now.
+func (l *Ledger) Report(q Query, now time.Time) []Row {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rows := map[string]*Row{}
+	for _, e := range l.sessions {
+		if q.Owner != "" && e.session.Owner != q.Owner {
+			continue
+		}
+
+		start, end := e.start, e.end
+		if end.IsZero() {
+			end = now
+		}
+		if !q.From.IsZero() && start.Before(q.From) {
+			start = q.From
+		}
+		if end.After(q.To) {
+			end = q.To
+		}
+		if !end.After(start) {
+			continue
+		}
+
+		key := q.GroupBy.key(e.session)
+		row, ok := rows[key]
+		if !ok {
+			row = &Row{Key: key}
+			rows[key] = row
+		}
+		row.Sessions++
+		row.BrowserMinutes += end.Sub(start).Minutes()
+	}
+
+	result := make([]Row, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, *row)
+	}
+	slices.SortFunc(result, func(a, b Row) int {
+		return cmp.Compare(a.Key, b.Key)
+	})
+	return result
+}
@@ -0,0 +1,179 @@
+package usage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func openLedger(t *testing.T, path string) *Ledger {
+	t.Helper()
+	l, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func seed(t *testing.T, l *Ledger) {
+	t.Helper()
+	sessions := []struct {
+		s          Session
+		start, end time.Duration
+	}{
+		{Session{Name: "a", Owner: "alice", BrowserName: "chrome", BrowserVersion: "120.0", Labels: map[string]string{"team": "web"}}, 0, 10 * time.Minute},
+		{Session{Name: "b", Owner: "alice", BrowserName: "firefox", BrowserVersion: "125.0", Labels: map[string]string{"team": "web"}}, 5 * time.Minute, 35 * time.Minute},
+		{Session{Name: "c", Owner: "bob", BrowserName: "chrome", BrowserVersion: "120.0", Labels: map[string]string{"team": "api"}}, 20 * time.Minute, 0},
+	}
+	for _, tt := range sessions {
+		if err := l.Start(tt.s, t0.Add(tt.start)); err != nil {
+			t.Fatal(err)
+		}
+		if tt.end > 0 {
+			if err := l.Stop(tt.s.Name, t0.Add(tt.end)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	l := openLedger(t, filepath.Join(t.TempDir(), "usage.jsonl"))
+	seed(t, l)
+	now := t0.Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		query    Query
+		expected []Row
+	}{
+		{"owner", Query{To: now, GroupBy: "owner"}, []Row{{"alice", 2, 40}, {"bob", 1, 40}}},
+		{"browser", Query{To: now, GroupBy: "browser"}, []Row{{"chrome/120.0", 2, 50}, {"firefox/125.0", 1, 30}}},
+		{"label", Query{To: now, GroupBy: "label:team"}, []Row{{"api", 1, 40}, {"web", 2, 40}}},
+		{"missing label", Query{To: now, GroupBy: "label:cost"}, []Row{{"", 3, 80}}},
+		{"window", Query{From: t0.Add(30 * time.Minute), To: t0.Add(50 * time.Minute), GroupBy: "owner"}, []Row{{"alice", 1, 5}, {"bob", 1, 20}}},
+		{"owner filter", Query{To: now, GroupBy: "browser", Owner: "bob"}, []Row{{"chrome/120.0", 1, 40}}},
+		{"empty window", Query{From: now, To: now.Add(time.Hour), GroupBy: "owner"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.Report(tt.query, now); !slices.Equal(got, tt.expected) {
+				t.Fatalf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestLedgerSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	l, err := Open(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed(t, l)
+	l.Close()
+
+	// a record cut short by a crash
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"stop","na`)
+	f.Close()
+
+	l = openLedger(t, path)
+	if got := l.Running(); !slices.Equal(got, []string{"c"}) {
+		t.Fatalf("expected c to be running, got %v", got)
+	}
+	if err := l.Stop("c", t0.Add(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	l = openLedger(t, path)
+	if got := l.Running(); len(got) != 0 {
+		t.Fatalf("expected no running sessions, got %v", got)
+	}
+	expected := []Row{{"alice", 2, 40}, {"bob", 1, 10}}
+	if got := l.Report(Query{To: t0.Add(time.Hour), GroupBy: "owner"}, t0.Add(time.Hour)); !slices.Equal(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestLedgerRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	l := openLedger(t, path)
+	seed(t, l)
+	l.Close()
+
+	// a stops 10 minutes in, b 35 minutes in and c is running
+	l, err := Open(path, time.Since(t0.Add(20*time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	now := t0.Add(time.Hour)
+	expected := []Row{{"alice", 1, 30}, {"bob", 1, 40}}
+	if got := l.Report(Query{To: now, GroupBy: "owner"}, now); !slices.Equal(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Fatalf("expected the file to be rewritten with 3 records, got %d:\n%s", lines, data)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected no temporary file, got %v", err)
+	}
+
+	// records are appended to the rewritten file
+	if err := l.Stop("c", now); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if got := openLedger(t, path).Running(); len(got) != 0 {
+		t.Fatalf("expected no running sessions, got %v", got)
+	}
+}
+
+func TestStartStopIdempotent(t *testing.T) {
+	l := openLedger(t, filepath.Join(t.TempDir(), "usage.jsonl"))
+
+	if err := l.Stop("unknown", t0); err != nil {
+		t.Fatal(err)
+	}
+	l.Start(Session{Name: "a", Owner: "alice"}, t0)
+	l.Start(Session{Name: "a", Owner: "bob"}, t0.Add(time.Minute))
+	l.Stop("a", t0.Add(2*time.Minute))
+	l.Stop("a", t0.Add(5*time.Minute))
+
+	expected := []Row{{"alice", 1, 2}}
+	if got := l.Report(Query{To: t0.Add(time.Hour), GroupBy: "owner"}, t0.Add(time.Hour)); !slices.Equal(got, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestParseGroupBy(t *testing.T) {
+	for _, v := range []string{"owner", "browser", "label:team"} {
+		if g, err := ParseGroupBy(v); err != nil || string(g) != v {
+			t.Fatalf("%q: unexpected %q, %v", v, g, err)
+		}
+	}
+	for _, v := range []string{"", "team", "label:"} {
+		if _, err := ParseGroupBy(v); !errors.Is(err, ErrInvalidGroupBy) {
+			t.Fatalf("%q: expected ErrInvalidGroupBy, got %v", v, err)
+		}
+	}
+}
@@ -0,0 +1,640 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	logctx "github.com/alcounit/browser-controller/pkg/log"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	"github.com/alcounit/selenosis/v2/pkg/proxy"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// startupJobTTL is how long a finished asynchronous startup can still
+	// be polled.
+	startupJobTTL = 10 * time.Minute
+
+	defaultStartupPollWait = 30 * time.Second
+	// maxStartupPollWait stays below the 60s idle timeout common to load
+	// balancers.
+	maxStartupPollWait = 55 * time.Second
+	// startupLookupInterval is how often the Browser of a startup run by
+	// another replica is looked up while a poll waits for it.
+	startupLookupInterval = time.Second
+)
+
+// StartupLabelKey carries the handle of an asynchronous startup on every
+// Browser it tries, so that other replicas find the startup after a retry
+// replaced its first Browser.
+const StartupLabelKey = "selenosis.io/startup"
+
+const (
+	startupAccepted = "Accepted"
+	startupQueued   = "Queued"
+	startupPending  = "Pending"
+	startupRunning  = "Running"
+	startupFailed   = "Failed"
+)
+
+var ErrUnknownStartup = errors.New("unknown session startup")
+
+// startupStatus is the JSON view of an asynchronous startup.
+type startupStatus struct {
+	ID      string `json:"id"`
+	Phase   string `json:"phase"`
+	Browser string `json:"browser,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// startupJob is a session startup running independently of the request that
+// asked for it. collected tells whether a poll has been given the session.
+type startupJob struct {
+	id          string
+	owner       string
+	body        []byte
+	externalURL string
+
+	mu       sync.Mutex
+	status   startupStatus
+	changed  chan struct{}
+	response *recordedResponse
+	err      *browserError
+
+	collected atomic.Bool
+}
+
+func newStartupJob(id, owner string, body []byte, externalURL string) *startupJob {
+	return &startupJob{
+		id:          id,
+		owner:       owner,
+		body:        body,
+		externalURL: externalURL,
+		status:      startupStatus{ID: id, Phase: startupAccepted},
+		changed:     make(chan struct{}),
+	}
+}
+
+func (j *startupJob) update(f func(*startupStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(&j.status)
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *startupJob) finish(name string, response *recordedResponse, waitErr *browserError) {
+	j.update(func(st *startupStatus) {
+		if name != "" {
+			st.Browser = name
+		}
+		j.response, j.err = response, waitErr
+		if waitErr == nil {
+			st.Phase = startupRunning
+			return
+		}
+		st.Phase = startupFailed
+		st.Reason = waitErr.reason
+		st.Message = waitErr.message
+		if st.Message == "" && waitErr.err != nil {
+			st.Message = waitErr.err.Error()
+		}
+	})
+}
+
+// snapshot returns the current status and a channel that is closed on the
+// next change.
+func (j *startupJob) snapshot() (startupStatus, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status, j.changed
+}
+
+func (j *startupJob) result() (*recordedResponse, *browserError) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.response, j.err
+}
+
+func (st startupStatus) done() bool {
+	return st.Phase == startupRunning || st.Phase == startupFailed
+}
+
+type startupJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*startupJob
+}
+
+func newStartupJobs() *startupJobs {
+	return &startupJobs{jobs: map[string]*startupJob{}}
+}
+
+func (r *startupJobs) add(j *startupJob) {
+	r.mu.Lock()
+	r.jobs[j.id] = j
+	r.mu.Unlock()
+}
+
+func (r *startupJobs) get(id string) *startupJob {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.jobs[id]
+}
+
+// alias makes j known by id as well.
+func (r *startupJobs) alias(id string, j *startupJob) {
+	r.mu.Lock()
+	r.jobs[id] = j
+	r.mu.Unlock()
+}
+
+// remove forgets j under all of its ids.
+func (r *startupJobs) remove(j *startupJob) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, known := range r.jobs {
+		if known == j {
+			delete(r.jobs, id)
+		}
+	}
+}
+
+// CreateSessionAsync starts a WebDriver session and answers 202 Accepted with
+// a handle as soon as the Browser has been created or claimed from the pool,
+// or queued for admission. The handle of a claim is the name of the claimed
+// Browser, since pooled Browsers cannot be labelled. The capabilities are sent to the browser as soon as it runs, by this
+// replica alone, and the session is collected from SessionStartup. A session
+// that no poll collects within startupJobTTL, and that was not used either,
+// is deleted.
+func (s *Service) CreateSessionAsync(rw http.ResponseWriter, req *http.Request) {
+	log := logctx.FromContext(req.Context())
+
+	nsr, ok := readNewSessionRequest(rw, req)
+	if !ok {
+		return
+	}
+
+	if s.Draining() {
+		log.Warn().Msg("session refused, hub draining")
+		writeCreateSessionWaitError(rw, s.drainingError())
+		return
+	}
+
+	template, err := newBrowserTemplate(req.Context(), nsr.caps.GetBrowserName(), nsr.caps.GetBrowserVersion(), nsr.opts)
+	if err != nil {
+		log.Err(err).Msg("failed to set selenosis options annotation")
+		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(err))
+		return
+	}
+
+	labels := template.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[StartupLabelKey] = template.GetName()
+	template.SetLabels(labels)
+
+	log = browserLogger(log, template, s.config.Namespace).With().Str("startupId", template.GetName()).Logger()
+	lifetime := s.setSessionLifetime(template, nsr.sessionOpts)
+
+	owner, _ := auth.OwnerFrom(req.Context())
+	job := newStartupJob(template.GetName(), owner.Name, nsr.body, externalBaseURL(req).String())
+	s.startups.add(job)
+
+	trace := &startupTrace{
+		Queued: func() {
+			job.update(func(st *startupStatus) { st.Phase = startupQueued })
+		},
+		Created: func(name string) {
+			job.update(func(st *startupStatus) {
+				st.Phase = startupPending
+				st.Browser = name
+			})
+		},
+		Running: func(name string) {
+			// a claimed pooled Browser was never created
+			st, _ := job.snapshot()
+			if st.Phase != startupAccepted && st.Phase != startupQueued {
+				return
+			}
+			if st.Phase == startupAccepted {
+				s.startups.alias(name, job)
+			}
+			job.update(func(st *startupStatus) {
+				if st.Phase == startupAccepted {
+					st.ID = name
+				}
+				st.Phase = startupPending
+				st.Browser = name
+			})
+		},
+	}
+
+	ctx := withStartupTrace(logctx.IntoContext(context.WithoutCancel(req.Context()), log), trace)
+	go func() {
+		name, podIP, waitErr := s.startSession(ctx, log, template, nsr.opts, nsr.sessionOpts)
+		if waitErr == nil && net.ParseIP(podIP) == nil {
+			log.Err(fmt.Errorf("invalid pod IP: %s", podIP)).Msg("failed to parse pod IP")
+			s.deleteBrowser(ctx, log, name)
+			waitErr = &browserError{kind: browserCreate, err: errors.New("failed to get browser IP")}
+		}
+		var resp *recordedResponse
+		if waitErr == nil {
+			s.deadlines.set(podIP, name, deadlineAfter(lifetime))
+			resp, waitErr = s.forwardStartup(ctx, log, job, name, podIP, s.startupTimeout(nsr.caps.GetBrowserName(), nsr.caps.GetBrowserVersion(), nsr.sessionOpts))
+		}
+		job.finish(name, resp, waitErr)
+		time.AfterFunc(startupJobTTL, func() {
+			s.startups.remove(job)
+			if waitErr == nil && !job.collected.Load() {
+				s.deleteAbandonedStartup(ctx, log, name, podIP)
+			}
+		})
+	}()
+
+	for {
+		st, changed := job.snapshot()
+		if st.Phase != startupAccepted {
+			if st.Phase == startupFailed {
+				s.startups.remove(job)
+				_, waitErr := job.result()
+				writeCreateSessionWaitError(rw, waitErr)
+				return
+			}
+
+			log.Info().Str("phase", st.Phase).Msg("session startup accepted")
+			rw.Header().Set("Location", startupPath(st.ID))
+			writeJSON(rw, http.StatusAccepted, st)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			// the startup goes on and can still be polled
+			return
+		}
+	}
+}
+
+// SessionStartup reports the progress of an asynchronous startup. It waits
+// for the startup to finish, by long-poll or as a server-sent event stream,
+// and then answers with the WebDriver new session response of the browser.
+func (s *Service) SessionStartup(rw http.ResponseWriter, req *http.Request) {
+	log := logctx.FromContext(req.Context())
+
+	id := chi.URLParam(req, "sessionId")
+	job := s.startups.get(id)
+	if job != nil && !ownsStartup(req, job.owner) {
+		job = nil
+	}
+	if job == nil && !s.startupElsewhere(req, id) {
+		log.Warn().Str("startupId", id).Msg("unknown session startup")
+		writeErrorResponse(rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrUnknownStartup))
+		return
+	}
+
+	stream := strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+
+	wait := defaultStartupPollWait
+	if v := req.URL.Query().Get("wait"); v != "" && !stream {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(fmt.Errorf("invalid wait %q", v)))
+			return
+		}
+		wait = min(d, maxStartupPollWait)
+	}
+
+	if job == nil {
+		var cancel context.CancelFunc
+		job, cancel = s.lookupStartup(req.Context(), log, id)
+		defer cancel()
+	}
+
+	if stream {
+		s.streamStartup(rw, req, job)
+		return
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		st, changed := job.snapshot()
+		if st.done() {
+			break
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			writeJSON(rw, http.StatusAccepted, st)
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	resp, waitErr := job.result()
+	if waitErr != nil {
+		writeCreateSessionWaitError(rw, waitErr)
+		return
+	}
+	job.collect(resp)
+	resp.write(rw)
+}
+
+func (s *Service) streamStartup(rw http.ResponseWriter, req *http.Request, job *startupJob) {
+	flusher, _ := rw.(http.Flusher)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+
+	send := func(event string, data []byte) {
+		fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event, bytes.TrimSpace(data))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	for {
+		st, changed := job.snapshot()
+		data, _ := json.Marshal(st)
+		send("status", data)
+
+		if st.done() {
+			break
+		}
+
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	resp, waitErr := job.result()
+	if waitErr != nil {
+		var buf bytes.Buffer
+		errRw := &bufferedResponse{header: http.Header{}, body: &buf}
+		writeCreateSessionWaitError(errRw, waitErr)
+		send("error", buf.Bytes())
+		return
+	}
+
+	if resp.status < 200 || resp.status > 299 {
+		send("error", resp.body)
+		return
+	}
+	job.collect(resp)
+	send("session", resp.body)
+}
+
+func (j *startupJob) collect(resp *recordedResponse) {
+	if resp.status >= 200 && resp.status <= 299 {
+		j.collected.Store(true)
+	}
+}
+
+func ownsStartup(req *http.Request, owner string) bool {
+	if auth.IsAdmin(req.Context()) {
+		return true
+	}
+	caller, _ := auth.OwnerFrom(req.Context())
+	return caller.Name == owner
+}
+
+// forwardStartup sends the original capabilities to the browser once it is
+// running, on behalf of the startup rather than a poll, so that a poll that
+// goes away cannot leave the session half created. The response is kept for
+// the polls; when the browser cannot be reached it is deleted and the
+// startup fails.
+func (s *Service) forwardStartup(ctx context.Context, log zerolog.Logger, job *startupJob, name, podIP string, timeout time.Duration) (*recordedResponse, *browserError) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	target := &url.URL{Scheme: "http", Host: s.sidecarHost(podIP), Path: "/session"}
+	out, err := http.NewRequestWithContext(ctx, http.MethodPost, target.String(), bytes.NewReader(job.body))
+	if err != nil {
+		return nil, &browserError{kind: browserCreate, err: err, name: name}
+	}
+	out.Header.Set("Content-Type", "application/json")
+	out.Header.Set("X-Selenosis-External-URL", job.externalURL)
+
+	recorded, err := func() (*recordedResponse, error) {
+		resp, err := (&http.Client{Transport: proxy.DefaultTransport}).Do(out)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		recorded := &recordedResponse{status: resp.StatusCode, header: resp.Header.Clone(), body: body}
+		recorded.header.Del("Content-Length")
+		if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			if recorded.body, err = s.signSessionID(recorded.header, body, name, podIP); err != nil {
+				return nil, err
+			}
+		}
+		return recorded, nil
+	}()
+	if err != nil {
+		log.Err(err).Str("ip", podIP).Msg("session create proxy error")
+		s.deleteBrowser(ctx, log, name)
+		return nil, &browserError{kind: browserCreate, err: err, name: name}
+	}
+	return recorded, nil
+}
+
+// deleteAbandonedStartup deletes the Browser of a startup whose session no
+// poll on this replica collected. A poll on another replica may have, so a
+// browser that has left its start page is kept.
+func (s *Service) deleteAbandonedStartup(ctx context.Context, log zerolog.Logger, name, podIP string) {
+	if used, err := s.sessionNavigated(ctx, podIP); err != nil || used {
+		log.Info().Err(err).Str("name", name).Msg("keeping browser of uncollected session startup")
+		return
+	}
+	log.Warn().Str("name", name).Msg("session startup was never collected, deleting its browser")
+	s.deleteBrowser(ctx, log, name)
+}
+
+// sessionNavigated reports whether the WebDriver session at podIP has left
+// the page a browser starts on. A session that is gone counts as unused.
+func (s *Service) sessionNavigated(ctx context.Context, podIP string) (bool, error) {
+	plain, err := sidecarSessionID(net.ParseIP(podIP))
+	if err != nil {
+		return false, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, browserDeleteTimeout)
+	defer cancel()
+
+	target := &url.URL{Scheme: "http", Host: s.sidecarHost(podIP), Path: "/session/" + plain + "/url"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := (&http.Client{Transport: proxy.DefaultTransport}).Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return false, err
+	}
+	switch body.Value {
+	case "", "about:blank", "data:,":
+		return false, nil
+	}
+	return true, nil
+}
+
+// startupElsewhere reports whether id is the handle of a startup of the
+// caller, run by another replica.
+func (s *Service) startupElsewhere(req *http.Request, id string) bool {
+	b, err := s.startupBrowser(req.Context(), id)
+	return err == nil && b != nil && ownsStartup(req, s.browserOwner(b))
+}
+
+// startupBrowser returns the latest Browser of the startup with handle id:
+// the Browsers it tried carry the handle as their StartupLabelKey, and a
+// claimed pooled Browser is named by it. It returns nil if there is none.
+func (s *Service) startupBrowser(ctx context.Context, id string) (*browserv1.Browser, error) {
+	browsers, err := s.client.List(ctx, s.config.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *browserv1.Browser
+	for _, b := range browsers {
+		if b == nil || b.GetName() != id && b.GetLabels()[StartupLabelKey] != id {
+			continue
+		}
+		if latest == nil || latest.CreationTimestamp.Before(&b.CreationTimestamp) {
+			latest = b
+		}
+	}
+	return latest, nil
+}
+
+// startupRetryGrace is how long a startup run by another replica may go
+// without a live Browser before it is taken as ended, when ended is its
+// last Browser, nil if it has none: the replica that runs it may still
+// start another one after the longest retry backoff.
+func (s *Service) startupRetryGrace(ended *browserv1.Browser) time.Duration {
+	retry := s.config.Retry
+	if retry.MaxAttempts < 2 || ended != nil && !slices.Contains(retry.Reasons, ended.Status.Reason) {
+		return 0
+	}
+	return retry.backoff(retry.MaxAttempts) + startupLookupInterval
+}
+
+// lookupStartup follows a startup run by another replica through its
+// Browser until it fails or its session exists. The replica that runs it
+// sends the capabilities; this one only looks the session up in the sidecar.
+func (s *Service) lookupStartup(ctx context.Context, log zerolog.Logger, id string) (*startupJob, context.CancelFunc) {
+	job := newStartupJob(id, "", nil, "")
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		ticker := time.NewTicker(startupLookupInterval)
+		defer ticker.Stop()
+
+		// lost is when the startup was first seen without a live Browser
+		var lost time.Time
+		for {
+			b, err := s.startupBrowser(ctx, id)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				log.Err(err).Str("startupId", id).Msg("failed to look up session startup")
+			case b == nil || b.Status.Phase == "Failed" || b.Status.Phase == "Succeeded":
+				if lost.IsZero() {
+					lost = time.Now()
+				}
+				if time.Since(lost) < s.startupRetryGrace(b) {
+					break
+				}
+				if b == nil {
+					job.finish("", nil, &browserError{kind: browserCreate, err: ErrUnknownStartup, name: id})
+				} else {
+					job.finish(b.GetName(), nil, &browserError{kind: browserFailed, name: b.GetName(), reason: b.Status.Reason, message: b.Status.Message})
+				}
+				return
+			case b.Status.Phase == "Running":
+				lost = time.Time{}
+				if resp, ok := s.rebuildWebDriverSession(ctx, log, b.GetName(), b.Status.PodIP, b.Spec.BrowserName, b.Spec.BrowserVersion); ok {
+					job.finish(b.GetName(), resp, nil)
+					return
+				}
+				fallthrough
+			default:
+				lost = time.Time{}
+				if st, _ := job.snapshot(); st.Phase != startupPending || st.Browser != b.GetName() {
+					job.update(func(st *startupStatus) {
+						st.Phase = startupPending
+						st.Browser = b.GetName()
+					})
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return job, cancel
+}
+
+func startupPath(id string) string {
+	return "/selenosis/v1/sessions/" + id + "/startup"
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+// bufferedResponse captures an error response so that it can be sent as an
+// event.
+type bufferedResponse struct {
+	header http.Header
+	body   *bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header         { return b.header }
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+func (b *bufferedResponse) WriteHeader(int)             {}
@@ -0,0 +1,334 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	"github.com/rs/zerolog"
+)
+
+func asyncService(fc browserclient.Client) *Service {
+	return NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second})
+}
+
+func startAsync(t *testing.T, svc *Service, owner string) startupStatus {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/selenosis/v1/sessions", bytes.NewBufferString(validCapsBody()))
+	if owner != "" {
+		req = req.WithContext(auth.WithOwner(req.Context(), auth.Owner{Name: owner}))
+	}
+	rw := httptest.NewRecorder()
+
+	svc.CreateSessionAsync(rw, req)
+
+	if rw.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", rw.Code, rw.Body.String())
+	}
+
+	var st startupStatus
+	if err := json.Unmarshal(rw.Body.Bytes(), &st); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if loc := rw.Header().Get("Location"); loc != startupPath(st.ID) {
+		t.Fatalf("unexpected Location %q", loc)
+	}
+
+	// the job forwards through the transport of the test, so it must not
+	// outlive it
+	job := svc.startups.get(st.ID)
+	t.Cleanup(func() {
+		waitUntil(t, func() bool {
+			st, _ := job.snapshot()
+			return st.done()
+		})
+	})
+	return st
+}
+
+func pollStartup(svc *Service, id, query, owner string, header http.Header) *httptest.ResponseRecorder {
+	req := newRequestWithParams(http.MethodGet, startupPath(id)+query, nil, map[string]string{"sessionId": id})
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if owner != "" {
+		req = req.WithContext(auth.WithOwner(req.Context(), auth.Owner{Name: owner}))
+	}
+	rw := httptest.NewRecorder()
+	svc.SessionStartup(rw, req)
+	return rw
+}
+
+func TestCreateSessionAsyncLongPoll(t *testing.T) {
+	var calls atomic.Int32
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		if req.URL.Host != "127.0.0.1:4444" || req.URL.Path != "/session" {
+			t.Errorf("unexpected target %s", req.URL)
+		}
+		return response(http.StatusOK, `{"value":{"sessionId":"s1"}}`), nil
+	}))
+
+	fc := &slowClient{release: make(chan struct{})}
+	svc := asyncService(fc)
+
+	st := startAsync(t, svc, "alice")
+	if st.Phase != startupPending || st.Browser != st.ID {
+		t.Fatalf("expected pending startup, got %+v", st)
+	}
+
+	rw := pollStartup(svc, st.ID, "?wait=10ms", "alice", nil)
+	if rw.Code != http.StatusAccepted || !strings.Contains(rw.Body.String(), `"phase":"Pending"`) {
+		t.Fatalf("expected pending status, got %d %s", rw.Code, rw.Body.String())
+	}
+
+	close(fc.release)
+
+	for range 2 {
+		rw = pollStartup(svc, st.ID, "", "alice", nil)
+		if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"s1"`) {
+			t.Fatalf("expected session response, got %d %s", rw.Code, rw.Body.String())
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected capabilities to be forwarded once, got %d", calls.Load())
+	}
+}
+
+func TestCreateSessionAsyncEventStream(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"s1"}}`), nil
+	}))
+
+	fc := &slowClient{release: make(chan struct{})}
+	svc := asyncService(fc)
+	st := startAsync(t, svc, "")
+
+	close(fc.release)
+
+	rw := pollStartup(svc, st.ID, "", "", http.Header{"Accept": {"text/event-stream"}})
+
+	if ct := rw.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected Content-Type %q", ct)
+	}
+	body := rw.Body.String()
+	if !strings.Contains(body, "event: status\ndata: {") || !strings.Contains(body, `"phase":"Running"`) {
+		t.Fatalf("expected status events, got %q", body)
+	}
+	if !strings.Contains(body, "event: session\ndata: {\"value\":{\"sessionId\":\"s1\"}}\n\n") {
+		t.Fatalf("expected session event, got %q", body)
+	}
+}
+
+func TestCreateSessionAsyncFailedStartup(t *testing.T) {
+	fc := &fakeClient{stream: failedStream("Unschedulable")}
+	svc := asyncService(fc)
+
+	req := httptest.NewRequest(http.MethodPost, "/selenosis/v1/sessions", bytes.NewBufferString(validCapsBody()))
+	rw := httptest.NewRecorder()
+	svc.CreateSessionAsync(rw, req)
+
+	// the browser may fail before or after the handle is returned
+	if rw.Code == http.StatusInternalServerError {
+		if !strings.Contains(rw.Body.String(), "Unschedulable") {
+			t.Fatalf("expected failure reason, got %s", rw.Body.String())
+		}
+		return
+	}
+
+	var st startupStatus
+	json.Unmarshal(rw.Body.Bytes(), &st)
+
+	poll := pollStartup(svc, st.ID, "", "", nil)
+	if poll.Code != http.StatusInternalServerError || !strings.Contains(poll.Body.String(), "Unschedulable") {
+		t.Fatalf("expected failure with reason, got %d %s", poll.Code, poll.Body.String())
+	}
+}
+
+func TestCreateSessionAsyncCreateError(t *testing.T) {
+	fc := &fakeClient{stream: newFakeStream(), createErr: errors.New("boom")}
+	svc := asyncService(fc)
+
+	req := httptest.NewRequest(http.MethodPost, "/selenosis/v1/sessions", bytes.NewBufferString(validCapsBody()))
+	rw := httptest.NewRecorder()
+	svc.CreateSessionAsync(rw, req)
+
+	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.Error("failed to create browser", errors.New("boom")))
+}
+
+func TestCreateSessionAsyncInvalidBody(t *testing.T) {
+	svc := asyncService(&fakeClient{})
+
+	req := httptest.NewRequest(http.MethodPost, "/selenosis/v1/sessions", bytes.NewBufferString("{"))
+	rw := httptest.NewRecorder()
+	svc.CreateSessionAsync(rw, req)
+
+	verifyResponseError(t, rw, http.StatusBadRequest, selenium.ErrInvalidArgument(ErrDecodeRequestBody))
+}
+
+func TestSessionStartupUnknownOrForeign(t *testing.T) {
+	fc := &slowClient{release: make(chan struct{})}
+	defer close(fc.release)
+	svc := asyncService(fc)
+
+	rw := pollStartup(svc, "missing", "", "", nil)
+	verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrUnknownStartup))
+
+	st := startAsync(t, svc, "alice")
+	rw = pollStartup(svc, st.ID, "?wait=0s", "bob", nil)
+	verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrUnknownStartup))
+}
+
+func TestSessionStartupInvalidWait(t *testing.T) {
+	fc := &slowClient{release: make(chan struct{})}
+	defer close(fc.release)
+	svc := asyncService(fc)
+
+	st := startAsync(t, svc, "")
+	rw := pollStartup(svc, st.ID, "?wait=soon", "", nil)
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rw.Code)
+	}
+}
+
+func TestCreateSessionAsyncForwardsWithoutPoll(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if got := req.Header.Get("X-Selenosis-External-URL"); got != "http://example.com" {
+			t.Errorf("unexpected external URL %q", got)
+		}
+		return response(http.StatusOK, `{"value":{"sessionId":"s1"}}`), nil
+	}))
+
+	fc := &slowClient{release: make(chan struct{})}
+	svc := asyncService(fc)
+	st := startAsync(t, svc, "alice")
+	job := svc.startups.get(st.ID)
+
+	close(fc.release)
+	waitUntil(t, func() bool {
+		st, _ := job.snapshot()
+		return st.done()
+	})
+
+	resp, waitErr := job.result()
+	if waitErr != nil || resp == nil || !strings.Contains(string(resp.body), `"s1"`) {
+		t.Fatalf("expected the session to be created without a poll, got %v %v", resp, waitErr)
+	}
+}
+
+func TestSessionStartupAdmin(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"s1"}}`), nil
+	}))
+
+	fc := &slowClient{release: make(chan struct{})}
+	svc := asyncService(fc)
+	st := startAsync(t, svc, "alice")
+	close(fc.release)
+
+	req := newRequestWithParams(http.MethodGet, startupPath(st.ID), nil, map[string]string{"sessionId": st.ID})
+	req = req.WithContext(auth.WithOwner(req.Context(), auth.Owner{Name: "root", Admin: true}))
+	rw := httptest.NewRecorder()
+	svc.SessionStartup(rw, req)
+
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"s1"`) {
+		t.Fatalf("expected admin to collect the session, got %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestSessionStartupOfOtherReplica(t *testing.T) {
+	var targets []string
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		targets = append(targets, req.Method+" "+req.URL.Host+req.URL.Path)
+		return response(http.StatusOK, `{"value":{"implicit":0}}`), nil
+	}))
+
+	fc := newPoolClient()
+	b := listedBrowser("8f0e9a52-6f1e-4d0c-9a43-1c2b3d4e5f60", "alice", "chrome", "120", "Running", "127.0.0.9", 0, nil)
+	fc.add(b)
+	svc := asyncService(fc)
+
+	rw := pollStartup(svc, b.Name, "?wait=1s", "bob", nil)
+	verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrUnknownStartup))
+
+	rw = pollStartup(svc, b.Name, "?wait=1s", "alice", nil)
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"browserName":"chrome"`) {
+		t.Fatalf("expected session response, got %d %s", rw.Code, rw.Body.String())
+	}
+	if expected := []string{"GET 127.0.0.9:4444/session/00000000-0000-0000-0000-ffff7f000009/timeouts"}; !slices.Equal(targets, expected) {
+		t.Fatalf("expected only a session lookup %v, got %v", expected, targets)
+	}
+}
+
+func TestSessionStartupOfOtherReplicaAfterRetry(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"implicit":0}}`), nil
+	}))
+
+	// the first Browser of the startup was replaced by a retry
+	fc := newPoolClient()
+	b := listedBrowser("retried", "alice", "chrome", "120", "Running", "127.0.0.9", 0, nil)
+	b.Labels[StartupLabelKey] = "first"
+	fc.add(b)
+	svc := asyncService(fc)
+
+	rw := pollStartup(svc, "first", "?wait=1s", "alice", nil)
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), `"browserName":"chrome"`) {
+		t.Fatalf("expected session response, got %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestCreateSessionAsyncClaimsPooledBrowser(t *testing.T) {
+	release := make(chan struct{})
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		<-release
+		return response(http.StatusOK, `{"value":{"sessionId":"orig"}}`), nil
+	}))
+
+	fc := newPoolClient()
+	fc.add(pooledBrowser("warm", "127.0.0.2"))
+	svc := poolService(fc)
+	addReady(svc, "chrome/120", poolMember{name: "warm", podIP: "127.0.0.2"})
+
+	// accepted on the claim, before the capabilities have been forwarded
+	st := startAsync(t, svc, "")
+	close(release)
+	if st.ID != "warm" || st.Browser != "warm" || st.Phase != startupPending {
+		t.Fatalf("expected the claimed browser to be the handle, got %+v", st)
+	}
+
+	rw := pollStartup(svc, st.ID, "?wait=1s", "", nil)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected session response, got %d %s", rw.Code, rw.Body.String())
+	}
+}
+
+func TestDeleteAbandonedStartup(t *testing.T) {
+	for url, deleted := range map[string]bool{"about:blank": true, "https://example.com/": false} {
+		setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if !strings.HasSuffix(req.URL.Path, "/url") {
+				t.Errorf("unexpected target %s", req.URL)
+			}
+			return response(http.StatusOK, `{"value":"`+url+`"}`), nil
+		}))
+
+		fc := &fakeClient{}
+		svc := asyncService(fc)
+		svc.deleteAbandonedStartup(t.Context(), zerolog.Nop(), "b1", "127.0.0.1")
+
+		if got := len(fc.deletedNames()) == 1; got != deleted {
+			t.Fatalf("%s: expected deleted=%v, got %v", url, deleted, fc.deletedNames())
+		}
+	}
+}
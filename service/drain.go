@@ -0,0 +1,63 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	logctx "github.com/alcounit/browser-controller/pkg/log"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+)
+
+const defaultDrainRetryAfter = 30 * time.Second
+
+var (
+	ErrHubDraining = errors.New("hub draining")
+	ErrAdminOnly   = errors.New("admin access required")
+)
+
+// drainState is the JSON view of the drain mode.
+type drainState struct {
+	Draining bool `json:"draining"`
+}
+
+// SetDraining switches drain mode. A draining hub refuses new sessions and
+// reports itself as not ready, while existing sessions keep being proxied.
+func (s *Service) SetDraining(draining bool) {
+	s.draining.Store(draining)
+}
+
+func (s *Service) Draining() bool {
+	return s.draining.Load()
+}
+
+func (s *Service) drainingError() *browserError {
+	retryAfter := s.config.DrainRetryAfter
+	if retryAfter <= 0 {
+		retryAfter = defaultDrainRetryAfter
+	}
+	return &browserError{kind: browserDraining, err: ErrHubDraining, retryAfter: retryAfter}
+}
+
+// Drain reports the drain mode on GET, and enables it on PUT and disables it
+// on DELETE. It is restricted to admins.
+func (s *Service) Drain(rw http.ResponseWriter, req *http.Request) {
+	log := logctx.FromContext(req.Context())
+
+	if !auth.IsAdmin(req.Context()) {
+		log.Warn().Msg("drain mode change refused to non-admin")
+		http.Error(rw, ErrAdminOnly.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		s.SetDraining(true)
+		log.Info().Msg("drain mode enabled")
+	case http.MethodDelete:
+		s.SetDraining(false)
+		log.Info().Msg("drain mode disabled")
+	}
+
+	writeJSON(rw, http.StatusOK, drainState{Draining: s.Draining()})
+}
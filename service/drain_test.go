@@ -0,0 +1,101 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+)
+
+func drainingService(fc *captureClient) *Service {
+	svc := NewService(fc, ServiceConfig{Namespace: "ns"})
+	svc.SetDraining(true)
+	return svc
+}
+
+func TestCreateSessionRefusedWhileDraining(t *testing.T) {
+	fc := &captureClient{}
+	svc := drainingService(fc)
+
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	rw := httptest.NewRecorder()
+	svc.CreateSession(rw, req)
+
+	verifyResponseError(t, rw, http.StatusServiceUnavailable, selenium.ErrSessionNotCreated(ErrHubDraining))
+	if got := rw.Header().Get("Retry-After"); got != "30" {
+		t.Fatalf("expected Retry-After 30, got %q", got)
+	}
+	if fc.created != nil {
+		t.Fatal("expected no browser to be created")
+	}
+}
+
+func TestPlaywrightAndMcpRefusedWhileDraining(t *testing.T) {
+	svc := drainingService(&captureClient{})
+
+	req := newRequestWithParams(http.MethodGet, "/playwright", nil, map[string]string{"name": "chromium", "version": "123"})
+	rw := httptest.NewRecorder()
+	svc.Playwright(rw, req)
+
+	if rw.Code != http.StatusServiceUnavailable || !strings.Contains(rw.Body.String(), "session not created: hub draining") {
+		t.Fatalf("expected playwright to be refused, got %d %q", rw.Code, rw.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/mcp?browser=chromium&version=123", nil)
+	rw = httptest.NewRecorder()
+	svc.McpHandler(rw, req)
+
+	if rw.Code != http.StatusServiceUnavailable || !strings.Contains(rw.Body.String(), "hub draining") {
+		t.Fatalf("expected mcp initialize to be refused, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestSessionStatusWhileDraining(t *testing.T) {
+	svc := drainingService(&captureClient{})
+
+	rw := httptest.NewRecorder()
+	svc.SessionStatus(rw, newRequestWithParams(http.MethodGet, "/status", nil, nil))
+
+	var status selenium.Status
+	if err := json.Unmarshal(rw.Body.Bytes(), &status); err != nil {
+		t.Fatalf("failed to decode status: %v", err)
+	}
+	if status.Value["ready"] != false {
+		t.Fatalf("expected ready false, got %v", status.Value["ready"])
+	}
+}
+
+func TestDrainEndpoint(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{})
+
+	call := func(method string, owner auth.Owner) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/selenosis/v1/drain", nil)
+		req = req.WithContext(auth.WithOwner(req.Context(), owner))
+		rw := httptest.NewRecorder()
+		svc.Drain(rw, req)
+		return rw
+	}
+
+	if rw := call(http.MethodPut, auth.Owner{Name: "alice"}); rw.Code != http.StatusForbidden {
+		t.Fatalf("expected non-admin to be refused, got %d", rw.Code)
+	}
+	if svc.Draining() {
+		t.Fatal("expected hub not to drain")
+	}
+
+	admin := auth.Owner{Name: "root", Admin: true}
+	if rw := call(http.MethodPut, admin); !strings.Contains(rw.Body.String(), `"draining":true`) || !svc.Draining() {
+		t.Fatalf("expected drain mode to be enabled, got %s", rw.Body.String())
+	}
+	if rw := call(http.MethodGet, admin); !strings.Contains(rw.Body.String(), `"draining":true`) {
+		t.Fatalf("expected drain mode to be reported, got %s", rw.Body.String())
+	}
+	if rw := call(http.MethodDelete, admin); !strings.Contains(rw.Body.String(), `"draining":false`) || svc.Draining() {
+		t.Fatalf("expected drain mode to be disabled, got %s", rw.Body.String())
+	}
+}
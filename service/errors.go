@@ -2,8 +2,12 @@ package service
 
 import (
 	"errors"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alcounit/selenosis/v2/pkg/jsonrpc"
 	"github.com/alcounit/selenosis/v2/pkg/proxy"
@@ -11,6 +15,10 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// statusClientClosedRequest is the non-standard status popularised by nginx for
+// requests the client abandoned before a response was written.
+const statusClientClosedRequest = 499
+
 func isUpstreamUnreachable(err error) bool {
 	var opErr *net.OpError
 	return errors.As(err, &opErr) && opErr.Op == "dial"
@@ -67,8 +75,61 @@ func mcpProxyErrorHandler(log zerolog.Logger, ip string) proxy.ErrorHandler {
 }
 
 type browserError struct {
-	kind errorKind
-	err  error
+	kind       errorKind
+	err        error
+	retryAfter time.Duration
+	// name is the Browser resource the error relates to, if any.
+	name string
+	// reason and message are the Status.Reason and Status.Message of a
+	// Failed Browser.
+	reason  string
+	message string
+}
+
+// detail describes a failed or timed out startup for the client, naming the
+// Browser resource so that it can be looked up. It is empty when nothing is
+// known beyond the error kind.
+func (e *browserError) detail() string {
+	var parts []string
+	switch e.kind {
+	case browserFailed:
+		for _, p := range []string{e.reason, e.message} {
+			if p != "" {
+				parts = append(parts, p)
+			}
+		}
+	case browserStartTimeout:
+		parts = append(parts, ErrStartupTimeout.Error())
+	}
+
+	msg := strings.Join(parts, ": ")
+	if e.name == "" {
+		return msg
+	}
+	if msg == "" {
+		return "browser " + e.name
+	}
+	return msg + " (browser " + e.name + ")"
+}
+
+// data is the JSON-RPC error data for a failed or timed out startup.
+func (e *browserError) data() any {
+	data := map[string]string{}
+	for k, v := range map[string]string{"browser": e.name, "reason": e.reason, "message": e.message} {
+		if v != "" {
+			data[k] = v
+		}
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return data
+}
+
+func setRetryAfter(rw http.ResponseWriter, d time.Duration) {
+	if d > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	}
 }
 
 func writeCreateSessionWaitError(rw http.ResponseWriter, waitErr *browserError) {
@@ -80,11 +141,26 @@ func writeCreateSessionWaitError(rw http.ResponseWriter, waitErr *browserError)
 	case browserStreamClosed:
 		writeErrorResponse(rw, http.StatusInternalServerError, selenium.ErrUnknown(ErrInternal))
 	case browserFailed:
-		writeErrorResponse(rw, http.StatusInternalServerError, selenium.Error("browser failed to start", ErrInternal))
+		cause := ErrInternal
+		if d := waitErr.detail(); d != "" {
+			cause = errors.New(d)
+		}
+		writeErrorResponse(rw, http.StatusInternalServerError, selenium.Error("browser failed to start", cause))
 	case browserStreamError:
 		writeErrorResponse(rw, http.StatusInternalServerError, selenium.ErrUnknown(waitErr.err))
-	case browserContextDone:
-		writeErrorResponse(rw, http.StatusInternalServerError, selenium.ErrUnknown(ErrInternal))
+	case browserStartTimeout:
+		writeErrorResponse(rw, http.StatusInternalServerError, selenium.ErrTimeout(errors.New(waitErr.detail())))
+	case browserClientGone:
+		writeErrorResponse(rw, statusClientClosedRequest, selenium.ErrUnknown(ErrClientDisconnected))
+	case browserQueueTimeout, browserDraining:
+		setRetryAfter(rw, waitErr.retryAfter)
+		writeErrorResponse(rw, http.StatusServiceUnavailable, selenium.ErrSessionNotCreated(waitErr.err))
+	case browserInvalidRequest:
+		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(waitErr.err))
+	case browserQuotaExceeded:
+		writeErrorResponse(rw, http.StatusTooManyRequests, selenium.ErrSessionNotCreated(waitErr.err))
+	case browserIdempotencyConflict:
+		writeErrorResponse(rw, http.StatusUnprocessableEntity, selenium.ErrInvalidArgument(waitErr.err))
 	default:
 		writeErrorResponse(rw, http.StatusInternalServerError, selenium.ErrUnknown(ErrInternal))
 	}
@@ -99,11 +175,26 @@ func writePlaywrightWaitError(rw http.ResponseWriter, waitErr *browserError) {
 	case browserStreamClosed:
 		http.Error(rw, "browser event stream closed unexpectedly", http.StatusInternalServerError)
 	case browserFailed:
-		http.Error(rw, "browser failed to start", http.StatusInternalServerError)
+		msg := "browser failed to start"
+		if d := waitErr.detail(); d != "" {
+			msg += ": " + d
+		}
+		http.Error(rw, msg, http.StatusInternalServerError)
 	case browserStreamError:
 		http.Error(rw, "browser event stream error", http.StatusInternalServerError)
-	case browserContextDone:
-		http.Error(rw, "context cancelled, stopping browser event stream", http.StatusInternalServerError)
+	case browserStartTimeout:
+		http.Error(rw, waitErr.detail(), http.StatusInternalServerError)
+	case browserClientGone:
+		http.Error(rw, "client disconnected", statusClientClosedRequest)
+	case browserQueueTimeout, browserDraining:
+		setRetryAfter(rw, waitErr.retryAfter)
+		http.Error(rw, "session not created: "+waitErr.err.Error(), http.StatusServiceUnavailable)
+	case browserInvalidRequest:
+		http.Error(rw, waitErr.err.Error(), http.StatusBadRequest)
+	case browserQuotaExceeded:
+		http.Error(rw, "session not created: "+waitErr.err.Error(), http.StatusTooManyRequests)
+	case browserIdempotencyConflict:
+		http.Error(rw, waitErr.err.Error(), http.StatusUnprocessableEntity)
 	default:
 		http.Error(rw, "internal server error", http.StatusInternalServerError)
 	}
@@ -118,11 +209,22 @@ func writeMcpWaitError(rw http.ResponseWriter, waitErr *browserError) {
 	case browserStreamClosed:
 		jsonrpc.WriteError(rw, http.StatusInternalServerError, jsonrpc.InternalError, "Internal error: browser event stream closed unexpectedly")
 	case browserFailed:
-		jsonrpc.WriteError(rw, http.StatusInternalServerError, jsonrpc.InternalError, "Internal error: browser failed to start")
+		jsonrpc.WriteErrorWithData(rw, http.StatusInternalServerError, jsonrpc.InternalError, "Internal error: browser failed to start", waitErr.data())
 	case browserStreamError:
 		jsonrpc.WriteError(rw, http.StatusInternalServerError, jsonrpc.InternalError, "Internal error: browser event stream error")
-	case browserContextDone:
-		jsonrpc.WriteError(rw, http.StatusInternalServerError, jsonrpc.InternalError, "Internal error: context cancelled, stopping browser event stream")
+	case browserStartTimeout:
+		jsonrpc.WriteErrorWithData(rw, http.StatusInternalServerError, jsonrpc.InternalError, "Internal error: browser startup timed out", waitErr.data())
+	case browserClientGone:
+		jsonrpc.WriteError(rw, statusClientClosedRequest, jsonrpc.InternalError, "Internal error: client disconnected")
+	case browserQueueTimeout, browserDraining:
+		setRetryAfter(rw, waitErr.retryAfter)
+		jsonrpc.WriteError(rw, http.StatusServiceUnavailable, jsonrpc.InternalError, "Session not created: "+waitErr.err.Error())
+	case browserInvalidRequest:
+		jsonrpc.WriteError(rw, http.StatusBadRequest, jsonrpc.InvalidParams, "Bad Request: "+waitErr.err.Error())
+	case browserQuotaExceeded:
+		jsonrpc.WriteError(rw, http.StatusTooManyRequests, jsonrpc.QuotaExceeded, "Session not created: "+waitErr.err.Error())
+	case browserIdempotencyConflict:
+		jsonrpc.WriteError(rw, http.StatusUnprocessableEntity, jsonrpc.InvalidParams, "Bad Request: "+waitErr.err.Error())
 	default:
 		jsonrpc.WriteError(rw, http.StatusInternalServerError, jsonrpc.InternalError, "Internal error")
 	}
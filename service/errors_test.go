@@ -158,3 +158,28 @@ func TestMcpProxyErrorHandlerGeneric(t *testing.T) {
 
 	assertMcpError(t, rw, http.StatusInternalServerError, -32603)
 }
+
+func TestWriteMcpWaitErrorData(t *testing.T) {
+	rw := httptest.NewRecorder()
+	writeMcpWaitError(rw, &browserError{kind: browserFailed, name: "br", reason: "ImagePullBackOff", message: "chrome:999.0 not found"})
+	assertMcpError(t, rw, http.StatusInternalServerError, -32603)
+
+	var body struct {
+		Error struct {
+			Data map[string]string `json:"data"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatalf("failed to decode body: %v", err)
+	}
+	expected := map[string]string{"browser": "br", "reason": "ImagePullBackOff", "message": "chrome:999.0 not found"}
+	if fmt.Sprint(body.Error.Data) != fmt.Sprint(expected) {
+		t.Fatalf("expected data %v, got %v", expected, body.Error.Data)
+	}
+
+	rw = httptest.NewRecorder()
+	writeMcpWaitError(rw, &browserError{kind: browserStartTimeout, name: "br"})
+	if !strings.Contains(rw.Body.String(), `"data":{"browser":"br"}`) {
+		t.Fatalf("expected browser name in data, got %s", rw.Body.String())
+	}
+}
@@ -0,0 +1,386 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	logctx "github.com/alcounit/browser-controller/pkg/log"
+	"github.com/alcounit/browser-service/pkg/event"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// sessionFeedHistory is the number of events kept for clients that
+	// reconnect with Last-Event-ID.
+	sessionFeedHistory = 1024
+	// sessionFeedBuffer is the number of events queued for a slow client
+	// before its stream is closed; it resumes with Last-Event-ID.
+	sessionFeedBuffer    = 64
+	sessionFeedKeepAlive = 15 * time.Second
+
+	SessionEventCreated  = "created"
+	SessionEventDeleted  = "deleted"
+	SessionEventSnapshot = "snapshot"
+)
+
+var ErrSessionEventsDisabled = errors.New("session events are disabled")
+
+// sessionEvent is the hub's JSON schema of a session lifecycle event. Type
+// is created, deleted, snapshot, or the lower-cased phase the session
+// entered: pending, running, failed or succeeded.
+type sessionEvent struct {
+	ID      string      `json:"id"`
+	Type    string      `json:"type"`
+	Time    time.Time   `json:"time"`
+	Session sessionView `json:"session"`
+
+	seq     uint64
+	browser *browserv1.Browser
+	claimed bool
+}
+
+// sessionFeed re-publishes the Browser events of the namespace as session
+// events and keeps the latest of them, so that a client that reconnects
+// with Last-Event-ID gets the events it missed. Event ids are only known to
+// the replica that issued them.
+type sessionFeed struct {
+	svc   *Service
+	epoch string
+	log   zerolog.Logger
+
+	mu       sync.Mutex
+	seq      uint64
+	history  []*sessionEvent
+	browsers map[string]*feedBrowser
+	claims   map[string]bool
+	synced   bool
+	subs     map[*feedSubscription]struct{}
+}
+
+// feedBrowser is the last known state of a Browser. announced tells whether
+// it was published as a session; pool members this replica has not handed
+// out are not until they are claimed.
+type feedBrowser struct {
+	browser   *browserv1.Browser
+	owner     string
+	announced bool
+}
+
+func newSessionFeed(svc *Service) *sessionFeed {
+	return &sessionFeed{
+		svc:      svc,
+		epoch:    strconv.FormatInt(time.Now().UnixNano(), 36),
+		log:      zerolog.Nop(),
+		browsers: map[string]*feedBrowser{},
+		claims:   map[string]bool{},
+		subs:     map[*feedSubscription]struct{}{},
+	}
+}
+
+// resync publishes the difference between the known Browsers and a fresh
+// list of the browserWatcher, and reconciles the usage ledger with it. The
+// first list only seeds the known Browsers.
+func (f *sessionFeed) resync(browsers []*browserv1.Browser) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	listed := map[string]bool{}
+	for _, b := range browsers {
+		if b == nil {
+			continue
+		}
+		listed[b.GetName()] = true
+		if !f.synced {
+			f.browsers[b.GetName()] = &feedBrowser{browser: b, owner: f.svc.browserOwner(b), announced: f.svc.isSession(b)}
+			continue
+		}
+		f.updateLocked(b)
+	}
+
+	if f.synced {
+		for name, known := range f.browsers {
+			if !listed[name] {
+				f.deleteLocked(known.browser)
+			}
+		}
+		for name := range f.claims {
+			if !listed[name] {
+				delete(f.claims, name)
+			}
+		}
+	}
+	f.synced = true
+
+	if err := f.svc.syncUsage(browsers, time.Now()); err != nil {
+		f.log.Err(err).Msg("failed to sync usage ledger")
+	}
+}
+
+// claimed publishes a pool member that was handed out, which changes no
+// Browser and so comes with no event. Its events are marked as claimed on
+// this replica, so that its usage is accounted from here on.
+func (f *sessionFeed) claimed(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.claims[name] = true
+	if known, ok := f.browsers[name]; ok && !known.announced {
+		f.updateLocked(known.browser)
+	}
+}
+
+// liveAt returns the live Browser at ip among the known ones, nil if there
+// is none.
+func (f *sessionFeed) liveAt(ip net.IP) *browserv1.Browser {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, known := range f.browsers {
+		if b := known.browser; b.Status.PodIP == ip.String() && liveBrowser(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (f *sessionFeed) apply(e *event.BrowserEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if e.EventType == event.EventTypeDeleted {
+		f.deleteLocked(e.Browser)
+		return
+	}
+	f.updateLocked(e.Browser)
+}
+
+// updateLocked publishes the creation of a session and the phases it
+// enters.
+func (f *sessionFeed) updateLocked(b *browserv1.Browser) {
+	known, ok := f.browsers[b.GetName()]
+	if !ok {
+		known = &feedBrowser{}
+		f.browsers[b.GetName()] = known
+	}
+	prev := known.browser
+	known.browser, known.owner = b, f.svc.browserOwner(b)
+
+	if !f.svc.isSession(b) {
+		return
+	}
+
+	phase := b.Status.Phase
+	if !known.announced {
+		known.announced = true
+		f.publishLocked(SessionEventCreated, b, known.owner)
+	} else if prev != nil && prev.Status.Phase == phase {
+		return
+	}
+	if phase != "" {
+		f.publishLocked(strings.ToLower(string(phase)), b, known.owner)
+	}
+}
+
+func (f *sessionFeed) deleteLocked(b *browserv1.Browser) {
+	known, ok := f.browsers[b.GetName()]
+	delete(f.browsers, b.GetName())
+	defer delete(f.claims, b.GetName())
+
+	switch {
+	case ok && known.announced:
+		f.publishLocked(SessionEventDeleted, b, known.owner)
+	case !ok && f.svc.isSession(b):
+		f.publishLocked(SessionEventDeleted, b, f.svc.browserOwner(b))
+	}
+}
+
+// publishLocked publishes an event of b, owned by owner.
+func (f *sessionFeed) publishLocked(typ string, b *browserv1.Browser, owner string) {
+	now := time.Now()
+
+	f.seq++
+	e := &sessionEvent{
+		ID:      f.eventID(f.seq),
+		Type:    typ,
+		Time:    now,
+		Session: f.svc.sessionView(b, now),
+		seq:     f.seq,
+		browser: b,
+		claimed: f.claims[b.GetName()],
+	}
+	e.Session.Owner = owner
+
+	f.history = append(f.history, e)
+	if len(f.history) > sessionFeedHistory {
+		f.history = f.history[len(f.history)-sessionFeedHistory:]
+	}
+
+	for sub := range f.subs {
+		sub.deliver(e)
+	}
+
+	if err := f.svc.recordUsage(e); err != nil {
+		f.log.Err(err).Str("name", b.GetName()).Msg("failed to record session usage")
+	}
+}
+
+func (f *sessionFeed) eventID(seq uint64) string {
+	return f.epoch + "." + strconv.FormatUint(seq, 10)
+}
+
+// subscribe registers a subscription that receives the events published
+// after lastEventID. resumed is false when the events after lastEventID are
+// no longer known, in which case the subscription starts with the next
+// event and lastID is the id of the current position.
+func (f *sessionFeed) subscribe(lastEventID string) (sub *feedSubscription, lastID string, resumed bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub = &feedSubscription{
+		feed:   f,
+		events: make(chan *sessionEvent, sessionFeedBuffer+sessionFeedHistory),
+		lost:   make(chan struct{}),
+	}
+	f.subs[sub] = struct{}{}
+
+	if lastEventID == "" {
+		return sub, f.eventID(f.seq), true
+	}
+
+	seq, ok := f.parseEventID(lastEventID)
+	if !ok || seq > f.seq || len(f.history) > 0 && seq+1 < f.history[0].seq {
+		return sub, f.eventID(f.seq), false
+	}
+	for _, e := range f.history {
+		if e.seq > seq {
+			sub.events <- e
+		}
+	}
+	return sub, f.eventID(f.seq), true
+}
+
+func (f *sessionFeed) parseEventID(id string) (uint64, bool) {
+	epoch, seq, ok := strings.Cut(id, ".")
+	if !ok || epoch != f.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil
+}
+
+func (f *sessionFeed) unsubscribe(sub *feedSubscription) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subs, sub)
+}
+
+// feedSubscription is the event queue of one client. A client that falls
+// behind loses its subscription instead of holding up the feed.
+type feedSubscription struct {
+	feed   *sessionFeed
+	events chan *sessionEvent
+	lost   chan struct{}
+}
+
+// deliver is called with the feed lock held.
+func (s *feedSubscription) deliver(e *sessionEvent) {
+	select {
+	case <-s.lost:
+	case s.events <- e:
+	default:
+		close(s.lost)
+	}
+}
+
+// SessionEvents streams session lifecycle events as server-sent events. It
+// takes the filters of ListSessions, and non-admins only receive the events
+// of their own sessions. A client that reconnects with Last-Event-ID, or
+// the lastEventId query parameter, receives the events it missed; when they
+// are no longer known it gets a snapshot of the current sessions instead.
+func (s *Service) SessionEvents(rw http.ResponseWriter, req *http.Request) {
+	log := logctx.FromContext(req.Context())
+
+	if !s.config.SessionEvents {
+		http.Error(rw, ErrSessionEventsDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	filter, err := parseSessionFilter(req)
+	if err != nil {
+		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(err))
+		return
+	}
+
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = req.URL.Query().Get("lastEventId")
+	}
+
+	sub, lastID, resumed := s.feed.subscribe(lastEventID)
+	defer s.feed.unsubscribe(sub)
+
+	var snapshot []*browserv1.Browser
+	if !resumed {
+		log.Info().Str("lastEventId", lastEventID).Msg("session events not resumable, sending snapshot")
+		if snapshot, err = s.client.List(req.Context(), s.config.Namespace); err != nil {
+			log.Err(err).Msg("failed to list browsers")
+			writeErrorResponse(rw, http.StatusInternalServerError, selenium.ErrUnknown(err))
+			return
+		}
+	}
+
+	flusher, _ := rw.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flush()
+
+	send := func(e *sessionEvent) {
+		if !filter.matches(e.Session, e.browser) {
+			return
+		}
+		data, _ := json.Marshal(e)
+		fmt.Fprintf(rw, "id: %s\ndata: %s\n\n", e.ID, data)
+		flush()
+	}
+
+	now := time.Now()
+	for _, b := range snapshot {
+		if b != nil && s.isSession(b) {
+			send(&sessionEvent{ID: lastID, Type: SessionEventSnapshot, Time: now, Session: s.sessionView(b, now), browser: b})
+		}
+	}
+
+	keepAlive := time.NewTicker(sessionFeedKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case e := <-sub.events:
+			send(e)
+		case <-keepAlive.C:
+			fmt.Fprint(rw, ": keep-alive\n\n")
+			flush()
+		case <-sub.lost:
+			log.Warn().Msg("session events client fell behind, closing stream")
+			return
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/browser-service/pkg/event"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+)
+
+func feedEvent(typ event.EventType, b *browserv1.Browser) *event.BrowserEvent {
+	return &event.BrowserEvent{EventType: typ, Browser: b}
+}
+
+func feedTypes(f *sessionFeed) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var types []string
+	for _, e := range f.history {
+		types = append(types, e.Session.Name+":"+e.Type)
+	}
+	return types
+}
+
+func TestSessionFeedLifecycle(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{SessionEvents: true})
+	f := svc.feed
+	f.resync(nil)
+
+	f.apply(feedEvent(event.EventTypeAdded, listedBrowser("b1", "alice", "chrome", "120.0", "", "", 0, nil)))
+	f.apply(feedEvent(event.EventTypeModified, listedBrowser("b1", "alice", "chrome", "120.0", "Pending", "", 0, nil)))
+	f.apply(feedEvent(event.EventTypeModified, listedBrowser("b1", "alice", "chrome", "120.0", "Running", "127.0.0.1", 0, nil)))
+	f.apply(feedEvent(event.EventTypeModified, listedBrowser("b1", "alice", "chrome", "120.0", "Running", "127.0.0.1", 0, nil)))
+	f.apply(feedEvent(event.EventTypeDeleted, listedBrowser("b1", "alice", "chrome", "120.0", "Running", "127.0.0.1", 0, nil)))
+
+	expected := []string{"b1:created", "b1:pending", "b1:running", "b1:deleted"}
+	if got := feedTypes(f); !slices.Equal(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	f.mu.Lock()
+	running := f.history[2]
+	f.mu.Unlock()
+	if running.Session.ID != testSidecarSessionID || running.Session.Owner != "alice" {
+		t.Fatalf("unexpected session in event: %+v", running.Session)
+	}
+}
+
+func TestSessionFeedResync(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{SessionEvents: true})
+	f := svc.feed
+
+	f.resync([]*browserv1.Browser{
+		listedBrowser("b1", "alice", "chrome", "120.0", "Running", "127.0.0.1", 0, nil),
+		listedBrowser("b2", "bob", "chrome", "120.0", "Pending", "", 0, nil),
+	})
+	if got := feedTypes(f); len(got) != 0 {
+		t.Fatalf("expected first list to publish nothing, got %v", got)
+	}
+
+	f.resync([]*browserv1.Browser{
+		listedBrowser("b2", "bob", "chrome", "120.0", "Running", "127.0.0.2", 0, nil),
+		listedBrowser("b3", "bob", "firefox", "125.0", "Pending", "", 0, nil),
+	})
+
+	got := feedTypes(f)
+	slices.Sort(got)
+	expected := []string{"b1:deleted", "b2:running", "b3:created", "b3:pending"}
+	if !slices.Equal(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
+
+type sseEvent struct {
+	id    string
+	event sessionEvent
+}
+
+// eventsServer serves SessionEvents to the owner in the X-Test-Owner header,
+// prefixed with "admin:" for admins.
+func eventsServer(t *testing.T, svc *Service) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if name := req.Header.Get("X-Test-Owner"); name != "" {
+			admin := strings.HasPrefix(name, "admin:")
+			owner := auth.Owner{Name: strings.TrimPrefix(name, "admin:"), Admin: admin}
+			req = req.WithContext(auth.WithOwner(req.Context(), owner))
+		}
+		svc.SessionEvents(rw, req)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func subscribeEvents(t *testing.T, srv *httptest.Server, query string, header http.Header) <-chan sseEvent {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/selenosis/v1/events"+query, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected event stream, got %q", ct)
+	}
+
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+
+		var e sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				e.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.event)
+			case line == "" && e.id != "":
+				events <- e
+				e = sseEvent{}
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvents(t *testing.T, events <-chan sseEvent, n int) []sseEvent {
+	t.Helper()
+	var got []sseEvent
+	for range n {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("stream closed after %d events", len(got))
+			}
+			got = append(got, e)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out after %d events", len(got))
+		}
+	}
+	return got
+}
+
+func eventNames(events []sseEvent) []string {
+	var names []string
+	for _, e := range events {
+		names = append(names, e.event.Session.Name+":"+e.event.Type)
+	}
+	return names
+}
+
+func TestSessionEventsFilters(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{SessionEvents: true})
+	svc.feed.resync(nil)
+	srv := eventsServer(t, svc)
+
+	alice := subscribeEvents(t, srv, "", http.Header{"X-Test-Owner": {"alice"}})
+	admin := subscribeEvents(t, srv, "?labelSelector=team%3Dapi", http.Header{"X-Test-Owner": {"admin:root"}})
+
+	svc.feed.apply(feedEvent(event.EventTypeAdded, listedBrowser("b1", "alice", "chrome", "120.0", "", "", 0, map[string]string{"team": "web"})))
+	svc.feed.apply(feedEvent(event.EventTypeAdded, listedBrowser("b2", "bob", "chrome", "120.0", "", "", 0, map[string]string{"team": "api"})))
+	svc.feed.apply(feedEvent(event.EventTypeDeleted, listedBrowser("b1", "alice", "chrome", "120.0", "", "", 0, map[string]string{"team": "web"})))
+	svc.feed.apply(feedEvent(event.EventTypeDeleted, listedBrowser("b2", "bob", "chrome", "120.0", "", "", 0, map[string]string{"team": "api"})))
+
+	if got := eventNames(nextEvents(t, alice, 2)); !slices.Equal(got, []string{"b1:created", "b1:deleted"}) {
+		t.Fatalf("expected only alice's events, got %v", got)
+	}
+	if got := eventNames(nextEvents(t, admin, 2)); !slices.Equal(got, []string{"b2:created", "b2:deleted"}) {
+		t.Fatalf("expected only team=api events, got %v", got)
+	}
+}
+
+func TestSessionEventsLastEventID(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{SessionEvents: true})
+	svc.feed.resync(nil)
+	srv := eventsServer(t, svc)
+
+	first := subscribeEvents(t, srv, "", nil)
+	svc.feed.apply(feedEvent(event.EventTypeAdded, listedBrowser("b1", "alice", "chrome", "120.0", "Pending", "", 0, nil)))
+	svc.feed.apply(feedEvent(event.EventTypeModified, listedBrowser("b1", "alice", "chrome", "120.0", "Running", "127.0.0.1", 0, nil)))
+
+	received := nextEvents(t, first, 2)
+	if got := eventNames(received); !slices.Equal(got, []string{"b1:created", "b1:pending"}) {
+		t.Fatalf("unexpected events %v", got)
+	}
+
+	resumed := subscribeEvents(t, srv, "", http.Header{"Last-Event-Id": {received[1].id}})
+	if got := eventNames(nextEvents(t, resumed, 1)); !slices.Equal(got, []string{"b1:running"}) {
+		t.Fatalf("expected the missed event, got %v", got)
+	}
+
+	query := subscribeEvents(t, srv, "?lastEventId="+received[0].id, nil)
+	if got := eventNames(nextEvents(t, query, 2)); !slices.Equal(got, []string{"b1:pending", "b1:running"}) {
+		t.Fatalf("expected the missed events, got %v", got)
+	}
+}
+
+func TestSessionEventsSnapshot(t *testing.T) {
+	svc := NewService(newListClient(), ServiceConfig{SessionEvents: true})
+	svc.feed.resync(nil)
+	srv := eventsServer(t, svc)
+
+	events := subscribeEvents(t, srv, "", http.Header{"Last-Event-Id": {"gone.42"}, "X-Test-Owner": {"alice"}})
+	got := nextEvents(t, events, 2)
+	if names := eventNames(got); !slices.Equal(names, []string{"b3:snapshot", "b1:snapshot"}) {
+		t.Fatalf("expected a snapshot of alice's sessions, got %v", names)
+	}
+
+	svc.feed.apply(feedEvent(event.EventTypeDeleted, listedBrowser("b1", "alice", "chrome", "120.0", "Running", "127.0.0.1", 0, nil)))
+	next := nextEvents(t, events, 1)
+	if names := eventNames(next); !slices.Equal(names, []string{"b1:deleted"}) {
+		t.Fatalf("expected live events after the snapshot, got %v", names)
+	}
+	if got[0].id != svc.feed.eventID(0) {
+		t.Fatalf("expected snapshot to carry the feed position, got %q", got[0].id)
+	}
+}
+
+func TestSessionEventsDisabled(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{})
+
+	rw := httptest.NewRecorder()
+	svc.SessionEvents(rw, httptest.NewRequest(http.MethodGet, "/selenosis/v1/events", nil))
+
+	if rw.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", rw.Code)
+	}
+}
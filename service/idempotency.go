@@ -0,0 +1,436 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	"github.com/alcounit/selenosis/v2/pkg/jsonrpc"
+	"github.com/alcounit/selenosis/v2/pkg/proxy"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	"github.com/rs/zerolog"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotencyKeyLabelKey holds a hash of the Idempotency-Key a Browser
+	// was created with, so that other replicas can find it.
+	IdempotencyKeyLabelKey = "selenosis.io/idempotency-key"
+	// IdempotencyRequestLabelKey holds a hash of the request a Browser was
+	// created for, so that a key reused for another request is refused.
+	IdempotencyRequestLabelKey = "selenosis.io/idempotency-request"
+
+	defaultIdempotencyTTL            = 10 * time.Minute
+	defaultIdempotencyAbandonTimeout = time.Minute
+)
+
+var (
+	ErrIdempotencyKeyReused = errors.New("idempotency key was used for a different request")
+	// ErrIdempotentCreateElsewhere is returned for a key whose session is
+	// being created through another replica, which alone knows its response.
+	ErrIdempotentCreateElsewhere = errors.New("session for this idempotency key is being created through another replica")
+)
+
+type idempotencyPayloadKey struct{}
+
+// withIdempotencyPayload marks body as the payload that identifies the
+// request for its idempotency key, instead of its query.
+func withIdempotencyPayload(req *http.Request, body []byte) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), idempotencyPayloadKey{}, body))
+}
+
+// idempotencyFingerprint identifies what a request asks for, so that
+// requests sharing an idempotency key can be checked to be the same.
+func idempotencyFingerprint(req *http.Request, name, version string) string {
+	payload, ok := req.Context().Value(idempotencyPayloadKey{}).([]byte)
+	if !ok {
+		payload = []byte(req.URL.RawQuery)
+	}
+	return idempotencyLabel(name + "\x00" + version + "\x00" + string(payload))
+}
+
+// idempotencyKey returns the key under which startups of this request are
+// shared: the Idempotency-Key header scoped to the request owner.
+func idempotencyKey(req *http.Request) string {
+	key := strings.TrimSpace(req.Header.Get(IdempotencyKeyHeader))
+	if key == "" {
+		return ""
+	}
+	owner, _ := auth.OwnerFrom(req.Context())
+	return owner.Name + "\x00" + key
+}
+
+func idempotencyLabel(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	// label values are limited to 63 characters
+	return hex.EncodeToString(sum[:20])
+}
+
+type recordedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (r *recordedResponse) write(rw http.ResponseWriter) {
+	for k, v := range r.header {
+		rw.Header()[k] = v
+	}
+	rw.WriteHeader(r.status)
+	rw.Write(r.body)
+}
+
+// startupFlight is one browser startup shared by all requests with the same
+// idempotency key. foreign tells that the Browser was created through
+// another replica, and delivered that a request has been given it.
+type startupFlight struct {
+	fingerprint string
+
+	done    chan struct{}
+	name    string
+	podIP   string
+	err     *browserError
+	foreign bool
+
+	delivered atomic.Bool
+
+	// proxyMu serialises the create requests forwarded to the browser, so
+	// that a retry waits for the first one and can replay its response.
+	proxyMu  sync.Mutex
+	response *recordedResponse
+}
+
+func (f *startupFlight) record(resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	f.response = &recordedResponse{status: resp.StatusCode, header: resp.Header.Clone(), body: body}
+	return nil
+}
+
+type idempotencyRegistry struct {
+	ttl          time.Duration
+	abandonAfter time.Duration
+
+	mu      sync.Mutex
+	flights map[string]*startupFlight
+}
+
+func newIdempotencyRegistry(ttl, abandonAfter time.Duration) *idempotencyRegistry {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	if abandonAfter <= 0 {
+		abandonAfter = defaultIdempotencyAbandonTimeout
+	}
+	return &idempotencyRegistry{ttl: ttl, abandonAfter: min(abandonAfter, ttl), flights: map[string]*startupFlight{}}
+}
+
+// join returns the flight for key and whether the caller has to run it.
+func (r *idempotencyRegistry) join(key, fingerprint string) (*startupFlight, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if f, ok := r.flights[key]; ok {
+		return f, false
+	}
+	f := &startupFlight{fingerprint: fingerprint, done: make(chan struct{})}
+	r.flights[key] = f
+	return f, true
+}
+
+func (r *idempotencyRegistry) get(key string) *startupFlight {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.flights[key]
+}
+
+// finish publishes the outcome of f. Failed startups are forgotten straight
+// away so that a retry can start over. Successful ones that no request was
+// given the Browser of within abandonAfter are forgotten too, and abandon is
+// called; the others are kept for the TTL, so that their response can be
+// replayed.
+func (r *idempotencyRegistry) finish(key string, f *startupFlight, name, podIP string, foreign bool, waitErr *browserError, abandon func()) {
+	f.name, f.podIP, f.foreign, f.err = name, podIP, foreign, waitErr
+	close(f.done)
+
+	forget := func() {
+		r.mu.Lock()
+		if r.flights[key] == f {
+			delete(r.flights, key)
+		}
+		r.mu.Unlock()
+	}
+
+	if waitErr != nil {
+		forget()
+		return
+	}
+	time.AfterFunc(r.abandonAfter, func() {
+		if f.delivered.Load() {
+			time.AfterFunc(r.ttl-r.abandonAfter, forget)
+			return
+		}
+		forget()
+		abandon()
+	})
+}
+
+// startIdempotentSession attaches to a startup with the same idempotency key
+// if this replica runs one, and otherwise starts one. The startup outlives
+// the request, so that a client retrying after its own timeout finds the
+// browser it already asked for; a Browser it created that no request picks
+// up within the abandon timeout is deleted. A key reused for a different request, as
+// told by its fingerprint, is refused.
+func (s *Service) startIdempotentSession(ctx context.Context, log zerolog.Logger, key, fingerprint string, template *browserv1.Browser, opts map[string]any, sessionOpts sessionOptions) (string, string, *browserError) {
+	log = log.With().Bool("idempotent", true).Logger()
+
+	f, leader := s.idempotency.join(key, fingerprint)
+	if leader {
+		if template.Labels == nil {
+			template.Labels = map[string]string{}
+		}
+		template.Labels[IdempotencyKeyLabelKey] = idempotencyLabel(key)
+		template.Labels[IdempotencyRequestLabelKey] = fingerprint
+
+		go func() {
+			detached := context.WithoutCancel(ctx)
+			name, podIP, waitErr, found := s.findIdempotentBrowser(detached, log, template, sessionOpts)
+			if !found {
+				name, podIP, waitErr = s.startSession(detached, log, template, opts, sessionOpts)
+			}
+			s.idempotency.finish(key, f, name, podIP, found, waitErr, func() {
+				if found {
+					return
+				}
+				log.Warn().Str("name", name).Msg("no request picked up the browser of an idempotent startup, deleting it")
+				s.deleteBrowser(detached, log, name)
+			})
+		}()
+	} else {
+		if f.fingerprint != fingerprint {
+			log.Warn().Msg("idempotency key reused for a different request")
+			return "", "", &browserError{kind: browserIdempotencyConflict, err: ErrIdempotencyKeyReused}
+		}
+		log.Info().Msg("attaching to browser startup with the same idempotency key")
+	}
+
+	select {
+	case <-f.done:
+		if f.err == nil {
+			f.delivered.Store(true)
+		}
+		return f.name, f.podIP, f.err
+	case <-ctx.Done():
+		return "", "", contextDoneError(ctx, log, "")
+	}
+}
+
+// findIdempotentBrowser looks for a Browser another replica created for the
+// same idempotency key and owner, and waits for it if it is still starting.
+func (s *Service) findIdempotentBrowser(ctx context.Context, log zerolog.Logger, template *browserv1.Browser, sessionOpts sessionOptions) (string, string, *browserError, bool) {
+	browsers, err := s.client.List(ctx, s.config.Namespace)
+	if err != nil {
+		log.Err(err).Msg("failed to look up browsers by idempotency key")
+		return "", "", nil, false
+	}
+
+	label := template.Labels[IdempotencyKeyLabelKey]
+	fingerprint := template.Labels[IdempotencyRequestLabelKey]
+	owner := template.Labels[browserv1.SelenosisOwnerLabelKey]
+
+	for _, b := range browsers {
+		if b == nil || b.Labels[IdempotencyKeyLabelKey] != label || b.Labels[browserv1.SelenosisOwnerLabelKey] != owner {
+			continue
+		}
+		if b.Labels[IdempotencyRequestLabelKey] != fingerprint {
+			switch b.Status.Phase {
+			case "", "Pending", "Running":
+				log.Warn().Str("name", b.GetName()).Msg("idempotency key reused for a different request")
+				return "", "", &browserError{kind: browserIdempotencyConflict, err: ErrIdempotencyKeyReused}, true
+			}
+			continue
+		}
+
+		switch b.Status.Phase {
+		case "Running":
+			log.Info().Str("name", b.GetName()).Msg("reusing browser with the same idempotency key")
+			return b.GetName(), b.Status.PodIP, nil, true
+
+		case "", "Pending":
+			log.Info().Str("name", b.GetName()).Msg("waiting for browser with the same idempotency key")
+			name, podIP, waitErr := s.waitForExistingBrowser(ctx, log, template, b.GetName(), sessionOpts)
+			return name, podIP, waitErr, true
+		}
+	}
+
+	return "", "", nil, false
+}
+
+func (s *Service) waitForExistingBrowser(ctx context.Context, log zerolog.Logger, template *browserv1.Browser, name string, sessionOpts sessionOptions) (string, string, *browserError) {
+	timeout := s.startupTimeout(template.Spec.BrowserName, template.Spec.BrowserVersion, sessionOpts)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stream, err := s.browserEvents(ctx, name)
+	if err != nil {
+		log.Err(err).Str("name", name).Msg("failed to start browser event stream")
+		return name, "", &browserError{kind: browserEventsStart, err: err}
+	}
+	defer stream.Close()
+
+	// the Browser may have started between the lookup and the subscription
+	podIP := ""
+	if b, err := s.client.Get(ctx, s.config.Namespace, name); err == nil && b != nil && b.Status.Phase == "Running" {
+		podIP = b.Status.PodIP
+	} else {
+		var waitErr *browserError
+		if podIP, waitErr = s.awaitBrowser(ctx, log, stream, name); waitErr != nil {
+			return name, "", waitErr
+		}
+	}
+
+	// the request that created the Browser may still be probing it
+	if waitErr := s.waitForSidecar(ctx, log, name, podIP); waitErr != nil {
+		return name, "", waitErr
+	}
+	return name, podIP, nil
+}
+
+// proxyCreateRequest forwards a session create request to the browser. For
+// requests with an idempotency key, a successful response is recorded and
+// replayed to later requests with the same key instead of creating a second
+// session in the browser. A Browser created through another replica never
+// gets a second create request; foreign answers for it instead. The startup
+// timings are added to the response.
+func (s *Service) proxyCreateRequest(rw http.ResponseWriter, req *http.Request, log zerolog.Logger, name, podIP string, foreign func(http.ResponseWriter, *startupFlight), opts ...proxy.HTTPReverseProxyOptions) {
+	var f *startupFlight
+	if key := idempotencyKey(req); key != "" {
+		f = s.idempotency.get(key)
+	}
+
+	timings := startupTimingsFrom(req.Context())
+	modifier := func(resp *http.Response) error {
+		if err := s.signSessionResponse(resp, name, podIP); err != nil {
+			return err
+		}
+		if f != nil {
+			if err := f.record(resp); err != nil {
+				return err
+			}
+		}
+		timings.sidecarResponded(log, resp.Header)
+		return nil
+	}
+	opts = append(opts, proxy.WithResponseModifier(modifier))
+
+	if f == nil {
+		proxy.NewHTTPReverseProxy(opts...).ServeHTTP(rw, req)
+		return
+	}
+
+	f.proxyMu.Lock()
+	defer f.proxyMu.Unlock()
+
+	if f.response != nil {
+		log.Info().Msg("replaying session create response for idempotency key")
+		f.response.write(rw)
+		return
+	}
+
+	if f.foreign {
+		log.Info().Str("name", name).Msg("session create for idempotency key was sent through another replica")
+		foreign(rw, f)
+		return
+	}
+
+	proxy.NewHTTPReverseProxy(opts...).ServeHTTP(rw, req)
+}
+
+// foreignWebDriverSession answers for a WebDriver session created through
+// another replica. The sidecar knows the session by the pod IP, so once it
+// has the session its response is rebuilt, losing only the capabilities
+// beyond the browser name and version; until then the client is told to
+// retry.
+func (s *Service) foreignWebDriverSession(ctx context.Context, log zerolog.Logger, caps selenium.Capabilities) func(http.ResponseWriter, *startupFlight) {
+	return func(rw http.ResponseWriter, f *startupFlight) {
+		if resp, ok := s.rebuildWebDriverSession(ctx, log, f.name, f.podIP, caps.GetBrowserName(), caps.GetBrowserVersion()); ok {
+			f.response = resp
+			resp.write(rw)
+			return
+		}
+		setRetryAfter(rw, time.Second)
+		writeErrorResponse(rw, http.StatusConflict, selenium.ErrSessionNotCreated(ErrIdempotentCreateElsewhere))
+	}
+}
+
+// rebuildWebDriverSession builds the create response of the WebDriver
+// session in the named Browser, if its sidecar has one.
+func (s *Service) rebuildWebDriverSession(ctx context.Context, log zerolog.Logger, name, podIP, browserName, browserVersion string) (*recordedResponse, bool) {
+	plain, err := sidecarSessionID(net.ParseIP(podIP))
+	if err != nil {
+		return nil, false
+	}
+
+	probe, err := http.NewRequestWithContext(ctx, http.MethodGet, (&url.URL{
+		Scheme: "http",
+		Host:   s.sidecarHost(podIP),
+		Path:   "/session/" + plain + "/timeouts",
+	}).String(), nil)
+	if err != nil {
+		return nil, false
+	}
+	resp, err := (&http.Client{Transport: proxy.DefaultTransport}).Do(probe)
+	if err != nil {
+		log.Warn().Err(err).Str("name", name).Msg("failed to look up session in sidecar")
+		return nil, false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+
+	body, err := json.Marshal(map[string]any{"value": map[string]any{
+		"sessionId": plain,
+		"capabilities": map[string]string{
+			"browserName":    browserName,
+			"browserVersion": browserVersion,
+		},
+	}})
+	if err != nil {
+		return nil, false
+	}
+	header := http.Header{"Content-Type": {"application/json; charset=utf-8"}}
+	if body, err = s.signSessionID(header, body, name, podIP); err != nil {
+		return nil, false
+	}
+	return &recordedResponse{status: http.StatusOK, header: header, body: body}, true
+}
+
+// foreignMcpSession answers for an MCP session created through another
+// replica, whose initialize response cannot be rebuilt.
+func foreignMcpSession(rw http.ResponseWriter, f *startupFlight) {
+	setRetryAfter(rw, time.Second)
+	jsonrpc.WriteError(rw, http.StatusConflict, jsonrpc.InternalError, "Session not created: "+ErrIdempotentCreateElsewhere.Error())
+}
@@ -0,0 +1,344 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
+	"github.com/alcounit/browser-service/pkg/event"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func idempotentRequest(key, owner string) *http.Request {
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	req.Header.Set(IdempotencyKeyHeader, key)
+	if owner != "" {
+		req = req.WithContext(auth.WithOwner(req.Context(), auth.Owner{Name: owner}))
+	}
+	return req
+}
+
+func countingTransport(t *testing.T) *atomic.Int32 {
+	var calls atomic.Int32
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		n := calls.Add(1)
+		if n > 1 {
+			return response(http.StatusInternalServerError, `{"value":{"error":"session not created"}}`), nil
+		}
+		return response(http.StatusOK, `{"value":{"sessionId":"first"}}`), nil
+	}))
+	return &calls
+}
+
+func TestCreateSessionIdempotencyKeyReplaysResponse(t *testing.T) {
+	calls := countingTransport(t)
+
+	fc := newPoolClient()
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second})
+
+	for i := range 2 {
+		rw := httptest.NewRecorder()
+		svc.CreateSession(rw, idempotentRequest("retry-1", "alice"))
+
+		if rw.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d: %s", i, rw.Code, rw.Body.String())
+		}
+		if !bytes.Contains(rw.Body.Bytes(), []byte(`"first"`)) {
+			t.Fatalf("request %d: expected first session, got %s", i, rw.Body.String())
+		}
+	}
+
+	if fc.createCount() != 1 {
+		t.Fatalf("expected a single Browser, got %d", fc.createCount())
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected a single create request to the browser, got %d", calls.Load())
+	}
+
+	for _, b := range fc.browsers {
+		if b.Labels[IdempotencyKeyLabelKey] != idempotencyLabel("alice\x00retry-1") {
+			t.Fatalf("expected idempotency label, got %v", b.Labels)
+		}
+	}
+}
+
+func TestCreateSessionIdempotencyKeyScopedToOwner(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"s"}}`), nil
+	}))
+
+	fc := newPoolClient()
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second})
+
+	for _, owner := range []string{"alice", "bob"} {
+		rw := httptest.NewRecorder()
+		svc.CreateSession(rw, idempotentRequest("same", owner))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d", owner, rw.Code)
+		}
+	}
+
+	if fc.createCount() != 2 {
+		t.Fatalf("expected a Browser per owner, got %d", fc.createCount())
+	}
+}
+
+func otherReplicaBrowser(key, owner string) *browserv1.Browser {
+	req := idempotentRequest(key, owner)
+	return &browserv1.Browser{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "8f0e9a52-6f1e-4d0c-9a43-1c2b3d4e5f60",
+			Labels: map[string]string{
+				IdempotencyKeyLabelKey:           idempotencyLabel(owner + "\x00" + key),
+				IdempotencyRequestLabelKey:       idempotencyFingerprint(withIdempotencyPayload(req, []byte(validCapsBody())), "chrome", "120"),
+				browserv1.SelenosisOwnerLabelKey: owner,
+			},
+		},
+		Status: browserv1.BrowserStatus{Phase: "Running", PodIP: "127.0.0.9"},
+	}
+}
+
+func TestCreateSessionIdempotencyKeyFindsBrowserOfOtherReplica(t *testing.T) {
+	var methods []string
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		methods = append(methods, req.Method+" "+req.URL.Host+req.URL.Path)
+		return response(http.StatusOK, `{"value":{"implicit":0}}`), nil
+	}))
+
+	fc := newPoolClient()
+	fc.add(otherReplicaBrowser("k", "alice"))
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second})
+
+	rw := httptest.NewRecorder()
+	svc.CreateSession(rw, idempotentRequest("k", "alice"))
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if fc.createCount() != 0 {
+		t.Fatalf("expected existing Browser to be reused, got %d creates", fc.createCount())
+	}
+	if len(methods) != 1 || methods[0] != "GET 127.0.0.9:4444/session/00000000-0000-0000-0000-ffff7f000009/timeouts" {
+		t.Fatalf("expected the session to be looked up instead of created again, got %v", methods)
+	}
+	if !bytes.Contains(rw.Body.Bytes(), []byte(`"sessionId":"00000000-0000-0000-0000-ffff7f000009"`)) {
+		t.Fatalf("expected the sidecar session, got %s", rw.Body.String())
+	}
+}
+
+func TestCreateSessionIdempotencyKeyOtherReplicaCreateInProgress(t *testing.T) {
+	var creates atomic.Int32
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Method == http.MethodPost {
+			creates.Add(1)
+		}
+		return response(http.StatusNotFound, `{"value":{"error":"invalid session id"}}`), nil
+	}))
+
+	fc := newPoolClient()
+	fc.add(otherReplicaBrowser("k", "alice"))
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second})
+
+	rw := httptest.NewRecorder()
+	svc.CreateSession(rw, idempotentRequest("k", "alice"))
+
+	if rw.Code != http.StatusConflict || rw.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected status 409 with Retry-After, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if creates.Load() != 0 {
+		t.Fatalf("expected no second create request, got %d", creates.Load())
+	}
+	if got := fc.deletedNames(); len(got) != 0 {
+		t.Fatalf("expected the Browser of another replica to be kept, got %v", got)
+	}
+}
+
+// slowClient reports the Browser as Running only once release is closed.
+type slowClient struct {
+	fakeClient
+	release chan struct{}
+	creates atomic.Int32
+}
+
+func (c *slowClient) Create(ctx context.Context, namespace string, browser *browserv1.Browser) (*browserv1.Browser, error) {
+	c.creates.Add(1)
+	return browser, nil
+}
+
+func (c *slowClient) Events(ctx context.Context, namespace string, opts ...event.EventsOption) (browserclient.EventStream, error) {
+	stream := newFakeStream()
+	go func() {
+		<-c.release
+		stream.events <- &event.BrowserEvent{
+			Browser: &browserv1.Browser{Status: browserv1.BrowserStatus{Phase: "Running", PodIP: "127.0.0.1"}},
+		}
+	}()
+	return stream, nil
+}
+
+func TestCreateSessionIdempotencyKeySurvivesClientTimeout(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"s"}}`), nil
+	}))
+
+	fc := &slowClient{release: make(chan struct{})}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	rw := httptest.NewRecorder()
+	svc.CreateSession(rw, idempotentRequest("k", "").WithContext(ctx))
+	if rw.Code != http.StatusInternalServerError {
+		t.Fatalf("expected first request to time out, got %d", rw.Code)
+	}
+
+	close(fc.release)
+
+	rw = httptest.NewRecorder()
+	svc.CreateSession(rw, idempotentRequest("k", ""))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected retry to attach to the startup, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if fc.creates.Load() != 1 {
+		t.Fatalf("expected a single Browser, got %d", fc.creates.Load())
+	}
+	if got := fc.deletedNames(); len(got) != 0 {
+		t.Fatalf("expected no Browser to be deleted, got %v", got)
+	}
+}
+
+func TestCreateSessionIdempotencyKeyRetriesAfterFailure(t *testing.T) {
+	fc := &sequenceClient{streams: []browserclient.EventStream{
+		failedStream("Unschedulable"),
+		runningStream("127.0.0.1"),
+	}}
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"s"}}`), nil
+	}))
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second})
+
+	rw := httptest.NewRecorder()
+	svc.CreateSession(rw, idempotentRequest("k", ""))
+	if rw.Code != http.StatusInternalServerError {
+		t.Fatalf("expected first startup to fail, got %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	svc.CreateSession(rw, idempotentRequest("k", ""))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected retry to start a new browser, got %d", rw.Code)
+	}
+	if len(fc.created) != 2 {
+		t.Fatalf("expected 2 Browsers, got %d", len(fc.created))
+	}
+}
+
+func TestIdempotencyRegistryForgetsAfterTTL(t *testing.T) {
+	r := newIdempotencyRegistry(10*time.Millisecond, 0)
+
+	f, leader := r.join("k", "req")
+	if !leader {
+		t.Fatal("expected first join to lead")
+	}
+	if _, leader := r.join("k", "req"); leader {
+		t.Fatal("expected second join to attach")
+	}
+
+	var abandoned atomic.Bool
+	r.finish("k", f, "br", "127.0.0.1", false, nil, func() { abandoned.Store(true) })
+	waitUntil(t, func() bool { return r.get("k") == nil && abandoned.Load() })
+}
+
+func TestIdempotencyRegistryKeepsDeliveredBrowser(t *testing.T) {
+	r := newIdempotencyRegistry(10*time.Millisecond, 0)
+
+	f, _ := r.join("k", "req")
+	f.delivered.Store(true)
+
+	var abandoned atomic.Bool
+	r.finish("k", f, "br", "127.0.0.1", false, nil, func() { abandoned.Store(true) })
+	waitUntil(t, func() bool { return r.get("k") == nil })
+	if abandoned.Load() {
+		t.Fatal("expected a delivered Browser not to be abandoned")
+	}
+}
+
+func TestIdempotencyRegistryAbandonsBeforeTTL(t *testing.T) {
+	r := newIdempotencyRegistry(time.Hour, 10*time.Millisecond)
+
+	abandonedFlight, _ := r.join("abandoned", "req")
+	var abandoned atomic.Bool
+	r.finish("abandoned", abandonedFlight, "br1", "127.0.0.1", false, nil, func() { abandoned.Store(true) })
+
+	delivered, _ := r.join("delivered", "req")
+	delivered.delivered.Store(true)
+	r.finish("delivered", delivered, "br2", "127.0.0.2", false, nil, func() { t.Error("expected a delivered Browser not to be abandoned") })
+
+	waitUntil(t, func() bool { return r.get("abandoned") == nil && abandoned.Load() })
+	if r.get("delivered") == nil {
+		t.Fatal("expected a delivered startup to be kept for the TTL")
+	}
+}
+
+func TestCreateSessionIdempotencyKeyDeletesAbandonedBrowser(t *testing.T) {
+	fc := &slowClient{release: make(chan struct{})}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second, IdempotencyAbandonTimeout: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	rw := httptest.NewRecorder()
+	svc.CreateSession(rw, idempotentRequest("k", "").WithContext(ctx))
+	if rw.Code != http.StatusInternalServerError {
+		t.Fatalf("expected request to time out, got %d", rw.Code)
+	}
+
+	close(fc.release)
+	waitUntil(t, func() bool { return len(fc.deletedNames()) == 1 })
+}
+
+func TestCreateSessionIdempotencyKeyRefusesDifferentRequest(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"s"}}`), nil
+	}))
+
+	fc := newPoolClient()
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second})
+
+	rw := httptest.NewRecorder()
+	svc.CreateSession(rw, idempotentRequest("k", "alice"))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+
+	different := func() *http.Request {
+		req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBodyWithOptions()), nil)
+		req.Header.Set(IdempotencyKeyHeader, "k")
+		return req.WithContext(auth.WithOwner(req.Context(), auth.Owner{Name: "alice"}))
+	}
+
+	rw = httptest.NewRecorder()
+	svc.CreateSession(rw, different())
+	if rw.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status 422, got %d: %s", rw.Code, rw.Body.String())
+	}
+
+	// another replica only knows the Browser
+	other := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second})
+	rw = httptest.NewRecorder()
+	other.CreateSession(rw, different())
+	if rw.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status 422 from another replica, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if fc.createCount() != 1 {
+		t.Fatalf("expected a single Browser, got %d", fc.createCount())
+	}
+}
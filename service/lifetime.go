@@ -0,0 +1,235 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	logctx "github.com/alcounit/browser-controller/pkg/log"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// SessionLifetimeAnnotationKey holds the longest time, as a Go duration,
+	// the session of a Browser may last from when the Browser is Running.
+	SessionLifetimeAnnotationKey = "selenosis.io/session-lifetime"
+
+	defaultLifetimeCheckInterval = 30 * time.Second
+)
+
+var ErrSessionLifetimeExceeded = errors.New("session lifetime exceeded")
+
+// lifetimesEnabled reports whether the operator limits session lifetimes.
+func (s *Service) lifetimesEnabled() bool {
+	return s.config.MaxSessionLifetime > 0 || len(s.config.SessionLifetimes) > 0
+}
+
+// sessionLifetime picks the maximum lifetime of a session: the operator
+// limit for the owner, else for the browser, else the default, shortened by
+// the one requested by the client. Zero means no limit.
+func (s *Service) sessionLifetime(owner, name, version string, so sessionOptions) time.Duration {
+	if !s.lifetimesEnabled() {
+		return 0
+	}
+
+	lifetime := s.config.MaxSessionLifetime
+	if d, ok := s.config.SessionLifetimes["owner:"+owner]; ok && owner != "" {
+		lifetime = d
+	} else if d, ok := s.config.SessionLifetimes[poolKey(name, version)]; ok {
+		lifetime = d
+	} else if d, ok := s.config.SessionLifetimes[name]; ok {
+		lifetime = d
+	}
+
+	if so.Lifetime > 0 && (lifetime <= 0 || so.Lifetime < lifetime) {
+		lifetime = so.Lifetime
+	}
+	return lifetime
+}
+
+// setSessionLifetime stamps the lifetime of the session on template and
+// returns it, or zero when the session lifetime is not limited. The deadline
+// is only known once the Browser is Running.
+func (s *Service) setSessionLifetime(template *browserv1.Browser, so sessionOptions) time.Duration {
+	owner := template.GetLabels()[browserv1.SelenosisOwnerLabelKey]
+	lifetime := s.sessionLifetime(owner, template.Spec.BrowserName, template.Spec.BrowserVersion, so)
+	if lifetime > 0 {
+		stampSessionLifetime(template, lifetime)
+	}
+	return lifetime
+}
+
+func stampSessionLifetime(template *browserv1.Browser, lifetime time.Duration) {
+	if template.Annotations == nil {
+		template.Annotations = map[string]string{}
+	}
+	template.Annotations[SessionLifetimeAnnotationKey] = lifetime.String()
+}
+
+// deadlineAfter returns the time a session that may last lifetime ends,
+// counted from now, or the zero time when it is not limited.
+func deadlineAfter(lifetime time.Duration) time.Time {
+	if lifetime <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(lifetime)
+}
+
+// runningSince returns when the containers of b last started, or when its
+// pod started if none reports it, or the zero time before that.
+func runningSince(b *browserv1.Browser) time.Time {
+	var since time.Time
+	for _, cs := range b.Status.ContainerStatuses {
+		if r := cs.State.Running; r != nil && r.StartedAt.Time.After(since) {
+			since = r.StartedAt.Time
+		}
+	}
+	if since.IsZero() && b.Status.StartTime != nil {
+		since = b.Status.StartTime.Time
+	}
+	return since
+}
+
+// ParseSessionLifetimes parses per-owner and per-browser session lifetimes
+// such as "owner:alice=8h,chrome=2h,chrome/120.0=1h".
+func ParseSessionLifetimes(s string) (map[string]time.Duration, error) {
+	return parseDurations("session lifetime", s)
+}
+
+type sessionDeadline struct {
+	name     string
+	deadline time.Time
+}
+
+// sessionDeadlines knows the deadlines of sessions by pod IP. Deadlines come
+// from the lifetime annotations of listed Browsers, counted from when they
+// were Running, and from sessions started by this replica, counted from when
+// they were handed out. The earlier of the two wins.
+type sessionDeadlines struct {
+	mu        sync.RWMutex
+	deadlines map[string]sessionDeadline
+}
+
+func newSessionDeadlines() *sessionDeadlines {
+	return &sessionDeadlines{deadlines: map[string]sessionDeadline{}}
+}
+
+// set records the deadline of the named session at podIP. A session handed
+// out again, such as for a repeated Idempotency-Key, keeps its first one.
+func (d *sessionDeadlines) set(podIP, name string, deadline time.Time) {
+	if deadline.IsZero() {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if sd, ok := d.deadlines[podIP]; ok && sd.name == name && sd.deadline.Before(deadline) {
+		return
+	}
+	d.deadlines[podIP] = sessionDeadline{name: name, deadline: deadline}
+}
+
+// expired reports whether the session at ip outlived its deadline.
+func (d *sessionDeadlines) expired(ip net.IP) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	sd, ok := d.deadlines[ip.String()]
+	return ok && time.Now().After(sd.deadline)
+}
+
+// refresh replaces the known deadlines with those of browsers and returns
+// the sessions whose deadline has passed.
+func (d *sessionDeadlines) refresh(log zerolog.Logger, browsers []*browserv1.Browser) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	deadlines := map[string]sessionDeadline{}
+	listed := map[string]bool{}
+	var expired []string
+
+	for _, b := range browsers {
+		if b == nil {
+			continue
+		}
+		listed[b.GetName()] = true
+		if b.Status.PodIP == "" {
+			continue
+		}
+
+		sd, ok := d.deadlines[b.Status.PodIP]
+		if !ok || sd.name != b.GetName() {
+			sd = sessionDeadline{name: b.GetName()}
+		}
+		if v, ok := b.GetAnnotations()[SessionLifetimeAnnotationKey]; ok {
+			lifetime, err := time.ParseDuration(v)
+			if err != nil {
+				log.Warn().Err(err).Str("name", b.GetName()).Msg("invalid session lifetime annotation")
+				continue
+			}
+			if since := runningSince(b); !since.IsZero() {
+				if deadline := since.Add(lifetime); sd.deadline.IsZero() || deadline.Before(sd.deadline) {
+					sd.deadline = deadline
+				}
+			}
+		}
+		if sd.deadline.IsZero() {
+			continue
+		}
+
+		deadlines[b.Status.PodIP] = sd
+		if now.After(sd.deadline) && b.GetDeletionTimestamp() == nil {
+			expired = append(expired, b.GetName())
+		}
+	}
+
+	// sessions started after the list was taken are kept until they show up
+	for ip, sd := range d.deadlines {
+		if _, ok := deadlines[ip]; !ok && now.Before(sd.deadline) && !listed[sd.name] {
+			deadlines[ip] = sd
+		}
+	}
+
+	d.deadlines = deadlines
+	return expired
+}
+
+// enforceLifetimes deletes the Browsers of sessions that outlived their
+// deadline until ctx is done. It does nothing when lifetimes are not
+// limited.
+func (s *Service) enforceLifetimes(ctx context.Context) {
+	if !s.lifetimesEnabled() {
+		return
+	}
+
+	log := logctx.FromContext(ctx)
+
+	interval := s.config.LifetimeCheckInterval
+	if interval <= 0 {
+		interval = defaultLifetimeCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		browsers, err := s.client.List(ctx, s.config.Namespace)
+		if err != nil {
+			log.Err(err).Msg("failed to list browsers for lifetime check")
+			continue
+		}
+
+		for _, name := range s.deadlines.refresh(log, browsers) {
+			log.Info().Str("name", name).Msg("session lifetime exceeded")
+			s.deleteBrowser(ctx, log, name)
+		}
+	}
+}
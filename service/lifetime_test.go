@@ -0,0 +1,254 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSessionLifetimePrecedence(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{
+		MaxSessionLifetime: 4 * time.Hour,
+		SessionLifetimes: map[string]time.Duration{
+			"owner:alice":  8 * time.Hour,
+			"chrome":       2 * time.Hour,
+			"chrome/120.0": time.Hour,
+		},
+	})
+
+	tests := []struct {
+		name      string
+		owner     string
+		browser   string
+		version   string
+		requested time.Duration
+		expected  time.Duration
+	}{
+		{"owner", "alice", "chrome", "120.0", 0, 8 * time.Hour},
+		{"browser version", "bob", "chrome", "120.0", 0, time.Hour},
+		{"browser", "bob", "chrome", "121.0", 0, 2 * time.Hour},
+		{"default", "bob", "firefox", "", 0, 4 * time.Hour},
+		{"shorter requested", "alice", "chrome", "", 30 * time.Minute, 30 * time.Minute},
+		{"longer requested", "bob", "firefox", "", 10 * time.Hour, 4 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := svc.sessionLifetime(tt.owner, tt.browser, tt.version, sessionOptions{Lifetime: tt.requested})
+			if got != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSessionLifetimeUnlimited(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{})
+
+	if got := svc.sessionLifetime("", "chrome", "", sessionOptions{}); got != 0 {
+		t.Fatalf("expected no limit, got %s", got)
+	}
+	if got := svc.sessionLifetime("", "chrome", "", sessionOptions{Lifetime: time.Minute}); got != 0 {
+		t.Fatalf("expected requested lifetime to be ignored without a limit, got %s", got)
+	}
+}
+
+func TestCreateSessionStampsLifetime(t *testing.T) {
+	fc := &captureClient{fakeClient: fakeClient{stream: runningStream("127.0.0.1")}}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second, MaxSessionLifetime: time.Hour})
+
+	_, podIP, _, ok := svc.createBrowser(httptest.NewRecorder(), newRequestWithParams(http.MethodPost, "/session", nil, nil), "chrome", "120", nil, sessionOptions{}, writeCreateSessionWaitError)
+	if !ok {
+		t.Fatal("expected browser to be created")
+	}
+
+	if v := fc.created.GetAnnotations()[SessionLifetimeAnnotationKey]; v != "1h0m0s" {
+		t.Fatalf("expected lifetime annotation, got %q", v)
+	}
+	sd := svc.deadlines.deadlines[podIP]
+	if sd.deadline.Before(time.Now().Add(time.Hour-time.Second)) || sd.deadline.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("expected deadline to count from when the session started, got %s", sd.deadline)
+	}
+}
+
+func TestSetSessionLifetimeUnlimited(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{})
+	template, err := newBrowserTemplate(context.Background(), "chrome", "120", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lifetime := svc.setSessionLifetime(template, sessionOptions{Lifetime: time.Hour}); lifetime != 0 {
+		t.Fatalf("expected no lifetime, got %s", lifetime)
+	}
+	if _, ok := template.GetAnnotations()[SessionLifetimeAnnotationKey]; ok {
+		t.Fatal("expected no lifetime annotation")
+	}
+}
+
+func TestSessionDeadlinesSetKeepsFirst(t *testing.T) {
+	d := newSessionDeadlines()
+	first := time.Now().Add(time.Minute)
+	d.set("10.0.0.1", "b1", first)
+	d.set("10.0.0.1", "b1", first.Add(time.Hour))
+
+	if got := d.deadlines["10.0.0.1"].deadline; !got.Equal(first) {
+		t.Fatalf("expected first deadline to be kept, got %s", got)
+	}
+}
+
+func TestEnforceLifetimesDisabled(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{LifetimeCheckInterval: time.Millisecond})
+
+	done := make(chan struct{})
+	go func() {
+		svc.enforceLifetimes(context.Background())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected lifetime checks not to run without a limit")
+	}
+}
+
+func TestParseSessionLifetimes(t *testing.T) {
+	got, err := ParseSessionLifetimes("owner:alice=8h, chrome=2h,chrome/120.0=1h")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if got["owner:alice"] != 8*time.Hour || got["chrome"] != 2*time.Hour || got["chrome/120.0"] != time.Hour {
+		t.Fatalf("unexpected lifetimes: %v", got)
+	}
+
+	if _, err := ParseSessionLifetimes("chrome=forever"); err == nil {
+		t.Fatal("expected error for invalid lifetime")
+	}
+}
+
+func lifetimeBrowser(name, podIP, lifetime string, since time.Time) *browserv1.Browser {
+	b := &browserv1.Browser{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status: browserv1.BrowserStatus{
+			Phase: "Running",
+			PodIP: podIP,
+			ContainerStatuses: []browserv1.ContainerStatus{{
+				Name:  "browser",
+				State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: metav1.NewTime(since)}},
+			}},
+		},
+	}
+	if lifetime != "" {
+		b.Annotations = map[string]string{SessionLifetimeAnnotationKey: lifetime}
+	}
+	return b
+}
+
+func TestSessionDeadlinesRefresh(t *testing.T) {
+	d := newSessionDeadlines()
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	// pooled browser claimed by this replica, whose lifetime annotation
+	// allows for the time it waited in the pool
+	d.set("10.0.0.3", "pooled", past)
+	// started after the list was taken
+	d.set("10.0.0.4", "fresh", future)
+	// gone from the cluster
+	d.set("10.0.0.5", "gone", past)
+
+	expired := d.refresh(zerolog.Nop(), []*browserv1.Browser{
+		lifetimeBrowser("old", "10.0.0.1", "1h0m0s", time.Now().Add(-2*time.Hour)),
+		lifetimeBrowser("young", "10.0.0.2", "1h0m0s", time.Now()),
+		lifetimeBrowser("pooled", "10.0.0.3", "1h30m0s", time.Now().Add(-time.Hour)),
+		lifetimeBrowser("broken", "10.0.0.6", "forever", time.Now().Add(-2*time.Hour)),
+		lifetimeBrowser("other", "10.0.0.7", "1h0m0s", time.Now().Add(-61*time.Minute)),
+	})
+
+	if len(expired) != 3 || expired[0] != "old" || expired[1] != "pooled" || expired[2] != "other" {
+		t.Fatalf("unexpected expired sessions: %v", expired)
+	}
+
+	for ip, want := range map[string]bool{
+		"10.0.0.1": true,
+		"10.0.0.2": false,
+		"10.0.0.3": true,
+		"10.0.0.4": false,
+		"10.0.0.5": false,
+		"10.0.0.6": false,
+		"10.0.0.7": true,
+	} {
+		if got := d.expired(net.ParseIP(ip)); got != want {
+			t.Fatalf("%s: expected expired %v, got %v", ip, want, got)
+		}
+	}
+	if _, ok := d.deadlines["10.0.0.4"]; !ok {
+		t.Fatal("expected deadline of fresh session to be kept")
+	}
+	if _, ok := d.deadlines["10.0.0.5"]; ok {
+		t.Fatal("expected deadline of gone session to be dropped")
+	}
+}
+
+func TestSessionDeadlinesRefreshWaitsForRunning(t *testing.T) {
+	d := newSessionDeadlines()
+	b := lifetimeBrowser("pending", "10.0.0.1", "1m0s", time.Time{})
+	b.Status.ContainerStatuses = nil
+
+	if expired := d.refresh(zerolog.Nop(), []*browserv1.Browser{b}); len(expired) != 0 {
+		t.Fatalf("expected no expired sessions, got %v", expired)
+	}
+}
+
+func TestSessionDeadlinesRefreshSkipsDeletingBrowsers(t *testing.T) {
+	d := newSessionDeadlines()
+	b := lifetimeBrowser("old", "10.0.0.1", "1m0s", time.Now().Add(-time.Hour))
+	now := metav1.Now()
+	b.DeletionTimestamp = &now
+
+	if expired := d.refresh(zerolog.Nop(), []*browserv1.Browser{b}); len(expired) != 0 {
+		t.Fatalf("expected no expired sessions, got %v", expired)
+	}
+}
+
+func expiredSessionService(t *testing.T) *Service {
+	t.Helper()
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Fatal("expected expired session not to be proxied")
+		return nil, nil
+	}))
+
+	svc := NewService(&fakeClient{}, ServiceConfig{SidecarPort: "4444"})
+	svc.deadlines.set("127.0.0.1", "br", time.Now().Add(-time.Second))
+	return svc
+}
+
+func TestProxySessionLifetimeExceeded(t *testing.T) {
+	svc := expiredSessionService(t)
+
+	req := sessionDeleteRequest(t, "")
+	req.Method = http.MethodGet
+	rw := httptest.NewRecorder()
+	svc.ProxySession(rw, req)
+
+	verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrSessionLifetimeExceeded))
+}
+
+func TestMcpHandlerLifetimeExceeded(t *testing.T) {
+	svc := expiredSessionService(t)
+
+	rw := httptest.NewRecorder()
+	svc.McpHandler(rw, mcpProxyRequest(t, http.MethodPost, "/mcp"))
+
+	assertMcpError(t, rw, http.StatusNotFound, -32001)
+}
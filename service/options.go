@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
 )
@@ -144,6 +146,109 @@ func parseSelenosisOptions(q url.Values, limits parseLimits) (map[string]any, er
 	return out, nil
 }
 
+// sessionOptions are the parts of selenosis:options consumed by the hub
+// itself rather than by browser-controller.
+type sessionOptions struct {
+	PriorityClass  string
+	StartupTimeout time.Duration
+	// Lifetime shortens the maximum session lifetime.
+	Lifetime time.Duration
+}
+
+const (
+	priorityClassKey   = "priorityClass"
+	startupTimeoutKey  = "startupTimeout"
+	sessionLifetimeKey = "sessionLifetime"
+)
+
+// extractSessionOptions reads the hub options from opts and removes them, so
+// that only pod settings end up in the Browser annotation.
+func extractSessionOptions(opts map[string]any) (sessionOptions, error) {
+	var so sessionOptions
+	if opts == nil {
+		return so, nil
+	}
+
+	if raw, ok := opts[priorityClassKey]; ok {
+		class, ok := raw.(string)
+		if !ok {
+			return so, fmt.Errorf("invalid %s: expected string", priorityClassKey)
+		}
+		so.PriorityClass = strings.TrimSpace(class)
+		delete(opts, priorityClassKey)
+	}
+
+	for key, dst := range map[string]*time.Duration{
+		startupTimeoutKey:  &so.StartupTimeout,
+		sessionLifetimeKey: &so.Lifetime,
+	} {
+		raw, ok := opts[key]
+		if !ok {
+			continue
+		}
+		d, err := durationOption(key, raw)
+		if err != nil {
+			return so, err
+		}
+		*dst = d
+		delete(opts, key)
+	}
+
+	return so, nil
+}
+
+func sessionOptionsFromQuery(q url.Values) (sessionOptions, error) {
+	var so sessionOptions
+	so.PriorityClass = strings.TrimSpace(q.Get(priorityClassKey))
+
+	for key, dst := range map[string]*time.Duration{
+		startupTimeoutKey:  &so.StartupTimeout,
+		sessionLifetimeKey: &so.Lifetime,
+	} {
+		if v := strings.TrimSpace(q.Get(key)); v != "" {
+			d, err := parseDurationOption(key, v)
+			if err != nil {
+				return so, err
+			}
+			*dst = d
+		}
+	}
+	return so, nil
+}
+
+// durationOption reads a duration option from decoded JSON: a duration
+// string, or a plain number of seconds.
+func durationOption(key string, raw any) (time.Duration, error) {
+	switch v := raw.(type) {
+	case string:
+		return parseDurationOption(key, v)
+	case float64:
+		d := time.Duration(v * float64(time.Second))
+		if d <= 0 {
+			return 0, fmt.Errorf("invalid %s: must be positive", key)
+		}
+		return d, nil
+	default:
+		return 0, fmt.Errorf("invalid %s: expected duration string or seconds", key)
+	}
+}
+
+// parseDurationOption accepts Go durations ("90s", "5m") and plain seconds.
+func parseDurationOption(key, v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, convErr := strconv.ParseFloat(v, 64)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", key, v)
+	}
+	return d, nil
+}
+
 func setSelenosisOptions(ann map[string]string, opts map[string]any) (map[string]string, error) {
 	if len(opts) == 0 {
 		return ann, nil
@@ -161,3 +266,20 @@ func setSelenosisOptions(ann map[string]string, opts map[string]any) (map[string
 	ann[browserv1.SelenosisOptionsAnnotationKey] = string(b)
 	return ann, nil
 }
+
+// sessionLabels returns the labels a session was started with. They are kept
+// in the selenosis options annotation of its Browser, not as its labels.
+func sessionLabels(b *browserv1.Browser) map[string]string {
+	raw, ok := b.GetAnnotations()[browserv1.SelenosisOptionsAnnotationKey]
+	if !ok {
+		return nil
+	}
+
+	var opts struct {
+		Labels map[string]string `json:"labels"`
+	}
+	if err := json.Unmarshal([]byte(raw), &opts); err != nil {
+		return nil
+	}
+	return opts.Labels
+}
@@ -4,6 +4,9 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
 )
 
 func TestParseSelenosisOptionsSuccess(t *testing.T) {
@@ -144,3 +147,125 @@ func TestParseSelenosisOptionsEmptyValueSlice(t *testing.T) {
 		t.Fatalf("expected empty string value, got %q", v)
 	}
 }
+
+func TestExtractSessionOptions(t *testing.T) {
+	opts := map[string]any{
+		"priorityClass": " ci ",
+		"labels":        map[string]any{"team": "qa"},
+	}
+
+	so, err := extractSessionOptions(opts)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if so.PriorityClass != "ci" {
+		t.Fatalf("unexpected priority class: %q", so.PriorityClass)
+	}
+	if _, ok := opts["priorityClass"]; ok {
+		t.Fatal("expected priorityClass to be removed from options")
+	}
+	if _, ok := opts["labels"]; !ok {
+		t.Fatal("expected labels to be kept")
+	}
+
+	if _, err := extractSessionOptions(map[string]any{"priorityClass": 1}); err == nil {
+		t.Fatal("expected error for non-string priority class")
+	}
+
+	if so, err := extractSessionOptions(nil); err != nil || so != (sessionOptions{}) {
+		t.Fatalf("expected zero options, got %+v %v", so, err)
+	}
+}
+
+func TestSessionOptionsFromQuery(t *testing.T) {
+	so, err := sessionOptionsFromQuery(url.Values{"priorityClass": {"interactive"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if so.PriorityClass != "interactive" {
+		t.Fatalf("unexpected priority class: %q", so.PriorityClass)
+	}
+}
+
+func TestExtractSessionOptionsStartupTimeout(t *testing.T) {
+	for raw, expected := range map[any]time.Duration{
+		"90s": 90 * time.Second,
+		"2m":  2 * time.Minute,
+		"45":  45 * time.Second,
+		30.0:  30 * time.Second,
+	} {
+		opts := map[string]any{"startupTimeout": raw}
+		so, err := extractSessionOptions(opts)
+		if err != nil {
+			t.Fatalf("%v: expected no error, got %v", raw, err)
+		}
+		if so.StartupTimeout != expected {
+			t.Fatalf("%v: expected %s, got %s", raw, expected, so.StartupTimeout)
+		}
+		if _, ok := opts["startupTimeout"]; ok {
+			t.Fatal("expected startupTimeout to be removed from options")
+		}
+	}
+
+	for _, raw := range []any{"soon", "-1s", 0.0, true} {
+		if _, err := extractSessionOptions(map[string]any{"startupTimeout": raw}); err == nil {
+			t.Fatalf("expected error for %v", raw)
+		}
+	}
+}
+
+func TestSessionOptionsFromQueryStartupTimeout(t *testing.T) {
+	so, err := sessionOptionsFromQuery(url.Values{"startupTimeout": {"5m"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if so.StartupTimeout != 5*time.Minute {
+		t.Fatalf("unexpected startup timeout: %s", so.StartupTimeout)
+	}
+
+	if _, err := sessionOptionsFromQuery(url.Values{"startupTimeout": {"never"}}); err == nil {
+		t.Fatal("expected error for invalid startup timeout")
+	}
+}
+
+func TestSessionOptionsSessionLifetime(t *testing.T) {
+	so, err := extractSessionOptions(map[string]any{"sessionLifetime": "30m"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if so.Lifetime != 30*time.Minute {
+		t.Fatalf("unexpected session lifetime: %s", so.Lifetime)
+	}
+
+	so, err = sessionOptionsFromQuery(url.Values{"sessionLifetime": {"1h"}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if so.Lifetime != time.Hour {
+		t.Fatalf("unexpected session lifetime: %s", so.Lifetime)
+	}
+
+	if _, err := sessionOptionsFromQuery(url.Values{"sessionLifetime": {"-1h"}}); err == nil {
+		t.Fatal("expected error for invalid session lifetime")
+	}
+}
+
+func TestSessionLabels(t *testing.T) {
+	opts, err := parseSelenosisOptions(url.Values{"labels.team": {"web"}}, defaultParseLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := newBrowserTemplate(t.Context(), "chrome", "120", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := sessionLabels(template); len(got) != 1 || got["team"] != "web" {
+		t.Fatalf("unexpected labels: %v", got)
+	}
+
+	template.Annotations[browserv1.SelenosisOptionsAnnotationKey] = "{"
+	if got := sessionLabels(template); got != nil {
+		t.Fatalf("expected no labels for a broken annotation, got %v", got)
+	}
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+)
+
+const defaultOwnerCacheTTL = 10 * time.Second
+
+// ownerCache remembers the Browser found at a pod IP for a short while, so
+// that the ownership of a session is not looked up on every request when no
+// session registry is kept.
+type ownerCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]ownerCacheEntry
+}
+
+type ownerCacheEntry struct {
+	browser *browserv1.Browser
+	expires time.Time
+}
+
+func newOwnerCache(ttl time.Duration) *ownerCache {
+	if ttl <= 0 {
+		ttl = defaultOwnerCacheTTL
+	}
+	return &ownerCache{ttl: ttl, entries: map[string]ownerCacheEntry{}}
+}
+
+func (c *ownerCache) get(ip string) (*browserv1.Browser, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[ip]
+	if !ok || time.Now().After(e.expires) {
+		delete(c.entries, ip)
+		return nil, false
+	}
+	return e.browser, true
+}
+
+func (c *ownerCache) put(ip string, b *browserv1.Browser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[ip] = ownerCacheEntry{browser: b, expires: now.Add(c.ttl)}
+}
+
+// authorizeSession checks that the owner in ctx started the session at ip.
+// b is the Browser of the session when it is already known. Admins and
+// requests without an owner, when auth is off, may use every session.
+func (s *Service) authorizeSession(ctx context.Context, ip net.IP, b *browserv1.Browser) error {
+	if !s.config.EnforceOwnership || auth.IsAdmin(ctx) {
+		return nil
+	}
+
+	if b == nil {
+		var ok bool
+		if b, ok = s.owners.get(ip.String()); !ok {
+			var err error
+			if b, err = s.browserByIP(ctx, ip); err != nil {
+				return err
+			}
+			s.owners.put(ip.String(), b)
+		}
+	}
+
+	owner, _ := auth.OwnerFrom(ctx)
+	if s.browserOwner(b) != owner.Name {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// resolveSession returns an error when the session at ip may not be
+// proxied: its Browser is gone or was replaced, or it belongs to someone
+// else.
+func (s *Service) resolveSession(ctx context.Context, ip net.IP, name string) error {
+	b, err := s.liveSession(ctx, ip, name)
+	if err != nil {
+		return err
+	}
+	return s.authorizeSession(ctx, ip, b)
+}
@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+)
+
+// ownedClient lists a single running Browser owned by owner and counts the
+// List calls.
+type ownedClient struct {
+	*ipClient
+	lists atomic.Int32
+}
+
+func newOwnedClient(owner string) *ownedClient {
+	c := &ownedClient{ipClient: newIPClient("br", "127.0.0.1")}
+	c.browser.Labels = map[string]string{browserv1.SelenosisOwnerLabelKey: owner}
+	return c
+}
+
+func (c *ownedClient) List(ctx context.Context, namespace string) ([]*browserv1.Browser, error) {
+	c.lists.Add(1)
+	return c.ipClient.List(ctx, namespace)
+}
+
+func ownedSessionRequest(t *testing.T, owner *auth.Owner) *http.Request {
+	t.Helper()
+	req := sessionDeleteRequest(t, "/url")
+	req.Method = http.MethodGet
+	if owner != nil {
+		req = req.WithContext(auth.WithOwner(req.Context(), *owner))
+	}
+	return req
+}
+
+func TestProxySessionOwnership(t *testing.T) {
+	tests := []struct {
+		name     string
+		owner    *auth.Owner
+		enforce  bool
+		expected int
+	}{
+		{"owner", &auth.Owner{Name: "alice"}, true, http.StatusOK},
+		{"other user", &auth.Owner{Name: "bob"}, true, http.StatusNotFound},
+		{"admin", &auth.Owner{Name: "root", Admin: true}, true, http.StatusOK},
+		{"auth disabled", nil, true, http.StatusOK},
+		{"enforcement off", &auth.Owner{Name: "bob"}, false, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return response(http.StatusOK, `{"value":null}`), nil
+			}))
+
+			svc := NewService(newOwnedClient("alice"), ServiceConfig{SidecarPort: "4444", EnforceOwnership: tt.enforce})
+
+			rw := httptest.NewRecorder()
+			svc.ProxySession(rw, ownedSessionRequest(t, tt.owner))
+
+			if tt.expected == http.StatusNotFound {
+				verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrSessionNotFound))
+				return
+			}
+			if rw.Code != tt.expected {
+				t.Fatalf("expected status %d, got %d", tt.expected, rw.Code)
+			}
+		})
+	}
+}
+
+func TestProxySessionOwnershipIsCached(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":null}`), nil
+	}))
+
+	fc := newOwnedClient("alice")
+	svc := NewService(fc, ServiceConfig{SidecarPort: "4444", EnforceOwnership: true})
+
+	for range 3 {
+		rw := httptest.NewRecorder()
+		svc.ProxySession(rw, ownedSessionRequest(t, &auth.Owner{Name: "alice"}))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rw.Code)
+		}
+	}
+	if n := fc.lists.Load(); n != 1 {
+		t.Fatalf("expected one lookup, got %d", n)
+	}
+}
+
+func TestProxySessionOwnershipUsesRegistry(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":null}`), nil
+	}))
+
+	fc := newOwnedClient("alice")
+	svc := NewService(fc, ServiceConfig{SidecarPort: "4444", EnforceOwnership: true, SessionRegistry: true})
+
+	rw := httptest.NewRecorder()
+	svc.ProxySession(rw, ownedSessionRequest(t, &auth.Owner{Name: "bob"}))
+	verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrSessionNotFound))
+
+	rw = httptest.NewRecorder()
+	svc.ProxySession(rw, ownedSessionRequest(t, &auth.Owner{Name: "alice"}))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+	if n := fc.lists.Load(); n != 1 {
+		t.Fatalf("expected the registry lookup only, got %d lists", n)
+	}
+}
+
+func TestMcpHandlerOwnership(t *testing.T) {
+	svc := NewService(newOwnedClient("alice"), ServiceConfig{SidecarPort: "4444", EnforceOwnership: true})
+
+	req := mcpProxyRequest(t, http.MethodPost, "/mcp")
+	req = req.WithContext(auth.WithOwner(req.Context(), auth.Owner{Name: "bob"}))
+	rw := httptest.NewRecorder()
+	svc.McpHandler(rw, req)
+
+	assertMcpError(t, rw, http.StatusNotFound, -32001)
+}
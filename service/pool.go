@@ -0,0 +1,350 @@
+package service
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	logctx "github.com/alcounit/browser-controller/pkg/log"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PoolLabelKey marks Browsers started by the hub ahead of demand. The
+// replica that started such a Browser does not count it as a user session
+// until it is claimed; every other replica, and the same one after a
+// restart, counts it as a session of its owner label.
+const PoolLabelKey = "selenosis.io/pool"
+
+const (
+	defaultPoolRefreshInterval = 10 * time.Second
+	// poolMaxBackoff caps the wait before a browser whose pooled starts
+	// keep failing is started again.
+	poolMaxBackoff = 5 * time.Minute
+	// poolMaxIdle is how long a member with a limited session lifetime
+	// waits to be claimed before it is replaced. Its lifetime annotation
+	// allows for the wait, so that every replica can enforce it.
+	poolMaxIdle = 30 * time.Minute
+)
+
+type PoolConfig struct {
+	Browsers        []PoolBrowser
+	RefreshInterval time.Duration
+}
+
+// PoolBrowser is a browser kept pre-started. Members carry the owner label
+// of Owner from the start and are only handed out to that owner, so that
+// their ownership does not depend on the replica that hands them out.
+type PoolBrowser struct {
+	BrowserName    string `json:"browserName"`
+	BrowserVersion string `json:"browserVersion"`
+	Owner          string `json:"owner,omitempty"`
+	Size           int    `json:"size"`
+}
+
+func (b PoolBrowser) key() string {
+	return poolMemberKey(b.BrowserName, b.BrowserVersion, b.Owner)
+}
+
+// poolMember is a Running member. expires is when it is replaced unless
+// claimed, zero if never.
+type poolMember struct {
+	name    string
+	podIP   string
+	expires time.Time
+}
+
+type browserPool struct {
+	svc      *Service
+	browsers []PoolBrowser
+	interval time.Duration
+
+	mu       sync.Mutex
+	ready    map[string][]poolMember
+	starting map[string]int
+	idle     map[string]bool
+	backoff  map[string]time.Duration
+	retryAt  map[string]time.Time
+	wake     chan struct{}
+}
+
+func newBrowserPool(svc *Service, config PoolConfig) *browserPool {
+	interval := config.RefreshInterval
+	if interval <= 0 {
+		interval = defaultPoolRefreshInterval
+	}
+	return &browserPool{
+		svc:      svc,
+		browsers: config.Browsers,
+		interval: interval,
+		ready:    map[string][]poolMember{},
+		starting: map[string]int{},
+		idle:     map[string]bool{},
+		backoff:  map[string]time.Duration{},
+		retryAt:  map[string]time.Time{},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func poolKey(name, version string) string {
+	return name + "/" + version
+}
+
+func poolMemberKey(name, version, owner string) string {
+	if owner == "" {
+		return poolKey(name, version)
+	}
+	return poolKey(name, version) + "@" + owner
+}
+
+func (p *browserPool) run(ctx context.Context) {
+	log := logctx.FromContext(ctx)
+
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		p.drain(ctx, log)
+	}()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	p.adopt(ctx, log)
+	p.refill(ctx, log, &wg)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.refresh(ctx, log)
+		case <-p.wake:
+		}
+		p.refill(ctx, log, &wg)
+	}
+}
+
+func (p *browserPool) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// adopt logs the pooled Browsers found when the pool starts. They were left
+// by an earlier run of the hub or belong to another replica, and whether
+// they are in use is not known, so they are left to count as sessions of
+// their owner and end like any other session.
+func (p *browserPool) adopt(ctx context.Context, log zerolog.Logger) {
+	browsers, err := p.svc.client.List(ctx, p.svc.config.Namespace)
+	if err != nil {
+		log.Err(err).Msg("failed to list pooled browsers")
+		return
+	}
+
+	var adopted []string
+	for _, b := range browsers {
+		if b == nil {
+			continue
+		}
+		if _, ok := b.GetLabels()[PoolLabelKey]; ok {
+			adopted = append(adopted, b.GetName())
+		}
+	}
+	if len(adopted) > 0 {
+		log.Info().Strs("names", adopted).Msg("pooled browsers of an earlier run adopted as sessions")
+	}
+}
+
+// refill starts the members missing from the pool. Browsers whose starts
+// failed are retried with backoff, and nothing is started while the hub is
+// draining.
+func (p *browserPool) refill(ctx context.Context, log zerolog.Logger, wg *sync.WaitGroup) {
+	if p.svc.Draining() {
+		return
+	}
+
+	now := time.Now()
+	for _, b := range p.browsers {
+		key := b.key()
+
+		p.mu.Lock()
+		if now.Before(p.retryAt[key]) {
+			p.mu.Unlock()
+			continue
+		}
+		missing := b.Size - len(p.ready[key]) - p.starting[key]
+		p.starting[key] += max(missing, 0)
+		p.mu.Unlock()
+
+		for range missing {
+			wg.Go(func() { p.start(ctx, log, b, key) })
+		}
+	}
+}
+
+func (p *browserPool) start(ctx context.Context, log zerolog.Logger, b PoolBrowser, key string) {
+	template := &browserv1.Browser{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   uuid.NewString(),
+			Labels: map[string]string{PoolLabelKey: "true"},
+		},
+		Spec: browserv1.BrowserSpec{
+			BrowserName:    b.BrowserName,
+			BrowserVersion: b.BrowserVersion,
+		},
+	}
+	if b.Owner != "" {
+		template.Labels[browserv1.SelenosisOwnerLabelKey] = b.Owner
+	}
+	lifetime := p.svc.sessionLifetime(b.Owner, b.BrowserName, b.BrowserVersion, sessionOptions{})
+	if lifetime > 0 {
+		stampSessionLifetime(template, lifetime+poolMaxIdle)
+	}
+
+	logger := log.With().
+		Str("browserName", b.BrowserName).
+		Str("browserVersion", b.BrowserVersion).
+		Str("owner", b.Owner).
+		Str("namespace", p.svc.config.Namespace).
+		Bool("pool", true).
+		Logger()
+
+	p.mu.Lock()
+	p.idle[template.GetName()] = true
+	p.mu.Unlock()
+
+	startCtx, cancel := context.WithTimeout(ctx, p.svc.startupTimeout(b.BrowserName, b.BrowserVersion, sessionOptions{}))
+	defer cancel()
+
+	name, podIP, waitErr := p.svc.createBrowserAndWait(startCtx, logger, template)
+
+	p.mu.Lock()
+	p.starting[key]--
+	if waitErr == nil {
+		m := poolMember{name: name, podIP: podIP}
+		if lifetime > 0 {
+			m.expires = time.Now().Add(poolMaxIdle)
+		}
+		p.ready[key] = append(p.ready[key], m)
+		delete(p.backoff, key)
+		delete(p.retryAt, key)
+	} else {
+		delete(p.idle, template.GetName())
+		if ctx.Err() == nil {
+			p.backoff[key] = min(max(p.backoff[key]*2, p.interval), poolMaxBackoff)
+			p.retryAt[key] = time.Now().Add(p.backoff[key])
+		}
+	}
+	backoff := p.backoff[key]
+	p.mu.Unlock()
+
+	if waitErr != nil && ctx.Err() == nil {
+		logger.Warn().Dur("backoff", backoff).Msg("failed to start pooled browser")
+	}
+}
+
+// claim hands out a Running pool member for the given browser and owner,
+// or reports false if none is available. Members of other owners are never
+// handed out, since their owner label cannot be changed.
+func (p *browserPool) claim(ctx context.Context, logger zerolog.Logger, name, version, owner string) (poolMember, bool) {
+	key := poolMemberKey(name, version, owner)
+
+	for {
+		p.mu.Lock()
+		members := p.ready[key]
+		if len(members) == 0 {
+			p.mu.Unlock()
+			return poolMember{}, false
+		}
+		m := members[0]
+		p.ready[key] = members[1:]
+		delete(p.idle, m.name)
+		p.mu.Unlock()
+
+		p.notify()
+
+		if !m.expires.IsZero() && time.Now().After(m.expires) {
+			logger.Info().Str("name", m.name).Msg("pooled browser idle for too long")
+			p.svc.deleteBrowser(ctx, logger, m.name)
+			continue
+		}
+
+		b, err := p.svc.client.Get(ctx, p.svc.config.Namespace, m.name)
+		if err == nil && b != nil && b.Status.Phase == "Running" && b.Status.PodIP == m.podIP && net.ParseIP(m.podIP) != nil {
+			logger.Info().Str("name", m.name).Msg("claimed pooled browser")
+			return m, true
+		}
+
+		logger.Warn().Err(err).Str("name", m.name).Msg("pooled browser is no longer usable")
+		p.svc.deleteBrowser(ctx, logger, m.name)
+	}
+}
+
+// counts reports whether b should be counted as a user session, which is
+// all but the members this replica started and has not handed out.
+func (p *browserPool) counts(b *browserv1.Browser) bool {
+	if _, ok := b.GetLabels()[PoolLabelKey]; !ok {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.idle[b.GetName()]
+}
+
+// refresh drops ready members that are no longer Running or waited too
+// long to be claimed.
+func (p *browserPool) refresh(ctx context.Context, log zerolog.Logger) {
+	browsers, err := p.svc.client.List(ctx, p.svc.config.Namespace)
+	if err != nil {
+		log.Err(err).Msg("failed to refresh browser pool")
+		return
+	}
+
+	running := make(map[string]string, len(browsers))
+	for _, b := range browsers {
+		if b != nil && b.Status.Phase == "Running" {
+			running[b.GetName()] = b.Status.PodIP
+		}
+	}
+
+	var dropped []poolMember
+
+	now := time.Now()
+	p.mu.Lock()
+	for key, members := range p.ready {
+		alive := members[:0]
+		for _, m := range members {
+			if ip, ok := running[m.name]; ok && ip == m.podIP && (m.expires.IsZero() || now.Before(m.expires)) {
+				alive = append(alive, m)
+			} else {
+				dropped = append(dropped, m)
+				delete(p.idle, m.name)
+			}
+		}
+		p.ready[key] = alive
+	}
+	p.mu.Unlock()
+
+	for _, m := range dropped {
+		p.svc.deleteBrowser(ctx, log, m.name)
+	}
+}
+
+// drain deletes members that were never claimed.
+func (p *browserPool) drain(ctx context.Context, log zerolog.Logger) {
+	p.mu.Lock()
+	var members []poolMember
+	for key, m := range p.ready {
+		members = append(members, m...)
+		delete(p.ready, key)
+	}
+	clear(p.idle)
+	p.mu.Unlock()
+
+	for _, m := range members {
+		p.svc.deleteBrowser(ctx, log, m.name)
+	}
+}
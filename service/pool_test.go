@@ -0,0 +1,433 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
+	"github.com/alcounit/browser-service/pkg/event"
+	"github.com/rs/zerolog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// poolClient keeps created Browsers in memory and reports every one of them
+// as Running with a loopback pod IP.
+type poolClient struct {
+	fakeClient
+
+	mu       sync.Mutex
+	browsers map[string]*browserv1.Browser
+	creates  int
+}
+
+func newPoolClient() *poolClient {
+	return &poolClient{browsers: map[string]*browserv1.Browser{}}
+}
+
+func (c *poolClient) Create(ctx context.Context, namespace string, browser *browserv1.Browser) (*browserv1.Browser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.creates++
+	b := browser.DeepCopy()
+	b.Status = browserv1.BrowserStatus{Phase: "Running", PodIP: "127.0.0.1"}
+	c.browsers[b.GetName()] = b
+	return b, nil
+}
+
+func (c *poolClient) Get(ctx context.Context, namespace, name string) (*browserv1.Browser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.browsers[name], nil
+}
+
+func (c *poolClient) Delete(ctx context.Context, namespace, name string) error {
+	c.mu.Lock()
+	delete(c.browsers, name)
+	c.mu.Unlock()
+	return c.fakeClient.Delete(ctx, namespace, name)
+}
+
+func (c *poolClient) List(ctx context.Context, namespace string) ([]*browserv1.Browser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []*browserv1.Browser
+	for _, b := range c.browsers {
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+func (c *poolClient) Events(ctx context.Context, namespace string, opts ...event.EventsOption) (browserclient.EventStream, error) {
+	return runningStream("127.0.0.1"), nil
+}
+
+func (c *poolClient) createCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.creates
+}
+
+func (c *poolClient) add(b *browserv1.Browser) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.browsers[b.GetName()] = b
+}
+
+func pooledBrowser(name, podIP string) *browserv1.Browser {
+	return &browserv1.Browser{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{PoolLabelKey: "true"}},
+		Spec:       browserv1.BrowserSpec{BrowserName: "chrome", BrowserVersion: "120"},
+		Status:     browserv1.BrowserStatus{Phase: "Running", PodIP: podIP},
+	}
+}
+
+// addReady puts members into the pool as if this replica had started them.
+func addReady(svc *Service, key string, members ...poolMember) {
+	svc.pool.ready[key] = append(svc.pool.ready[key], members...)
+	for _, m := range members {
+		svc.pool.idle[m.name] = true
+	}
+}
+
+func poolService(fc *poolClient) *Service {
+	return NewService(fc, ServiceConfig{
+		Namespace:           "ns",
+		SidecarPort:         "4444",
+		BrowserStartTimeout: time.Second,
+		Pool: PoolConfig{
+			Browsers: []PoolBrowser{{BrowserName: "chrome", BrowserVersion: "120", Size: 1}},
+		},
+	})
+}
+
+func TestCreateSessionClaimsPooledBrowser(t *testing.T) {
+	var gotHost string
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		gotHost = req.URL.Host
+		return response(http.StatusOK, `{"value":{"sessionId":"orig"}}`), nil
+	}))
+
+	fc := newPoolClient()
+	fc.add(pooledBrowser("warm", "127.0.0.2"))
+	svc := poolService(fc)
+	addReady(svc, "chrome/120", poolMember{name: "warm", podIP: "127.0.0.2"})
+
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+	if gotHost != "127.0.0.2:4444" {
+		t.Fatalf("expected pooled browser to be used, got %s", gotHost)
+	}
+	if fc.createCount() != 0 {
+		t.Fatalf("expected no browser to be created, got %d", fc.createCount())
+	}
+	if !svc.isSession(pooledBrowser("warm", "127.0.0.2")) {
+		t.Fatal("expected warm to be claimed")
+	}
+}
+
+func TestCreateSessionWithOptionsSkipsPool(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"orig"}}`), nil
+	}))
+
+	fc := newPoolClient()
+	fc.add(pooledBrowser("warm", "127.0.0.2"))
+	svc := poolService(fc)
+	addReady(svc, "chrome/120", poolMember{name: "warm", podIP: "127.0.0.2"})
+
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBodyWithOptions()), nil)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+	if fc.createCount() != 1 {
+		t.Fatalf("expected cold start, got %d creates", fc.createCount())
+	}
+	if len(svc.pool.ready["chrome/120"]) != 1 {
+		t.Fatal("expected pooled browser to stay in the pool")
+	}
+}
+
+func TestPoolClaimSkipsStaleMember(t *testing.T) {
+	fc := newPoolClient()
+	fc.add(pooledBrowser("live", "127.0.0.3"))
+	svc := poolService(fc)
+	addReady(svc, "chrome/120", poolMember{name: "gone", podIP: "127.0.0.2"}, poolMember{name: "live", podIP: "127.0.0.3"})
+
+	m, ok := svc.pool.claim(context.Background(), zerolog.Nop(), "chrome", "120", "")
+	if !ok || m.name != "live" {
+		t.Fatalf("expected live member, got %+v %v", m, ok)
+	}
+	if got := fc.deletedNames(); len(got) != 1 || got[0] != "gone" {
+		t.Fatalf("expected stale member to be deleted, got %v", got)
+	}
+	if svc.pool.idle["gone"] {
+		t.Fatal("expected stale member to be forgotten")
+	}
+
+	if _, ok := svc.pool.claim(context.Background(), zerolog.Nop(), "chrome", "120", ""); ok {
+		t.Fatal("expected empty pool")
+	}
+}
+
+func TestPoolMembersNotCountedUntilClaimed(t *testing.T) {
+	fc := newPoolClient()
+	warm := pooledBrowser("warm", "127.0.0.2")
+	warm.Labels[browserv1.SelenosisOwnerLabelKey] = "alice"
+	fc.add(warm)
+	svc := poolService(fc)
+	addReady(svc, "chrome/120@alice", poolMember{name: "warm", podIP: "127.0.0.2"})
+
+	if n, _ := svc.countRunningBrowsers(context.Background()); n != 0 {
+		t.Fatalf("expected unclaimed member not to count, got %d", n)
+	}
+
+	if _, ok := svc.pool.claim(context.Background(), zerolog.Nop(), "chrome", "120", "bob"); ok {
+		t.Fatal("expected alice's member not to be handed out to bob")
+	}
+	if _, ok := svc.pool.claim(context.Background(), zerolog.Nop(), "chrome", "120", "alice"); !ok {
+		t.Fatal("expected claim to succeed")
+	}
+
+	if n, _ := svc.countRunningBrowsers(context.Background()); n != 1 {
+		t.Fatalf("expected claimed member to count, got %d", n)
+	}
+	sessions, _ := svc.listQuotaSessions(context.Background())
+	if len(sessions) != 1 || sessions[0].Owner != "alice" {
+		t.Fatalf("expected claimed member to be owned by alice, got %+v", sessions)
+	}
+}
+
+func TestPoolMembersOfAnotherReplicaAreSessions(t *testing.T) {
+	fc := newPoolClient()
+	warm := pooledBrowser("warm", "127.0.0.2")
+	warm.Labels[browserv1.SelenosisOwnerLabelKey] = "alice"
+	fc.add(warm)
+
+	// the replica that started warm may have handed it out
+	svc := poolService(fc)
+
+	if n, _ := svc.countRunningBrowsers(context.Background()); n != 1 {
+		t.Fatalf("expected member of another replica to count, got %d", n)
+	}
+	sessions, _ := svc.listQuotaSessions(context.Background())
+	if len(sessions) != 1 || sessions[0].Owner != "alice" {
+		t.Fatalf("expected member to be owned by alice, got %+v", sessions)
+	}
+}
+
+func TestPoolStartsMembersWithOwner(t *testing.T) {
+	fc := newPoolClient()
+	svc := NewService(fc, ServiceConfig{
+		Namespace:           "ns",
+		BrowserStartTimeout: time.Second,
+		Pool: PoolConfig{
+			Browsers: []PoolBrowser{{BrowserName: "chrome", BrowserVersion: "120", Owner: "alice", Size: 1}},
+		},
+	})
+
+	var wg sync.WaitGroup
+	svc.pool.refill(context.Background(), zerolog.Nop(), &wg)
+	wg.Wait()
+
+	members := svc.pool.ready["chrome/120@alice"]
+	if len(members) != 1 {
+		t.Fatalf("expected a member for alice, got %+v", svc.pool.ready)
+	}
+	b, _ := fc.Get(context.Background(), "ns", members[0].name)
+	if owner := b.GetLabels()[browserv1.SelenosisOwnerLabelKey]; owner != "alice" {
+		t.Fatalf("expected member to carry alice's owner label, got %q", owner)
+	}
+	if svc.isSession(b) {
+		t.Fatal("expected unclaimed member not to be a session")
+	}
+}
+
+func TestPoolMembersAllowForIdleTimeInLifetime(t *testing.T) {
+	fc := newPoolClient()
+	svc := NewService(fc, ServiceConfig{
+		Namespace:           "ns",
+		BrowserStartTimeout: time.Second,
+		MaxSessionLifetime:  time.Hour,
+		Pool: PoolConfig{
+			Browsers: []PoolBrowser{{BrowserName: "chrome", BrowserVersion: "120", Size: 1}},
+		},
+	})
+
+	var wg sync.WaitGroup
+	svc.pool.refill(context.Background(), zerolog.Nop(), &wg)
+	wg.Wait()
+
+	members := svc.pool.ready["chrome/120"]
+	if len(members) != 1 || members[0].expires.IsZero() {
+		t.Fatalf("expected a member that expires, got %+v", members)
+	}
+	b, _ := fc.Get(context.Background(), "ns", members[0].name)
+	if v := b.GetAnnotations()[SessionLifetimeAnnotationKey]; v != (time.Hour + poolMaxIdle).String() {
+		t.Fatalf("expected lifetime to allow for the idle time, got %q", v)
+	}
+
+	// the member waited too long to be claimed
+	svc.pool.ready["chrome/120"][0].expires = time.Now().Add(-time.Second)
+	svc.pool.refresh(context.Background(), zerolog.Nop())
+	if got := svc.pool.ready["chrome/120"]; len(got) != 0 {
+		t.Fatalf("expected expired member to be replaced, got %+v", got)
+	}
+}
+
+func TestPoolRefillBacksOff(t *testing.T) {
+	fc := &fakeClient{createErr: errors.New("boom")}
+	svc := NewService(fc, ServiceConfig{
+		Namespace:           "ns",
+		BrowserStartTimeout: time.Second,
+		Pool: PoolConfig{
+			Browsers:        []PoolBrowser{{BrowserName: "chrome", BrowserVersion: "120", Size: 2}},
+			RefreshInterval: time.Minute,
+		},
+	})
+
+	var wg sync.WaitGroup
+	svc.pool.refill(context.Background(), zerolog.Nop(), &wg)
+	wg.Wait()
+
+	if got := svc.pool.backoff["chrome/120"]; got != 2*time.Minute {
+		t.Fatalf("expected backoff to double per failure, got %v", got)
+	}
+	if !svc.pool.retryAt["chrome/120"].After(time.Now()) {
+		t.Fatal("expected retry to be scheduled")
+	}
+
+	svc.pool.refill(context.Background(), zerolog.Nop(), &wg)
+	wg.Wait()
+	if svc.pool.starting["chrome/120"] != 0 || svc.pool.backoff["chrome/120"] != 2*time.Minute {
+		t.Fatal("expected no start before the backoff elapsed")
+	}
+	if len(svc.pool.idle) != 0 {
+		t.Fatalf("expected failed members to be forgotten, got %v", svc.pool.idle)
+	}
+}
+
+func TestPoolRefillStopsWhileDraining(t *testing.T) {
+	fc := newPoolClient()
+	svc := poolService(fc)
+	svc.SetDraining(true)
+
+	var wg sync.WaitGroup
+	svc.pool.refill(context.Background(), zerolog.Nop(), &wg)
+	wg.Wait()
+
+	if fc.createCount() != 0 {
+		t.Fatalf("expected no browser to be started while draining, got %d", fc.createCount())
+	}
+}
+
+func TestPoolRunRefillsAndDrains(t *testing.T) {
+	fc := newPoolClient()
+	svc := poolService(fc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.Run(ctx)
+		close(done)
+	}()
+
+	waitUntil(t, func() bool {
+		svc.pool.mu.Lock()
+		defer svc.pool.mu.Unlock()
+		return len(svc.pool.ready["chrome/120"]) == 1
+	})
+
+	m, ok := svc.pool.claim(context.Background(), zerolog.Nop(), "chrome", "120", "")
+	if !ok {
+		t.Fatal("expected claim to succeed")
+	}
+
+	waitUntil(t, func() bool { return fc.createCount() == 2 })
+	waitUntil(t, func() bool {
+		svc.pool.mu.Lock()
+		defer svc.pool.mu.Unlock()
+		return len(svc.pool.ready["chrome/120"]) == 1
+	})
+
+	cancel()
+	<-done
+
+	deleted := fc.deletedNames()
+	if len(deleted) != 1 || deleted[0] == m.name {
+		t.Fatalf("expected only the unclaimed member to be drained, got %v", deleted)
+	}
+}
+
+func TestPoolRefreshDropsMissingMembers(t *testing.T) {
+	fc := newPoolClient()
+	fc.add(pooledBrowser("live", "127.0.0.3"))
+	svc := poolService(fc)
+	addReady(svc, "chrome/120", poolMember{name: "gone", podIP: "127.0.0.2"}, poolMember{name: "live", podIP: "127.0.0.3"})
+
+	svc.pool.refresh(context.Background(), zerolog.Nop())
+
+	if got := svc.pool.ready["chrome/120"]; len(got) != 1 || got[0].name != "live" {
+		t.Fatalf("unexpected ready members: %+v", got)
+	}
+	if svc.pool.idle["gone"] || !svc.pool.idle["live"] {
+		t.Fatalf("unexpected idle members: %v", svc.pool.idle)
+	}
+}
+
+func waitUntil(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met in time")
+}
+
+func TestSessionFeedAnnouncesClaimedPoolMember(t *testing.T) {
+	fc := newPoolClient()
+	fc.add(pooledBrowser("warm", "127.0.0.2"))
+	svc := NewService(fc, ServiceConfig{
+		Namespace:     "ns",
+		SessionEvents: true,
+		Pool:          PoolConfig{Browsers: []PoolBrowser{{BrowserName: "chrome", BrowserVersion: "120", Size: 1}}},
+	})
+	addReady(svc, "chrome/120", poolMember{name: "warm", podIP: "127.0.0.2"})
+	svc.feed.resync(nil)
+
+	svc.feed.apply(feedEvent(event.EventTypeAdded, pooledBrowser("warm", "127.0.0.2")))
+	if got := feedTypes(svc.feed); len(got) != 0 {
+		t.Fatalf("expected unclaimed member not to be published, got %v", got)
+	}
+
+	if _, _, err := svc.claimOrCreateBrowser(context.Background(), zerolog.Nop(), &browserv1.Browser{
+		Spec: browserv1.BrowserSpec{BrowserName: "chrome", BrowserVersion: "120"},
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"warm:created", "warm:running"}
+	if got := feedTypes(svc.feed); !slices.Equal(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/alcounit/selenosis/v2/pkg/proxy"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultSidecarProbePath     = "/status"
+	defaultSidecarProbeInterval = 250 * time.Millisecond
+	sidecarProbeAttemptTimeout  = 2 * time.Second
+)
+
+// SidecarProbe checks that the sidecar of a Running Browser accepts requests
+// before the first one is forwarded to it. The probe expects a 2xx answer to
+// a GET of Path, the WebDriver status endpoint by default.
+type SidecarProbe struct {
+	Enabled  bool
+	Path     string
+	Interval time.Duration
+}
+
+// waitForSidecar probes the sidecar at podIP until it is ready or ctx, which
+// carries the startup deadline, is done.
+func (s *Service) waitForSidecar(ctx context.Context, logger zerolog.Logger, name, podIP string) *browserError {
+	if !s.config.SidecarProbe.Enabled {
+		return nil
+	}
+
+	interval := s.config.SidecarProbe.Interval
+	if interval <= 0 {
+		interval = defaultSidecarProbeInterval
+	}
+
+	attempts := 0
+	err := proxy.Retry(ctx, interval, func(ctx context.Context) error {
+		attempts++
+		err := s.probeSidecar(ctx, podIP)
+		if err != nil {
+			logger.Debug().Err(err).Str("name", name).Int("attempt", attempts).Msg("browser sidecar not ready")
+		}
+		return err
+	})
+	if err != nil {
+		logger.Warn().Err(err).Str("name", name).Msg("browser sidecar did not become ready")
+		return contextDoneError(ctx, logger, name)
+	}
+
+	logger.Info().Str("name", name).Int("attempts", attempts).Msg("browser sidecar ready")
+	return nil
+}
+
+func (s *Service) probeSidecar(ctx context.Context, podIP string) error {
+	ctx, cancel := context.WithTimeout(ctx, sidecarProbeAttemptTimeout)
+	defer cancel()
+
+	path := s.config.SidecarProbe.Path
+	if path == "" {
+		path = defaultSidecarProbePath
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+s.sidecarHost(podIP)+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := (&http.Client{Transport: proxy.DefaultTransport}).Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sidecar probe answered %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	"github.com/rs/zerolog"
+)
+
+func TestCreateSessionWaitsForSidecar(t *testing.T) {
+	var probes atomic.Int32
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path == "/status" {
+			if probes.Add(1) < 3 {
+				return nil, errors.New("connection refused")
+			}
+			return response(http.StatusOK, `{"value":{"ready":true}}`), nil
+		}
+		if probes.Load() < 3 {
+			t.Fatal("expected session create to wait for the sidecar")
+		}
+		return response(http.StatusOK, `{"value":{"sessionId":"s1"}}`), nil
+	}))
+
+	fc := &fakeClient{stream: runningStream("127.0.0.1")}
+	svc := NewService(fc, ServiceConfig{
+		Namespace:           "ns",
+		SidecarPort:         "4444",
+		BrowserStartTimeout: 2 * time.Second,
+		SidecarProbe:        SidecarProbe{Enabled: true, Path: "/status", Interval: 10 * time.Millisecond},
+	})
+
+	rw := httptest.NewRecorder()
+	svc.CreateSession(rw, newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil))
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if n := probes.Load(); n != 3 {
+		t.Fatalf("expected 3 probes, got %d", n)
+	}
+}
+
+func TestCreateSessionSidecarNeverReady(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.Path != "/status" {
+			t.Fatal("expected session create not to be forwarded")
+		}
+		return response(http.StatusServiceUnavailable, `{}`), nil
+	}))
+
+	fc := &fakeClient{stream: runningStream("127.0.0.1")}
+	svc := NewService(fc, ServiceConfig{
+		Namespace:           "ns",
+		SidecarPort:         "4444",
+		BrowserStartTimeout: 100 * time.Millisecond,
+		SidecarProbe:        SidecarProbe{Enabled: true, Path: "/status", Interval: 10 * time.Millisecond},
+	})
+
+	rw := httptest.NewRecorder()
+	svc.CreateSession(rw, newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil))
+
+	deleted := fc.deletedNames()
+	if len(deleted) != 1 {
+		t.Fatalf("expected browser to be deleted, got %v", deleted)
+	}
+	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrTimeout(fmt.Errorf("%w (browser %s)", ErrStartupTimeout, deleted[0])))
+}
+
+func TestWaitForSidecarDefaultPath(t *testing.T) {
+	var probed string
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		probed = req.URL.String()
+		return response(http.StatusOK, `{"value":{"ready":true}}`), nil
+	}))
+
+	svc := NewService(&fakeClient{}, ServiceConfig{SidecarPort: "4444", SidecarProbe: SidecarProbe{Enabled: true}})
+
+	if waitErr := svc.waitForSidecar(t.Context(), zerolog.Nop(), "br", "127.0.0.1"); waitErr != nil {
+		t.Fatalf("expected sidecar to be ready, got %v", waitErr.err)
+	}
+	if probed != "http://127.0.0.1:4444/status" {
+		t.Fatalf("expected status endpoint to be probed, got %s", probed)
+	}
+}
+
+func TestWaitForSidecarDisabled(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Fatal("expected no probe")
+		return nil, nil
+	}))
+
+	svc := NewService(&fakeClient{}, ServiceConfig{SidecarPort: "4444", SidecarProbe: SidecarProbe{Path: "/status"}})
+	if waitErr := svc.waitForSidecar(t.Context(), zerolog.Nop(), "br", "127.0.0.1"); waitErr != nil {
+		t.Fatalf("expected no error, got %v", waitErr.err)
+	}
+}
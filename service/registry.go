@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
+	"github.com/alcounit/browser-service/pkg/event"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// sessionRegistry indexes the Running Browsers of the namespace by pod IP,
+// so that a session id is only proxied to a pod that is a live browser. It
+// is kept up to date by the browserWatcher.
+type sessionRegistry struct {
+	client    browserclient.Client
+	namespace string
+
+	mu     sync.RWMutex
+	byIP   map[string]*browserv1.Browser
+	byName map[string]string
+	// added is closed when a live Browser is indexed, and replaced.
+	added chan struct{}
+
+	// refreshMu lets a single lookup miss refresh the index at a time.
+	refreshMu sync.Mutex
+	refreshed time.Time
+}
+
+// registryRefreshInterval is the least time between two refreshes of the
+// index for IPs missing from it, so that unknown session ids cannot make
+// every request list the namespace.
+const registryRefreshInterval = time.Second
+
+func newSessionRegistry(client browserclient.Client, namespace string) *sessionRegistry {
+	return &sessionRegistry{
+		client:    client,
+		namespace: namespace,
+		byIP:      map[string]*browserv1.Browser{},
+		byName:    map[string]string{},
+		added:     make(chan struct{}),
+	}
+}
+
+// resync replaces the index with a fresh list, so that Browsers deleted
+// while the watcher was disconnected are dropped.
+func (r *sessionRegistry) resync(browsers []*browserv1.Browser) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.byIP = map[string]*browserv1.Browser{}
+	r.byName = map[string]string{}
+	for _, b := range browsers {
+		if b != nil {
+			r.setLocked(b)
+		}
+	}
+}
+
+func (r *sessionRegistry) apply(e *event.BrowserEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e.EventType == event.EventTypeDeleted {
+		r.removeLocked(e.Browser.GetName())
+		return
+	}
+	r.setLocked(e.Browser)
+}
+
+func (r *sessionRegistry) setLocked(b *browserv1.Browser) {
+	r.removeLocked(b.GetName())
+	if !liveBrowser(b) {
+		return
+	}
+	r.byIP[b.Status.PodIP] = b
+	r.byName[b.GetName()] = b.Status.PodIP
+	close(r.added)
+	r.added = make(chan struct{})
+}
+
+func (r *sessionRegistry) removeLocked(name string) {
+	ip, ok := r.byName[name]
+	if !ok {
+		return
+	}
+	delete(r.byName, name)
+	if b, ok := r.byIP[ip]; ok && b.GetName() == name {
+		delete(r.byIP, ip)
+	}
+}
+
+// lookup returns the live Browser at ip. An IP missing from the index is
+// looked for in a fresh list, as the event for a session that has just been
+// started elsewhere may not have arrived yet. The index is refreshed at most
+// once per registryRefreshInterval; a miss in between waits for the next
+// refresh, or for the watcher to index the IP meanwhile, and is answered
+// from the index if another miss refreshed it since.
+func (r *sessionRegistry) lookup(ctx context.Context, ip net.IP) (*browserv1.Browser, error) {
+	if b, ok := r.indexed(ip); ok {
+		return b, nil
+	}
+	missed := time.Now()
+
+	r.refreshMu.Lock()
+	defer r.refreshMu.Unlock()
+
+	for {
+		r.mu.RLock()
+		b, ok := r.byIP[ip.String()]
+		added := r.added
+		r.mu.RUnlock()
+
+		if ok {
+			return b, nil
+		}
+		if r.refreshed.After(missed) {
+			return nil, ErrSessionNotFound
+		}
+		wait := registryRefreshInterval - time.Since(r.refreshed)
+		if wait <= 0 {
+			break
+		}
+
+		r.refreshMu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-added:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		r.refreshMu.Lock()
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	browsers, err := r.client.List(ctx, r.namespace)
+	if err != nil {
+		return nil, err
+	}
+	r.refreshed = time.Now()
+	r.resync(browsers)
+
+	if b, ok := r.indexed(ip); ok {
+		return b, nil
+	}
+	return nil, ErrSessionNotFound
+}
+
+func (r *sessionRegistry) indexed(ip net.IP) (*browserv1.Browser, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	b, ok := r.byIP[ip.String()]
+	return b, ok
+}
+
+func liveBrowser(b *browserv1.Browser) bool {
+	return b.Status.Phase == corev1.PodRunning && b.Status.PodIP != "" && b.GetDeletionTimestamp() == nil
+}
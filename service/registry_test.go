@@ -0,0 +1,240 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/browser-service/pkg/event"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+)
+
+func indexed(r *sessionRegistry, ip string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if b, ok := r.byIP[ip]; ok {
+		return b.GetName()
+	}
+	return ""
+}
+
+func TestSessionRegistryFollowsEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newWatchClient()
+	c.list = []*browserv1.Browser{
+		browserEvent("a", "1", "Running", "10.0.0.1").Browser,
+		browserEvent("p", "2", "Pending", "10.0.0.9").Browser,
+	}
+
+	r := newSessionRegistry(c, "ns")
+	w := newBrowserWatcher(c, "ns")
+	w.listen(r)
+	go w.run(ctx)
+
+	stream := newFakeStream()
+	c.streams <- stream
+
+	waitUntil(t, func() bool { return indexed(r, "10.0.0.1") == "a" })
+	if indexed(r, "10.0.0.9") != "" {
+		t.Fatal("expected pending browser not to be indexed")
+	}
+
+	stream.events <- browserEvent("b", "3", "Running", "10.0.0.2")
+	stream.events <- browserEvent("a", "4", "Failed", "10.0.0.1")
+	waitUntil(t, func() bool { return indexed(r, "10.0.0.2") == "b" && indexed(r, "10.0.0.1") == "" })
+
+	// the IP of a deleted Browser was handed to a new one before the
+	// deletion event arrived
+	stream.events <- browserEvent("c", "5", "Running", "10.0.0.2")
+	deleted := browserEvent("b", "6", "Running", "10.0.0.2")
+	deleted.EventType = event.EventTypeDeleted
+	stream.events <- deleted
+	stream.events <- browserEvent("d", "7", "Running", "10.0.0.4")
+
+	waitUntil(t, func() bool { return indexed(r, "10.0.0.4") == "d" })
+	if got := indexed(r, "10.0.0.2"); got != "c" {
+		t.Fatalf("expected 10.0.0.2 to belong to c, got %q", got)
+	}
+}
+
+func TestSessionRegistryResyncsOnResubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newWatchClient()
+	c.list = []*browserv1.Browser{browserEvent("a", "1", "Running", "10.0.0.1").Browser}
+
+	r := newSessionRegistry(c, "ns")
+	w := newBrowserWatcher(c, "ns")
+	w.listen(r)
+	go w.run(ctx)
+
+	first := newFakeStream()
+	c.streams <- first
+	waitUntil(t, func() bool { return indexed(r, "10.0.0.1") == "a" })
+
+	// a was deleted while disconnected
+	c.listMu.Lock()
+	c.list = []*browserv1.Browser{browserEvent("b", "2", "Running", "10.0.0.2").Browser}
+	c.listMu.Unlock()
+	first.Close()
+	c.streams <- newFakeStream()
+
+	waitUntil(t, func() bool { return indexed(r, "10.0.0.2") == "b" && indexed(r, "10.0.0.1") == "" })
+}
+
+func TestSessionRegistryAndFeedShareWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newWatchClient()
+	svc := NewService(c, ServiceConfig{Namespace: "ns", SessionRegistry: true, SessionEvents: true, EventsMode: EventsModePerRequest})
+	go svc.Run(ctx)
+
+	stream := newFakeStream()
+	c.streams <- stream
+	stream.events <- browserEvent("a", "1", "Running", "10.0.0.1")
+
+	waitUntil(t, func() bool {
+		svc.feed.mu.Lock()
+		defer svc.feed.mu.Unlock()
+		return indexed(svc.registry, "10.0.0.1") == "a" && svc.feed.browsers["a"] != nil
+	})
+
+	select {
+	case c.streams <- newFakeStream():
+		t.Fatal("expected the registry and the feed to share one event stream")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSessionRegistryLookupFallsBackToList(t *testing.T) {
+	c := newWatchClient()
+	c.list = []*browserv1.Browser{
+		browserEvent("a", "1", "Running", "10.0.0.1").Browser,
+		browserEvent("p", "2", "Pending", "10.0.0.2").Browser,
+	}
+	r := newSessionRegistry(c, "ns")
+
+	b, err := r.lookup(context.Background(), net.ParseIP("10.0.0.1"))
+	if err != nil || b.GetName() != "a" {
+		t.Fatalf("expected a, got %v, %v", b, err)
+	}
+	if indexed(r, "10.0.0.1") != "a" {
+		t.Fatal("expected looked up browser to be indexed")
+	}
+
+	for _, ip := range []string{"10.0.0.2", "10.0.0.3"} {
+		// as if the refresh interval had passed
+		r.refreshed = time.Time{}
+		if _, err := r.lookup(context.Background(), net.ParseIP(ip)); !errors.Is(err, ErrSessionNotFound) {
+			t.Fatalf("%s: expected ErrSessionNotFound, got %v", ip, err)
+		}
+	}
+}
+
+func TestSessionRegistryLookupRefreshesOncePerInterval(t *testing.T) {
+	c := newWatchClient()
+	r := newSessionRegistry(c, "ns")
+
+	// refreshed a moment before a was started on another replica
+	r.refreshed = time.Now()
+	c.list = []*browserv1.Browser{browserEvent("a", "1", "Running", "10.0.0.1").Browser}
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip := net.IPv4(10, 0, 1, byte(i))
+			if _, err := r.lookup(context.Background(), ip); !errors.Is(err, ErrSessionNotFound) {
+				t.Errorf("%s: expected ErrSessionNotFound, got %v", ip, err)
+			}
+		}()
+	}
+	if b, err := r.lookup(context.Background(), net.ParseIP("10.0.0.1")); err != nil || b.GetName() != "a" {
+		t.Fatalf("expected a after the interval, got %v, %v", b, err)
+	}
+	wg.Wait()
+
+	if c.lists != 1 {
+		t.Fatalf("expected misses to list the namespace once, got %d", c.lists)
+	}
+}
+
+func TestSessionRegistryLookupWaitsForWatcher(t *testing.T) {
+	c := newWatchClient()
+	r := newSessionRegistry(c, "ns")
+	r.refreshed = time.Now()
+
+	found := make(chan error, 1)
+	go func() {
+		_, err := r.lookup(context.Background(), net.ParseIP("10.0.0.1"))
+		found <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	r.apply(browserEvent("a", "1", "Running", "10.0.0.1"))
+
+	select {
+	case err := <-found:
+		if err != nil {
+			t.Fatalf("expected a to be found, got %v", err)
+		}
+	case <-time.After(registryRefreshInterval / 2):
+		t.Fatal("expected the lookup to end with the watcher event")
+	}
+	if c.lists != 0 {
+		t.Fatalf("expected no list, got %d", c.lists)
+	}
+}
+
+func TestProxySessionUnknownSession(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Fatal("expected unknown session not to be proxied")
+		return nil, nil
+	}))
+
+	svc := NewService(&fakeClient{}, ServiceConfig{SidecarPort: "4444", SessionRegistry: true})
+
+	req := sessionDeleteRequest(t, "")
+	req.Method = http.MethodGet
+	rw := httptest.NewRecorder()
+	svc.ProxySession(rw, req)
+
+	verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrSessionNotFound))
+}
+
+func TestProxySessionLiveSession(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":null}`), nil
+	}))
+
+	svc := NewService(newIPClient("br", "127.0.0.1"), ServiceConfig{SidecarPort: "4444", SessionRegistry: true})
+
+	req := sessionDeleteRequest(t, "/url")
+	req.Method = http.MethodGet
+	rw := httptest.NewRecorder()
+	svc.ProxySession(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+}
+
+func TestMcpHandlerUnknownSession(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{SidecarPort: "4444", SessionRegistry: true})
+
+	rw := httptest.NewRecorder()
+	svc.McpHandler(rw, mcpProxyRequest(t, http.MethodPost, "/mcp"))
+
+	assertMcpError(t, rw, http.StatusNotFound, -32001)
+}
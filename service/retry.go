@@ -0,0 +1,136 @@
+package service
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	logctx "github.com/alcounit/browser-controller/pkg/log"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+// DefaultRetryReasons are the Browser Status.Reason values that usually
+// clear up on their own when the Browser is started again.
+var DefaultRetryReasons = []string{"Evicted", "PendingTimeoutExceeded", "QuotaExceeded"}
+
+const defaultRetryBackoff = time.Second
+
+// Startup retry counters, published with expvar. startupRetries counts the
+// retries by the Status.Reason that caused them, and startupAttempts counts
+// the startups that retried by the number of attempts they took and whether
+// they ended up running.
+var (
+	startupRetries  = expvar.NewMap("selenosis_browser_start_retries")
+	startupAttempts = expvar.NewMap("selenosis_browser_start_attempts")
+)
+
+// DebugVars serves the expvar variables of the process, the startup retry
+// counters among them. It is restricted to admins.
+func (s *Service) DebugVars(rw http.ResponseWriter, req *http.Request) {
+	log := logctx.FromContext(req.Context())
+
+	if !auth.IsAdmin(req.Context()) {
+		log.Warn().Msg("debug vars refused to non-admin")
+		http.Error(rw, ErrAdminOnly.Error(), http.StatusForbidden)
+		return
+	}
+	expvar.Handler().ServeHTTP(rw, req)
+}
+
+func countStartupAttempts(attempt int, started bool) {
+	outcome := "failed"
+	if started {
+		outcome = "started"
+	}
+	startupAttempts.Add(strconv.Itoa(attempt)+"/"+outcome, 1)
+}
+
+type RetryConfig struct {
+	// MaxAttempts is the number of Browsers tried for one session, including
+	// the first one. Values below 2 disable retries.
+	MaxAttempts int
+	// Backoff is the delay before the second attempt; it doubles for every
+	// further attempt up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Reasons lists the Status.Reason values of a Failed Browser that are
+	// worth another attempt.
+	Reasons []string
+}
+
+func (c RetryConfig) retryable(waitErr *browserError) bool {
+	return waitErr.kind == browserFailed && slices.Contains(c.Reasons, waitErr.reason)
+}
+
+func (c RetryConfig) backoff(attempt int) time.Duration {
+	d := c.Backoff
+	if d <= 0 {
+		d = defaultRetryBackoff
+	}
+	for range attempt - 1 {
+		if c.MaxBackoff > 0 && d >= c.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+	if c.MaxBackoff > 0 && d > c.MaxBackoff {
+		d = c.MaxBackoff
+	}
+	return d
+}
+
+// startBrowser creates the Browser described by template and waits for it to
+// run, starting a fresh Browser after retryable failures for as long as ctx
+// allows. Failed Browsers are deleted before the next attempt.
+func (s *Service) startBrowser(ctx context.Context, logger zerolog.Logger, template *browserv1.Browser) (string, string, *browserError) {
+	retry := s.config.Retry
+
+	for attempt := 1; ; attempt++ {
+		candidate := template
+		if attempt > 1 {
+			candidate = template.DeepCopy()
+			candidate.SetName(uuid.NewString())
+		}
+
+		attemptLog := logger.With().Int("attempt", attempt).Logger()
+
+		name, podIP, waitErr := s.createBrowserAndWait(ctx, attemptLog, candidate)
+		if waitErr == nil {
+			if attempt > 1 {
+				attemptLog.Info().Str("name", name).Msg("browser started after retry")
+				countStartupAttempts(attempt, true)
+			}
+			return name, podIP, nil
+		}
+
+		if attempt >= retry.MaxAttempts || !retry.retryable(waitErr) {
+			if attempt > 1 {
+				attemptLog.Warn().Str("name", name).Msg("giving up on browser startup")
+				countStartupAttempts(attempt, false)
+			}
+			return name, podIP, waitErr
+		}
+
+		delay := retry.backoff(attempt)
+		startupRetries.Add(waitErr.reason, 1)
+		attemptLog.Warn().
+			Str("name", name).
+			Str("statusReason", waitErr.reason).
+			Dur("backoff", delay).
+			Msg("retrying browser startup")
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return name, "", contextDoneError(ctx, attemptLog, name)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
+	"github.com/alcounit/browser-service/pkg/event"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	"github.com/rs/zerolog"
+)
+
+// sequenceClient hands out one prepared stream per Events call and records
+// the names of the Browsers it was asked to create.
+type sequenceClient struct {
+	fakeClient
+
+	seqMu   sync.Mutex
+	streams []browserclient.EventStream
+	created []string
+}
+
+func (c *sequenceClient) Events(ctx context.Context, namespace string, opts ...event.EventsOption) (browserclient.EventStream, error) {
+	c.seqMu.Lock()
+	defer c.seqMu.Unlock()
+	stream := c.streams[0]
+	if len(c.streams) > 1 {
+		c.streams = c.streams[1:]
+	}
+	return stream, nil
+}
+
+func (c *sequenceClient) Create(ctx context.Context, namespace string, browser *browserv1.Browser) (*browserv1.Browser, error) {
+	c.seqMu.Lock()
+	c.created = append(c.created, browser.GetName())
+	c.seqMu.Unlock()
+	return browser, nil
+}
+
+func failedStream(reason string) *fakeStream {
+	stream := newFakeStream()
+	stream.events <- &event.BrowserEvent{
+		Browser: &browserv1.Browser{
+			Status: browserv1.BrowserStatus{Phase: "Failed", Reason: reason},
+		},
+	}
+	return stream
+}
+
+func retryService(fc browserclient.Client, retry RetryConfig) *Service {
+	return NewService(fc, ServiceConfig{
+		Namespace:           "ns",
+		SidecarPort:         "4444",
+		BrowserStartTimeout: time.Second,
+		Retry:               retry,
+	})
+}
+
+func expvarCount(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestStartBrowserRetriesRetryableFailure(t *testing.T) {
+	evicted := expvarCount(startupRetries, "Evicted")
+	started := expvarCount(startupAttempts, "3/started")
+
+	fc := &sequenceClient{streams: []browserclient.EventStream{
+		failedStream("Evicted"),
+		failedStream("PendingTimeoutExceeded"),
+		runningStream("127.0.0.1"),
+	}}
+	svc := retryService(fc, RetryConfig{
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		Reasons:     DefaultRetryReasons,
+	})
+
+	template := &browserv1.Browser{}
+	template.SetName("first")
+
+	name, podIP, waitErr := svc.startBrowser(context.Background(), zerolog.Nop(), template)
+	if waitErr != nil {
+		t.Fatalf("expected startup to succeed, got %+v", waitErr)
+	}
+	if podIP != "127.0.0.1" {
+		t.Fatalf("unexpected pod IP %q", podIP)
+	}
+
+	if len(fc.created) != 3 {
+		t.Fatalf("expected 3 attempts, got %v", fc.created)
+	}
+	if fc.created[0] != "first" || fc.created[1] == "first" || fc.created[2] == fc.created[1] {
+		t.Fatalf("expected a fresh Browser per attempt, got %v", fc.created)
+	}
+	if name != fc.created[2] {
+		t.Fatalf("expected last Browser to be returned, got %s", name)
+	}
+
+	deleted := fc.deletedNames()
+	if len(deleted) != 2 || deleted[0] != fc.created[0] || deleted[1] != fc.created[1] {
+		t.Fatalf("expected failed Browsers to be deleted, got %v", deleted)
+	}
+
+	if got := expvarCount(startupRetries, "Evicted") - evicted; got != 1 {
+		t.Fatalf("expected 1 retry for Evicted to be counted, got %d", got)
+	}
+	if got := expvarCount(startupAttempts, "3/started") - started; got != 1 {
+		t.Fatalf("expected a startup after 3 attempts to be counted, got %d", got)
+	}
+}
+
+func TestStartBrowserDoesNotRetryOtherReasons(t *testing.T) {
+	fc := &sequenceClient{streams: []browserclient.EventStream{
+		failedStream("InvalidSelenosisOptions"),
+		runningStream("127.0.0.1"),
+	}}
+	svc := retryService(fc, RetryConfig{MaxAttempts: 3, Backoff: time.Millisecond, Reasons: DefaultRetryReasons})
+
+	_, _, waitErr := svc.startBrowser(context.Background(), zerolog.Nop(), &browserv1.Browser{})
+	if waitErr == nil || waitErr.kind != browserFailed || waitErr.reason != "InvalidSelenosisOptions" {
+		t.Fatalf("expected browserFailed, got %+v", waitErr)
+	}
+	if len(fc.created) != 1 {
+		t.Fatalf("expected a single attempt, got %d", len(fc.created))
+	}
+}
+
+func TestStartBrowserStopsAtMaxAttempts(t *testing.T) {
+	fc := &sequenceClient{streams: []browserclient.EventStream{
+		failedStream("Evicted"),
+		failedStream("Evicted"),
+		runningStream("127.0.0.1"),
+	}}
+	svc := retryService(fc, RetryConfig{MaxAttempts: 2, Backoff: time.Millisecond, Reasons: DefaultRetryReasons})
+	failed := expvarCount(startupAttempts, "2/failed")
+
+	_, _, waitErr := svc.startBrowser(context.Background(), zerolog.Nop(), &browserv1.Browser{})
+	if waitErr == nil || waitErr.kind != browserFailed {
+		t.Fatalf("expected browserFailed, got %+v", waitErr)
+	}
+	if len(fc.created) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(fc.created))
+	}
+	if got := expvarCount(startupAttempts, "2/failed") - failed; got != 1 {
+		t.Fatalf("expected a failed startup after 2 attempts to be counted, got %d", got)
+	}
+}
+
+func TestStartBrowserBackoffBoundedByDeadline(t *testing.T) {
+	fc := &sequenceClient{streams: []browserclient.EventStream{
+		failedStream("Evicted"),
+		runningStream("127.0.0.1"),
+	}}
+	svc := retryService(fc, RetryConfig{MaxAttempts: 3, Backoff: time.Hour, Reasons: DefaultRetryReasons})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, _, waitErr := svc.startBrowser(ctx, zerolog.Nop(), &browserv1.Browser{})
+	if waitErr == nil || waitErr.kind != browserStartTimeout {
+		t.Fatalf("expected startup timeout, got %+v", waitErr)
+	}
+	if len(fc.created) != 1 {
+		t.Fatalf("expected a single attempt, got %d", len(fc.created))
+	}
+}
+
+func TestCreateSessionRetriesEvictedBrowser(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"orig"}}`), nil
+	}))
+
+	fc := &sequenceClient{streams: []browserclient.EventStream{
+		failedStream("Evicted"),
+		runningStream("127.0.0.1"),
+	}}
+	svc := retryService(fc, RetryConfig{MaxAttempts: 2, Backoff: time.Millisecond, Reasons: DefaultRetryReasons})
+
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if len(fc.created) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(fc.created))
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	c := RetryConfig{Backoff: time.Second, MaxBackoff: 5 * time.Second}
+
+	for attempt, expected := range map[int]time.Duration{
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 5 * time.Second,
+		9: 5 * time.Second,
+	} {
+		if got := c.backoff(attempt); got != expected {
+			t.Fatalf("attempt %d: expected %s, got %s", attempt, expected, got)
+		}
+	}
+
+	if got := (RetryConfig{}).backoff(1); got != defaultRetryBackoff {
+		t.Fatalf("expected default backoff, got %s", got)
+	}
+}
+
+func TestDebugVarsAdminOnly(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{})
+
+	call := func(owner auth.Owner) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/debug/vars", nil)
+		req = req.WithContext(auth.WithOwner(req.Context(), owner))
+		rw := httptest.NewRecorder()
+		svc.DebugVars(rw, req)
+		return rw
+	}
+
+	if rw := call(auth.Owner{Name: "alice"}); rw.Code != http.StatusForbidden {
+		t.Fatalf("expected non-admin to be refused, got %d", rw.Code)
+	}
+	if rw := call(auth.Owner{Name: "root", Admin: true}); rw.Code != http.StatusOK || !bytes.Contains(rw.Body.Bytes(), []byte("selenosis_browser_start_retries")) {
+		t.Fatalf("expected the retry counters, got %d: %s", rw.Code, rw.Body.String())
+	}
+}
@@ -12,16 +12,22 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
 	logctx "github.com/alcounit/browser-controller/pkg/log"
 	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
+	"github.com/alcounit/selenosis/v2/pkg/admission"
 	"github.com/alcounit/selenosis/v2/pkg/auth"
 	"github.com/alcounit/selenosis/v2/pkg/ipuuid"
 	"github.com/alcounit/selenosis/v2/pkg/jsonrpc"
 	"github.com/alcounit/selenosis/v2/pkg/proxy"
+	"github.com/alcounit/selenosis/v2/pkg/quota"
 	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	"github.com/alcounit/selenosis/v2/pkg/sessionid"
+	"github.com/alcounit/selenosis/v2/pkg/usage"
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/rs/zerolog"
@@ -34,22 +40,108 @@ var (
 	ErrDecodeRequestBody   = errors.New("failed to decode request body")
 	ErrCapabilityMatch     = errors.New("cannot match request capabilities")
 	ErrInternal            = errors.New("internal server error")
+	ErrStartupTimeout      = errors.New("browser startup timed out")
+	ErrClientDisconnected  = errors.New("client disconnected")
 )
 
 const (
-	maxRequestBodySize = 1 << 20 // 1 MB
-	wdHubPrefix        = "/wd/hub"
+	maxRequestBodySize   = 1 << 20 // 1 MB
+	wdHubPrefix          = "/wd/hub"
+	browserDeleteTimeout = 30 * time.Second
+	// playwrightDialRetry caps how long the Playwright WebSocket dial is
+	// retried once the sidecar answered its readiness probe.
+	playwrightDialRetry = 10 * time.Second
 )
 
 type Service struct {
 	client browserclient.Client
 	config ServiceConfig
+	queue  *admission.Queue
+	quotas *quota.Enforcer
+	pool   *browserPool
+
+	idempotency *idempotencyRegistry
+	startups    *startupJobs
+	watcher     *browserWatcher
+	wsConns     *proxy.Tracker
+	conns       *browserConns
+	deadlines   *sessionDeadlines
+	registry    *sessionRegistry
+	sessionIDs  *sessionid.Codec
+	owners      *ownerCache
+	feed        *sessionFeed
+
+	draining atomic.Bool
 }
 
 type ServiceConfig struct {
 	Namespace           string
 	SidecarPort         string
 	BrowserStartTimeout time.Duration
+	// BrowserStartTimeouts overrides BrowserStartTimeout per browser name or
+	// name/version.
+	BrowserStartTimeouts map[string]time.Duration
+	// MaxBrowserStartTimeout caps the timeouts above and the one a client
+	// may request.
+	MaxBrowserStartTimeout time.Duration
+	Queue                  admission.Config
+	Quotas                 []quota.Rule
+	Pool                   PoolConfig
+	Retry                  RetryConfig
+	// IdempotencyTTL is how long a started session is remembered for its
+	// Idempotency-Key.
+	IdempotencyTTL time.Duration
+	// IdempotencyAbandonTimeout is how long the Browser of an idempotent
+	// startup is kept when no request has picked it up, within
+	// IdempotencyTTL.
+	IdempotencyAbandonTimeout time.Duration
+	// EventsMode selects how startups wait for their Browser: EventsModeShared
+	// or EventsModePerRequest. Empty means EventsModePerRequest.
+	EventsMode string
+	// TeardownGrace is how long after its client is done a session's
+	// Browser is deleted. A negative value leaves it to the sidecar.
+	TeardownGrace time.Duration
+	// DrainRetryAfter is the Retry-After sent with sessions refused while
+	// draining.
+	DrainRetryAfter time.Duration
+	// WebSocketDrainTimeout is how long shutdown waits for proxied WebSocket
+	// connections to end before closing them.
+	WebSocketDrainTimeout time.Duration
+	// MaxSessionLifetime limits how long a session may live; zero means no
+	// limit. SessionLifetimes overrides it per browser name, name/version or
+	// "owner:NAME".
+	MaxSessionLifetime    time.Duration
+	SessionLifetimes      map[string]time.Duration
+	LifetimeCheckInterval time.Duration
+	// SessionRegistry makes the hub proxy session requests only to pod IPs
+	// of Running Browsers.
+	SessionRegistry bool
+	// SessionIDSecret makes the hub hand out signed session ids. With
+	// LegacySessionIDs the unsigned ids of the sidecar are still accepted.
+	SessionIDSecret  []byte
+	LegacySessionIDs bool
+	// EnforceOwnership restricts proxied requests to the owner of a session
+	// and admins. OwnerCacheTTL is how long the owner found for a pod IP is
+	// trusted when no session registry is kept.
+	EnforceOwnership bool
+	OwnerCacheTTL    time.Duration
+	// SidecarProbe waits for the sidecar of a Running Browser to accept
+	// requests, within the startup timeout.
+	SidecarProbe SidecarProbe
+	// SessionEvents serves the session lifecycle events of the namespace as
+	// server-sent events.
+	SessionEvents bool
+	// DrainAPI serves drain mode at /selenosis/v1/drain. Signals switch it
+	// either way.
+	DrainAPI bool
+	// DebugVars serves the expvar variables at /debug/vars to admins.
+	DebugVars bool
+	// SessionsAPI serves the sessions of the namespace, and asynchronous
+	// session creation, at /selenosis/v1/sessions.
+	SessionsAPI bool
+	// Usage accounts the time every session runs, for the usage report. It
+	// is fed from the session events.
+	Usage *usage.Ledger
 }
 
 type errorKind int
@@ -60,53 +152,113 @@ const (
 	browserStreamClosed
 	browserFailed
 	browserStreamError
-	browserContextDone
+	browserStartTimeout
+	browserClientGone
+	browserQueueTimeout
+	browserInvalidRequest
+	browserQuotaExceeded
+	browserDraining
+	browserIdempotencyConflict
 )
 
 func NewService(client browserclient.Client, config ServiceConfig) *Service {
-	return &Service{
-		client: client,
-		config: config,
+	s := &Service{
+		client:      client,
+		config:      config,
+		idempotency: newIdempotencyRegistry(config.IdempotencyTTL, config.IdempotencyAbandonTimeout),
+		startups:    newStartupJobs(),
+		wsConns:     proxy.NewTracker(),
+		conns:       newBrowserConns(),
+		deadlines:   newSessionDeadlines(),
+		owners:      newOwnerCache(config.OwnerCacheTTL),
 	}
+
+	if config.Queue.MaxSessions > 0 {
+		s.queue = admission.New(config.Queue, s.countRunningBrowsers)
+	}
+
+	if len(config.Quotas) > 0 {
+		s.quotas = quota.NewEnforcer(config.Quotas, s.listQuotaSessions)
+	}
+
+	if len(config.Pool.Browsers) > 0 {
+		s.pool = newBrowserPool(s, config.Pool)
+	}
+
+	if len(config.SessionIDSecret) > 0 {
+		s.sessionIDs = sessionid.New(config.SessionIDSecret)
+	}
+
+	if config.SessionRegistry {
+		s.registry = newSessionRegistry(client, config.Namespace)
+	}
+
+	if config.SessionEvents || config.Usage != nil {
+		s.feed = newSessionFeed(s)
+	}
+
+	// startups in the shared mode, the registry and the feed all follow
+	// one event stream
+	if config.EventsMode == EventsModeShared || s.registry != nil || s.feed != nil {
+		s.watcher = newBrowserWatcher(client, config.Namespace)
+		if s.registry != nil {
+			s.watcher.listen(s.registry)
+		}
+		if s.feed != nil {
+			s.watcher.listen(s.feed)
+		}
+	}
+
+	return s
 }
 
-func (s *Service) sidecarHost(ip string) string {
-	return net.JoinHostPort(ip, s.config.SidecarPort)
+// ShutdownWebSockets refuses new WebSocket sessions and waits for the proxied
+// ones to end until ctx is done, after which they are closed with 1001 (going
+// away).
+func (s *Service) ShutdownWebSockets(ctx context.Context) error {
+	return s.wsConns.Shutdown(ctx)
 }
 
-func (s *Service) CreateSession(rw http.ResponseWriter, req *http.Request) {
-	log := logctx.FromContext(req.Context())
+// Run drives the background work of the service until ctx is done.
+func (s *Service) Run(ctx context.Context) {
+	var wg sync.WaitGroup
 
-	if req.Body == nil {
-		log.Err(ErrMissingCapabilities).Msg("empty request body")
-		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(ErrMissingCapabilities))
-		return
+	if s.feed != nil {
+		s.feed.log = logctx.FromContext(ctx)
 	}
-	defer req.Body.Close()
 
-	body, err := io.ReadAll(io.LimitReader(req.Body, maxRequestBodySize))
-	if err != nil {
-		log.Err(err).Msg("failed to read request body")
-		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(ErrReadRequestBody))
-		return
+	if s.watcher != nil {
+		wg.Go(func() { s.watcher.run(ctx) })
 	}
 
-	var caps selenium.Capabilities
-	if err := json.Unmarshal(body, &caps); err != nil {
-		log.Err(err).Msg("failed to decode request body")
-		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(ErrDecodeRequestBody))
-		return
+	wg.Go(func() { s.enforceLifetimes(ctx) })
+
+	if s.queue != nil {
+		wg.Go(func() { s.queue.Run(ctx) })
 	}
 
-	processed, err := caps.ProcessCapabilities()
-	if err != nil {
-		log.Err(err).Msg("failed to process request capabilities")
-		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(ErrCapabilityMatch))
+	if s.pool != nil {
+		wg.Go(func() { s.pool.run(ctx) })
+	}
+
+	wg.Wait()
+}
+
+func (s *Service) sidecarHost(ip string) string {
+	return net.JoinHostPort(ip, s.config.SidecarPort)
+}
+
+func (s *Service) CreateSession(rw http.ResponseWriter, req *http.Request) {
+	log := logctx.FromContext(req.Context())
+	req = withStartupTimings(req)
+
+	nsr, ok := readNewSessionRequest(rw, req)
+	if !ok {
 		return
 	}
+	req = withIdempotencyPayload(req, nsr.body)
 
-	opts := processed.GetSelenosisOptions()
-	podIP, _, ok := s.createBrowser(rw, req, processed.GetBrowserName(), processed.GetBrowserVersion(), opts, writeCreateSessionWaitError)
+	browserName, podIP, _, ok := s.createBrowser(rw, req, nsr.caps.GetBrowserName(), nsr.caps.GetBrowserVersion(), nsr.opts, nsr.sessionOpts, writeCreateSessionWaitError)
 	if !ok {
 		return
 	}
@@ -122,19 +274,71 @@ func (s *Service) CreateSession(rw http.ResponseWriter, req *http.Request) {
 		}
 		r.Method = req.Method
 		r.Host = r.URL.Host
-		r.Body = io.NopCloser(bytes.NewReader(body))
-		r.ContentLength = int64(len(body))
+		r.Body = io.NopCloser(bytes.NewReader(nsr.body))
+		r.ContentLength = int64(len(nsr.body))
 
 		log.Info().
 			Str("ip", podIP).
 			Msg("session create request modified")
 	}
 
-	rp := proxy.NewHTTPReverseProxy(
+	s.proxyCreateRequest(rw, req, log, browserName, podIP, s.foreignWebDriverSession(req.Context(), log, nsr.caps),
 		proxy.WithRequestModifier(reqModifier),
 		proxy.WithErrorHandler(createSessionProxyErrorHandler(log, podIP)),
 	)
-	rp.ServeHTTP(rw, req)
+}
+
+// newSessionRequest is a decoded WebDriver new session request.
+type newSessionRequest struct {
+	body        []byte
+	caps        selenium.Capabilities
+	opts        map[string]any
+	sessionOpts sessionOptions
+}
+
+// readNewSessionRequest decodes a WebDriver new session request, writing a
+// Selenium error response if it is not valid.
+func readNewSessionRequest(rw http.ResponseWriter, req *http.Request) (newSessionRequest, bool) {
+	log := logctx.FromContext(req.Context())
+
+	var nsr newSessionRequest
+	if req.Body == nil {
+		log.Err(ErrMissingCapabilities).Msg("empty request body")
+		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(ErrMissingCapabilities))
+		return nsr, false
+	}
+	defer req.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxRequestBodySize))
+	if err != nil {
+		log.Err(err).Msg("failed to read request body")
+		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(ErrReadRequestBody))
+		return nsr, false
+	}
+
+	var caps selenium.Capabilities
+	if err := json.Unmarshal(body, &caps); err != nil {
+		log.Err(err).Msg("failed to decode request body")
+		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(ErrDecodeRequestBody))
+		return nsr, false
+	}
+
+	processed, err := caps.ProcessCapabilities()
+	if err != nil {
+		log.Err(err).Msg("failed to process request capabilities")
+		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(ErrCapabilityMatch))
+		return nsr, false
+	}
+
+	opts := processed.GetSelenosisOptions()
+	sessionOpts, err := extractSessionOptions(opts)
+	if err != nil {
+		log.Err(err).Msg("failed to process selenosis options")
+		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(err))
+		return nsr, false
+	}
+
+	return newSessionRequest{body: body, caps: processed, opts: opts, sessionOpts: sessionOpts}, true
 }
 
 func (s *Service) ProxySession(rw http.ResponseWriter, req *http.Request) {
@@ -146,13 +350,25 @@ func (s *Service) ProxySession(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	ip, err := parseSessionID(sessionId)
+	ip, browser, err := s.parseSessionID(sessionId)
 	if err != nil {
 		log.Error().Msg("invalid url param: sessionId")
 		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(errors.ErrUnsupported))
 		return
 	}
 
+	if s.deadlines.expired(ip) {
+		log.Warn().Str("sessionId", sessionId).Msg("session lifetime exceeded")
+		writeErrorResponse(rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrSessionLifetimeExceeded))
+		return
+	}
+
+	if err := s.resolveSession(req.Context(), ip, browser); err != nil {
+		log.Warn().Err(err).Str("sessionId", sessionId).Str("ip", ip.String()).Msg("session refused")
+		writeErrorResponse(rw, http.StatusNotFound, selenium.ErrInvalidSessionId(err))
+		return
+	}
+
 	log.Info().Str("sessionId", sessionId).Str("ip", ip.String()).Msg("proxying session request")
 
 	host := s.sidecarHost(ip.String())
@@ -161,7 +377,7 @@ func (s *Service) ProxySession(rw http.ResponseWriter, req *http.Request) {
 			url := &url.URL{
 				Scheme: "ws",
 				Host:   host,
-				Path:   strings.TrimPrefix(r.URL.Path, wdHubPrefix),
+				Path:   sidecarPath(strings.TrimPrefix(r.URL.Path, wdHubPrefix), sessionId, ip),
 			}
 
 			log.Info().Str("ws_url", url.String()).Msg("resolved websocket target url")
@@ -173,7 +389,7 @@ func (s *Service) ProxySession(rw http.ResponseWriter, req *http.Request) {
 			Str("ip", ip.String()).
 			Msg("proxying websocket request")
 
-		rp := proxy.NewWebSocketReverseProxy(resolver)
+		rp := proxy.NewWebSocketReverseProxy(resolver, proxy.WithTracker(s.wsConns))
 		rp.ServeHTTP(rw, req)
 		return
 	}
@@ -183,15 +399,21 @@ func (s *Service) ProxySession(rw http.ResponseWriter, req *http.Request) {
 		r.URL = &url.URL{
 			Scheme: "http",
 			Host:   host,
-			Path:   strings.TrimPrefix(req.URL.Path, wdHubPrefix),
+			Path:   sidecarPath(strings.TrimPrefix(req.URL.Path, wdHubPrefix), sessionId, ip),
 		}
 		r.Host = req.Host
 
 		log.Info().Str("sessionId", sessionId).Str("ip", ip.String()).Msg("session proxy request modified")
 	}
 
+	respModifiers := []func(*http.Response) error{signedResponse(sessionId, ip)}
+	if req.Method == http.MethodDelete && path.Clean(strings.TrimPrefix(req.URL.Path, wdHubPrefix)) == "/session/"+sessionId {
+		respModifiers = append(respModifiers, s.teardownOnSuccess(log, s.teardownTarget(req.Context(), log, ip, browser)))
+	}
+
 	rp := proxy.NewHTTPReverseProxy(
 		proxy.WithRequestModifier(reqModifier),
+		proxy.WithResponseModifier(chainResponseModifiers(respModifiers...)),
 		proxy.WithErrorHandler(sessionProxyErrorHandler(log, sessionId)),
 	)
 	rp.ServeHTTP(rw, req)
@@ -201,7 +423,11 @@ func (s *Service) SessionStatus(rw http.ResponseWriter, req *http.Request) {
 	log := logctx.FromContext(req.Context())
 
 	var status selenium.Status
-	status.Set("service started", true)
+	if s.Draining() {
+		status.Set("service draining", false)
+	} else {
+		status.Set("service started", true)
+	}
 
 	log.Info().Msg("service status")
 
@@ -234,7 +460,15 @@ func (s *Service) Playwright(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	podIP, sessionUUID, ok := s.createBrowser(rw, req, name, version, opts, writePlaywrightWaitError)
+	sessionOpts, err := sessionOptionsFromQuery(req.URL.Query())
+	if err != nil {
+		log.Err(err).Msg("failed to parse session options from query parameters")
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req = withStartupTimings(req)
+	browserName, podIP, sessionUUID, ok := s.createBrowser(rw, req, name, version, opts, sessionOpts, writePlaywrightWaitError)
 	if !ok {
 		return
 	}
@@ -255,8 +489,54 @@ func (s *Service) Playwright(rw http.ResponseWriter, req *http.Request) {
 
 	log.Info().Str("ip", podIP).Msg("proxying playwright request")
 
-	rp := proxy.NewWebSocketReverseProxy(resolver)
+	timings := startupTimingsFrom(req.Context())
+	upgradeModifier := func(upstream *http.Response, header http.Header) {
+		timings.sidecarResponded(log, header)
+	}
+
+	// the connection holds the Browser from before the dial, so that a
+	// client sharing it cannot tear it down meanwhile
+	s.conns.acquire(browserName)
+	release := func() {
+		if s.conns.release(browserName) {
+			s.teardownBrowser(log, browserName)
+		}
+	}
+
+	connected := false
+	onConnect := func() {
+		connected = true
+	}
+	onClose := func() {
+		log.Info().Str("name", browserName).Msg("playwright client disconnected")
+		release()
+	}
+
+	wsOpts := []proxy.WSProxyOption{
+		proxy.WithUpgradeModifier(upgradeModifier),
+		proxy.WithOnConnect(onConnect),
+		proxy.WithOnClose(onClose),
+		proxy.WithTracker(s.wsConns),
+	}
+	if s.config.SidecarProbe.Enabled {
+		// the status endpoint may answer before the playwright server
+		// listens, which takes a moment at most, within what is left of the
+		// startup timeout
+		left := s.startupTimeout(name, version, sessionOpts) - time.Since(timings.start)
+		if retry := min(left, playwrightDialRetry); retry > 0 {
+			wsOpts = append(wsOpts, proxy.WithRetryTimeout(retry))
+		}
+	}
+
+	rp := proxy.NewWebSocketReverseProxy(resolver, wsOpts...)
 	rp.ServeHTTP(rw, req)
+
+	// the dial or the upgrade failed, or the hub is shutting down, so
+	// onClose never ran
+	if !connected {
+		log.Warn().Str("name", browserName).Msg("playwright client never connected")
+		release()
+	}
 }
 
 func (s *Service) RouteHTTP(rw http.ResponseWriter, req *http.Request) {
@@ -276,17 +556,29 @@ func (s *Service) RouteHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	ip, err := parseSessionID(sessionId)
+	ip, browser, err := s.parseSessionID(sessionId)
 	if err != nil {
 		log.Error().Msg("invalid url param: sessionId")
 		http.Error(rw, "invalid url param: sessionId", http.StatusBadRequest)
 		return
 	}
 
+	if s.deadlines.expired(ip) {
+		log.Warn().Str("sessionId", sessionId).Msg("session lifetime exceeded")
+		http.Error(rw, ErrSessionLifetimeExceeded.Error(), http.StatusNotFound)
+		return
+	}
+
+	if err := s.resolveSession(req.Context(), ip, browser); err != nil {
+		log.Warn().Err(err).Str("sessionId", sessionId).Str("ip", ip.String()).Msg("session refused")
+		http.Error(rw, "invalid session id: "+err.Error(), http.StatusNotFound)
+		return
+	}
+
 	reqModifier := func(r *http.Request) {
 		r.URL.Scheme = "http"
 		r.URL.Host = s.sidecarHost(ip.String())
-		r.URL.Path = path.Clean(req.URL.Path)
+		r.URL.Path = sidecarPath(path.Clean(req.URL.Path), sessionId, ip)
 
 		log.Info().Str("sessionId", sessionId).Str("ip", ip.String()).Msg("http proxy request modified")
 	}
@@ -295,6 +587,7 @@ func (s *Service) RouteHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	rp := proxy.NewHTTPReverseProxy(
 		proxy.WithRequestModifier(reqModifier),
+		proxy.WithResponseModifier(signedResponse(sessionId, ip)),
 		proxy.WithErrorHandler(routeHTTPProxyErrorHandler(log, sessionId)),
 	)
 	rp.ServeHTTP(rw, req)
@@ -321,7 +614,15 @@ func (s *Service) McpHandler(rw http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		podIP, _, ok := s.createBrowser(rw, req, name, version, selenosisOpts, writeMcpWaitError)
+		sessionOpts, err := sessionOptionsFromQuery(req.URL.Query())
+		if err != nil {
+			log.Err(err).Msg("failed to parse session options from query parameters")
+			jsonrpc.WriteError(rw, http.StatusBadRequest, jsonrpc.InvalidParams, "Bad Request: "+err.Error())
+			return
+		}
+
+		req = withStartupTimings(req)
+		browserName, podIP, _, ok := s.createBrowser(rw, req, name, version, selenosisOpts, sessionOpts, writeMcpWaitError)
 		if !ok {
 			return
 		}
@@ -340,11 +641,10 @@ func (s *Service) McpHandler(rw http.ResponseWriter, req *http.Request) {
 			r.Host = host
 		}
 
-		rp := proxy.NewHTTPReverseProxy(
+		s.proxyCreateRequest(rw, req, log, browserName, podIP, foreignMcpSession,
 			proxy.WithRequestModifier(reqModifier),
 			proxy.WithErrorHandler(mcpInitProxyErrorHandler(log, podIP)),
 		)
-		rp.ServeHTTP(rw, req)
 		return
 	}
 
@@ -354,13 +654,25 @@ func (s *Service) McpHandler(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	ip, err := parseSessionID(sessionId)
+	ip, browser, err := s.parseSessionID(sessionId)
 	if err != nil {
 		log.Error().Str("mcpSessionId", sessionId).Msg("invalid Mcp-Session-Id")
 		jsonrpc.WriteError(rw, http.StatusBadRequest, jsonrpc.InvalidParams, "Bad Request: invalid Mcp-Session-Id")
 		return
 	}
 
+	if s.deadlines.expired(ip) {
+		log.Warn().Str("mcpSessionId", sessionId).Msg("session lifetime exceeded")
+		jsonrpc.WriteError(rw, http.StatusNotFound, jsonrpc.SessionNotFound, "Session not found: "+ErrSessionLifetimeExceeded.Error())
+		return
+	}
+
+	if err := s.resolveSession(req.Context(), ip, browser); err != nil {
+		log.Warn().Err(err).Str("mcpSessionId", sessionId).Str("ip", ip.String()).Msg("session refused")
+		jsonrpc.WriteError(rw, http.StatusNotFound, jsonrpc.SessionNotFound, "Session not found: "+err.Error())
+		return
+	}
+
 	host := s.sidecarHost(ip.String())
 
 	log.Info().Str("ip", ip.String()).Msg("proxying mcp request")
@@ -373,18 +685,81 @@ func (s *Service) McpHandler(rw http.ResponseWriter, req *http.Request) {
 			RawQuery: req.URL.RawQuery,
 		}
 		r.Host = host
+		if plain, err := sidecarSessionID(ip); err == nil {
+			r.Header.Set("Mcp-Session-Id", plain)
+		}
+	}
+
+	respModifiers := []func(*http.Response) error{signedResponse(sessionId, ip)}
+	if req.Method == http.MethodDelete {
+		respModifiers = append(respModifiers, s.teardownOnSuccess(log, s.teardownTarget(req.Context(), log, ip, browser)))
 	}
 
 	rp := proxy.NewHTTPReverseProxy(
 		proxy.WithRequestModifier(reqModifier),
+		proxy.WithResponseModifier(chainResponseModifiers(respModifiers...)),
 		proxy.WithErrorHandler(mcpProxyErrorHandler(log, ip.String())),
 	)
 	rp.ServeHTTP(rw, req)
 }
 
-func (s *Service) createBrowser(rw http.ResponseWriter, req *http.Request, name, version string, opts map[string]any, writeWaitError func(http.ResponseWriter, *browserError)) (string, uuid.UUID, bool) {
+func (s *Service) createBrowser(rw http.ResponseWriter, req *http.Request, name, version string, opts map[string]any, sessionOpts sessionOptions, writeWaitError func(http.ResponseWriter, *browserError)) (string, string, uuid.UUID, bool) {
 	log := logctx.FromContext(req.Context())
 
+	if s.Draining() {
+		log.Warn().Msg("session refused, hub draining")
+		writeWaitError(rw, s.drainingError())
+		return "", "", uuid.UUID{}, false
+	}
+
+	template, err := newBrowserTemplate(req.Context(), name, version, opts)
+	if err != nil {
+		log.Err(err).Msg("failed to set selenosis options annotation")
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return "", "", uuid.UUID{}, false
+	}
+
+	log = browserLogger(log, template, s.config.Namespace)
+	lifetime := s.setSessionLifetime(template, sessionOpts)
+
+	var (
+		browserName, podIP string
+		waitErr            *browserError
+	)
+	if key := idempotencyKey(req); key != "" {
+		browserName, podIP, waitErr = s.startIdempotentSession(req.Context(), log, key, idempotencyFingerprint(req, name, version), template, opts, sessionOpts)
+	} else {
+		browserName, podIP, waitErr = s.startSession(req.Context(), log, template, opts, sessionOpts)
+	}
+	if waitErr != nil {
+		writeWaitError(rw, waitErr)
+		return "", "", uuid.UUID{}, false
+	}
+
+	ip := net.ParseIP(podIP)
+	if ip == nil {
+		log.Err(fmt.Errorf("invalid pod IP: %s", podIP)).Msg("failed to parse pod IP")
+		s.deleteBrowser(req.Context(), log, browserName)
+		http.Error(rw, "failed to get browser IP", http.StatusInternalServerError)
+		return "", "", uuid.UUID{}, false
+	}
+
+	sessionUUID, err := ipuuid.IPToUUID(ip)
+	if err != nil {
+		log.Err(err).Str("podIP", podIP).Msg("failed to convert IP to UUID")
+		s.deleteBrowser(req.Context(), log, browserName)
+		http.Error(rw, "failed to convert IP to UUID", http.StatusInternalServerError)
+		return "", "", uuid.UUID{}, false
+	}
+
+	s.deadlines.set(podIP, browserName, deadlineAfter(lifetime))
+
+	return browserName, podIP, sessionUUID, true
+}
+
+// newBrowserTemplate builds the Browser for a session requested by the owner
+// in ctx.
+func newBrowserTemplate(ctx context.Context, name, version string, opts map[string]any) (*browserv1.Browser, error) {
 	template := &browserv1.Browser{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: uuid.NewString(),
@@ -395,54 +770,70 @@ func (s *Service) createBrowser(rw http.ResponseWriter, req *http.Request, name,
 		},
 	}
 
-	var err error
 	if len(opts) > 0 {
+		var err error
 		template.ObjectMeta.Annotations, err = setSelenosisOptions(template.ObjectMeta.Annotations, opts)
 		if err != nil {
-			log.Err(err).Msg("failed to set selenosis options annotation")
-			http.Error(rw, err.Error(), http.StatusBadRequest)
-			return "", uuid.UUID{}, false
+			return nil, err
 		}
 	}
 
-	setOwnerReference(req.Context(), template)
+	setOwnerReference(ctx, template)
+	return template, nil
+}
 
-	log = log.With().
+func browserLogger(log zerolog.Logger, template *browserv1.Browser, namespace string) zerolog.Logger {
+	return log.With().
 		Str("browserName", template.Spec.BrowserName).
 		Str("browserVersion", template.Spec.BrowserVersion).
-		Str("namespace", s.config.Namespace).
+		Str("namespace", namespace).
 		Logger()
+}
 
-	ctx, cancel := context.WithTimeout(req.Context(), s.config.BrowserStartTimeout)
-	defer cancel()
-
-	_, podIP, waitErr := s.createBrowserAndWait(ctx, log, template)
-	if waitErr != nil {
-		writeWaitError(rw, waitErr)
-		return "", uuid.UUID{}, false
+// startSession reserves quota and an admission slot for template and brings
+// up its browser within the session's startup timeout.
+func (s *Service) startSession(ctx context.Context, log zerolog.Logger, template *browserv1.Browser, opts map[string]any, sessionOpts sessionOptions) (string, string, *browserError) {
+	releaseQuota, quotaErr := s.reserveQuota(ctx, log, template)
+	if quotaErr != nil {
+		return "", "", quotaErr
 	}
+	defer releaseQuota()
 
-	ip := net.ParseIP(podIP)
-	if ip == nil {
-		log.Err(fmt.Errorf("invalid pod IP: %s", podIP)).Msg("failed to parse pod IP")
-		http.Error(rw, "failed to get browser IP", http.StatusInternalServerError)
-		return "", uuid.UUID{}, false
+	ticket, queueErr := s.admit(ctx, log, sessionOpts)
+	if queueErr != nil {
+		return "", "", queueErr
 	}
+	defer ticket.Release()
 
-	sessionUUID, err := ipuuid.IPToUUID(ip)
-	if err != nil {
-		log.Err(err).Str("podIP", podIP).Msg("failed to convert IP to UUID")
-		http.Error(rw, "failed to convert IP to UUID", http.StatusInternalServerError)
-		return "", uuid.UUID{}, false
+	timeout := s.startupTimeout(template.Spec.BrowserName, template.Spec.BrowserVersion, sessionOpts)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return s.claimOrCreateBrowser(ctx, log, template, opts)
+}
+
+// claimOrCreateBrowser takes a pre-warmed Browser from the pool when the
+// request carries no pod options, and starts a new one otherwise.
+func (s *Service) claimOrCreateBrowser(ctx context.Context, logger zerolog.Logger, template *browserv1.Browser, opts map[string]any) (string, string, *browserError) {
+	if s.pool != nil && len(opts) == 0 {
+		owner := template.GetLabels()[browserv1.SelenosisOwnerLabelKey]
+		if m, ok := s.pool.claim(ctx, logger, template.Spec.BrowserName, template.Spec.BrowserVersion, owner); ok {
+			startupTraceFrom(ctx).running(m.name)
+			if s.feed != nil {
+				s.feed.claimed(m.name)
+			}
+			return m.name, m.podIP, nil
+		}
+		logger.Info().Msg("no pooled browser available, starting a new one")
 	}
 
-	return podIP, sessionUUID, true
+	return s.startBrowser(ctx, logger, template)
 }
 
 func (s *Service) createBrowserAndWait(ctx context.Context, logger zerolog.Logger, template *browserv1.Browser) (string, string, *browserError) {
 	logger.Info().Msg("creating browser resource")
 
-	stream, err := s.client.Events(ctx, s.config.Namespace, browserclient.WithName(template.GetName()))
+	stream, err := s.browserEvents(ctx, template.GetName())
 	if err != nil {
 		logger.Err(err).Str("name", template.GetName()).Msg("failed to start browser event stream")
 		return template.GetName(), "", &browserError{kind: browserEventsStart, err: err}
@@ -451,19 +842,43 @@ func (s *Service) createBrowserAndWait(ctx context.Context, logger zerolog.Logge
 
 	result, err := s.client.Create(ctx, s.config.Namespace, template)
 	if err != nil {
+		if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			// the request may have reached browser-service before the
+			// context ended, so make sure nothing is left behind
+			waitErr := contextDoneError(ctx, logger, template.GetName())
+			s.deleteBrowser(ctx, logger, template.GetName())
+			return "", "", waitErr
+		}
 		logger.Err(err).Msg("failed to create browser resource")
 		return "", "", &browserError{kind: browserCreate, err: err}
 	}
 
 	browserName := result.GetName()
 	logger.Info().Str("name", browserName).Msg("waiting for browser to become ready")
+	startupTraceFrom(ctx).created(browserName)
+
+	podIP, waitErr := s.awaitBrowser(ctx, logger, stream, browserName)
+	if waitErr == nil {
+		waitErr = s.waitForSidecar(ctx, logger, browserName, podIP)
+	}
+	if waitErr != nil {
+		s.deleteBrowser(ctx, logger, browserName)
+		return browserName, "", waitErr
+	}
+
+	return browserName, podIP, nil
+}
+
+func waitForBrowser(ctx context.Context, logger zerolog.Logger, stream browserclient.EventStream, browserName string) (string, *browserError) {
+	trace := startupTraceFrom(ctx)
+	pending := false
 
 	for {
 		select {
 		case event, ok := <-stream.Events():
 			if !ok {
 				logger.Error().Str("name", browserName).Msg("browser event stream closed unexpectedly")
-				return browserName, "", &browserError{kind: browserStreamClosed}
+				return "", &browserError{kind: browserStreamClosed}
 			}
 
 			if event.Browser == nil {
@@ -473,39 +888,179 @@ func (s *Service) createBrowserAndWait(ctx context.Context, logger zerolog.Logge
 
 			switch event.Browser.Status.Phase {
 			case "Failed":
-				logger.Error().Str("name", browserName).Str("statusReason", event.Browser.Status.Reason).Msg("browser failed to start")
-				return browserName, "", &browserError{kind: browserFailed}
+				logger.Error().
+					Str("name", browserName).
+					Str("statusReason", event.Browser.Status.Reason).
+					Str("statusMessage", event.Browser.Status.Message).
+					Msg("browser failed to start")
+				return "", &browserError{
+					kind:    browserFailed,
+					name:    browserName,
+					reason:  event.Browser.Status.Reason,
+					message: event.Browser.Status.Message,
+				}
+
+			case "Pending":
+				if !pending {
+					pending = true
+					trace.pending(browserName)
+				}
 
 			case "Running":
 				podIP := event.Browser.Status.PodIP
 				logger.Info().Str("name", browserName).Msg("browser successfully started")
-				return browserName, podIP, nil
+				trace.running(browserName)
+				return podIP, nil
 			}
 
 		case err, ok := <-stream.Errors():
 			if !ok {
 				logger.Error().Str("name", browserName).Msg("browser error stream closed unexpectedly")
-				return browserName, "", &browserError{kind: browserStreamClosed}
+				return "", &browserError{kind: browserStreamClosed}
 			}
 
 			if err != nil {
 				logger.Err(err).Str("name", browserName).Msg("browser event stream error")
-				return browserName, "", &browserError{kind: browserStreamError, err: err}
+				return "", &browserError{kind: browserStreamError, err: err}
 			}
 
 		case <-ctx.Done():
-			logger.Info().Str("name", browserName).Msg("context cancelled, stopping browser event stream")
-			return browserName, "", &browserError{kind: browserContextDone}
+			return "", contextDoneError(ctx, logger, browserName)
 		}
 	}
 }
 
-func parseSessionID(sessionId string) (net.IP, error) {
-	uid, err := uuid.Parse(sessionId)
+// admit waits for a free slot in the admission queue, if one is configured.
+// The returned ticket is held until the browser startup is over, after which
+// the session is accounted for by countRunningBrowsers.
+func (s *Service) admit(ctx context.Context, logger zerolog.Logger, sessionOpts sessionOptions) (*admission.Ticket, *browserError) {
+	if s.queue == nil {
+		return nil, nil
+	}
+
+	var owner string
+	if o, ok := auth.OwnerFrom(ctx); ok {
+		owner = o.Name
+	}
+
+	startupTraceFrom(ctx).queued()
+
+	start := time.Now()
+	ticket, err := s.queue.Acquire(ctx, admission.Request{Owner: owner, Class: sessionOpts.PriorityClass})
+	switch {
+	case err == nil:
+		logger.Info().Dur("queueWait", time.Since(start)).Msg("session admitted")
+		return ticket, nil
+	case errors.Is(err, admission.ErrUnknownClass):
+		logger.Err(err).Msg("session rejected by admission queue")
+		return nil, &browserError{kind: browserInvalidRequest, err: err}
+	case errors.Is(err, admission.ErrQueueTimeout), errors.Is(err, admission.ErrQueueFull):
+		logger.Warn().Err(err).Dur("queueWait", time.Since(start)).Int("queueLength", s.queue.Len()).Msg("session rejected by admission queue")
+		return nil, &browserError{kind: browserQueueTimeout, err: err, retryAfter: s.queue.RetryAfter()}
+	default:
+		logger.Warn().Err(err).Msg("client disconnected while queued")
+		return nil, &browserError{kind: browserClientGone, err: ErrClientDisconnected}
+	}
+}
+
+// reserveQuota enforces the configured session quotas before the Browser is
+// created. The reservation covers the startup; afterwards the Browser itself
+// is counted by listQuotaSessions.
+func (s *Service) reserveQuota(ctx context.Context, logger zerolog.Logger, template *browserv1.Browser) (func(), *browserError) {
+	if s.quotas == nil {
+		return func() {}, nil
+	}
+
+	release, err := s.quotas.Reserve(ctx, quotaSession(template))
+	if err == nil {
+		return release, nil
+	}
+
+	if errors.Is(err, quota.ErrQuotaExceeded) {
+		logger.Warn().Err(err).Str("owner", template.GetLabels()[browserv1.SelenosisOwnerLabelKey]).Msg("session quota exceeded")
+		return nil, &browserError{kind: browserQuotaExceeded, err: err}
+	}
+
+	logger.Err(err).Msg("failed to check session quota")
+	return nil, &browserError{kind: browserCreate, err: err}
+}
+
+func (s *Service) listQuotaSessions(ctx context.Context) ([]quota.Session, error) {
+	browsers, err := s.client.List(ctx, s.config.Namespace)
 	if err != nil {
 		return nil, err
 	}
-	return ipuuid.UUIDToIP(uid), nil
+
+	sessions := make([]quota.Session, 0, len(browsers))
+	for _, b := range browsers {
+		if b == nil || b.Status.Phase == "Failed" || b.Status.Phase == "Succeeded" || !s.isSession(b) {
+			continue
+		}
+		session := quotaSession(b)
+		session.Owner = s.browserOwner(b)
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// isSession reports whether b is a user session rather than an unclaimed
+// pool member.
+func (s *Service) isSession(b *browserv1.Browser) bool {
+	return s.pool == nil || s.pool.counts(b)
+}
+
+func (s *Service) browserOwner(b *browserv1.Browser) string {
+	return b.GetLabels()[browserv1.SelenosisOwnerLabelKey]
+}
+
+func quotaSession(b *browserv1.Browser) quota.Session {
+	return quota.Session{
+		Name:           b.GetName(),
+		Owner:          b.GetLabels()[browserv1.SelenosisOwnerLabelKey],
+		BrowserName:    b.Spec.BrowserName,
+		BrowserVersion: b.Spec.BrowserVersion,
+	}
+}
+
+func (s *Service) countRunningBrowsers(ctx context.Context) (int, error) {
+	browsers, err := s.client.List(ctx, s.config.Namespace)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, b := range browsers {
+		if b != nil && b.Status.Phase == "Running" && s.isSession(b) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// contextDoneError tells a client that went away apart from an expired
+// startup deadline.
+func contextDoneError(ctx context.Context, logger zerolog.Logger, browserName string) *browserError {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logger.Warn().Str("name", browserName).Msg("browser startup timeout expired")
+		return &browserError{kind: browserStartTimeout, err: ErrStartupTimeout, name: browserName}
+	}
+
+	logger.Warn().Str("name", browserName).Msg("client disconnected during browser startup")
+	return &browserError{kind: browserClientGone, err: ErrClientDisconnected, name: browserName}
+}
+
+// deleteBrowser removes a Browser the hub gave up on. It runs on a detached
+// context so that it still completes after the request has been cancelled.
+func (s *Service) deleteBrowser(ctx context.Context, logger zerolog.Logger, name string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), browserDeleteTimeout)
+	defer cancel()
+
+	if err := s.client.Delete(ctx, s.config.Namespace, name); err != nil {
+		logger.Err(err).Str("name", name).Msg("failed to delete browser resource")
+		return
+	}
+
+	logger.Info().Str("name", name).Msg("browser resource deleted")
 }
 
 func setOwnerReference(ctx context.Context, template *browserv1.Browser) {
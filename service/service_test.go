@@ -19,10 +19,12 @@ import (
 	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
 	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
 	"github.com/alcounit/browser-service/pkg/event"
+	"github.com/alcounit/selenosis/v2/pkg/admission"
 	"github.com/alcounit/selenosis/v2/pkg/auth"
 	"github.com/alcounit/selenosis/v2/pkg/ipuuid"
 	"github.com/alcounit/selenosis/v2/pkg/jsonrpc"
 	"github.com/alcounit/selenosis/v2/pkg/proxy"
+	"github.com/alcounit/selenosis/v2/pkg/quota"
 	"github.com/alcounit/selenosis/v2/pkg/selenium"
 	"github.com/go-chi/chi/v5"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -105,13 +107,13 @@ func TestCreateSessionStreamClosed(t *testing.T) {
 			ObjectMeta: browserv1.Browser{}.ObjectMeta,
 		},
 	}
-	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: 50 * time.Millisecond})
 	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
 	rw := httptest.NewRecorder()
 
 	svc.CreateSession(rw, req)
 
-	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrUnknown(ErrInternal))
+	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrTimeout(errors.New("browser startup timed out")))
 }
 
 func TestCreateSessionFailedEvent(t *testing.T) {
@@ -137,13 +139,12 @@ func TestCreateSessionFailedEvent(t *testing.T) {
 
 	svc.CreateSession(rw, req)
 
-	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.Error("browser failed to start", ErrInternal))
+	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.Error("browser failed to start", errors.New("nope")))
 }
 
 func TestCreateSessionEventError(t *testing.T) {
 	stream := newFakeStream()
-	err := errors.New("event error")
-	stream.errs <- err
+	stream.errs <- errors.New("event error")
 
 	fc := &fakeClient{
 		stream: stream,
@@ -151,16 +152,16 @@ func TestCreateSessionEventError(t *testing.T) {
 			ObjectMeta: browserv1.Browser{}.ObjectMeta,
 		},
 	}
-	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: 50 * time.Millisecond})
 	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
 	rw := httptest.NewRecorder()
 
 	svc.CreateSession(rw, req)
 
-	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrUnknown(err))
+	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrTimeout(errors.New("browser startup timed out")))
 }
 
-func TestCreateSessionContextDone(t *testing.T) {
+func TestCreateSessionClientGone(t *testing.T) {
 	stream := newFakeStream()
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
@@ -168,16 +169,48 @@ func TestCreateSessionContextDone(t *testing.T) {
 	fc := &fakeClient{
 		stream: stream,
 		createResult: &browserv1.Browser{
-			ObjectMeta: browserv1.Browser{}.ObjectMeta,
+			ObjectMeta: metav1.ObjectMeta{Name: "br"},
 		},
 	}
-	svc := NewService(fc, ServiceConfig{Namespace: "ns"})
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Minute})
 	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil).WithContext(ctx)
 	rw := httptest.NewRecorder()
 
 	svc.CreateSession(rw, req)
 
-	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrUnknown(ErrInternal))
+	verifyResponseError(t, rw, statusClientClosedRequest, selenium.ErrUnknown(ErrClientDisconnected))
+	if got := fc.deletedNames(); len(got) != 1 || got[0] != "br" {
+		t.Fatalf("expected browser br to be deleted, got %v", got)
+	}
+}
+
+func TestCreateSessionStartupTimeout(t *testing.T) {
+	fc := &fakeClient{
+		stream:       newFakeStream(),
+		createResult: &browserv1.Browser{ObjectMeta: metav1.ObjectMeta{Name: "br"}},
+	}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: 10 * time.Millisecond})
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrTimeout(errors.New("browser startup timed out (browser br)")))
+}
+
+func TestCreateSessionClientGoneDuringCreate(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	fc := &cancelOnCreateClient{cancel: cancel}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Minute})
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil).WithContext(ctx)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	verifyResponseError(t, rw, statusClientClosedRequest, selenium.ErrUnknown(ErrClientDisconnected))
+	if got := fc.deletedNames(); len(got) != 1 || got[0] != fc.name {
+		t.Fatalf("expected browser %q to be deleted, got %v", fc.name, got)
+	}
 }
 
 func TestCreateSessionInvalidPodIP(t *testing.T) {
@@ -349,6 +382,156 @@ func TestCreateSessionSelenosisOptionsAnnotation(t *testing.T) {
 	}
 }
 
+func TestCreateSessionDeletesBrowserOnStartupFailure(t *testing.T) {
+	failed := func() browserclient.EventStream {
+		stream := newFakeStream()
+		stream.events <- &event.BrowserEvent{
+			Browser: &browserv1.Browser{Status: browserv1.BrowserStatus{Phase: "Failed", Reason: "nope"}},
+		}
+		return stream
+	}
+	closed := func() browserclient.EventStream {
+		stream := newFakeStream()
+		stream.Close()
+		return stream
+	}
+	streamErr := func() browserclient.EventStream {
+		stream := newFakeStream()
+		stream.errs <- errors.New("event error")
+		return stream
+	}
+	timeout := func() browserclient.EventStream {
+		return newFakeStream()
+	}
+
+	tests := []struct {
+		name   string
+		stream func() browserclient.EventStream
+	}{
+		{"failed", failed},
+		{"stream closed", closed},
+		{"stream error", streamErr},
+		{"timeout", timeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := &fakeClient{
+				stream:       tt.stream(),
+				createResult: &browserv1.Browser{ObjectMeta: metav1.ObjectMeta{Name: "br"}},
+			}
+			svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: 50 * time.Millisecond})
+			req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+			rw := httptest.NewRecorder()
+
+			svc.CreateSession(rw, req)
+
+			if rw.Code != http.StatusInternalServerError {
+				t.Fatalf("expected status 500, got %d", rw.Code)
+			}
+			if got := fc.deletedNames(); len(got) != 1 || got[0] != "br" {
+				t.Fatalf("expected browser br to be deleted, got %v", got)
+			}
+		})
+	}
+}
+
+func TestCreateSessionDeletesBrowserOnInvalidPodIP(t *testing.T) {
+	fc := &fakeClient{
+		stream:       runningStream(""),
+		createResult: &browserv1.Browser{ObjectMeta: metav1.ObjectMeta{Name: "br"}},
+	}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	if got := fc.deletedNames(); len(got) != 1 || got[0] != "br" {
+		t.Fatalf("expected browser br to be deleted, got %v", got)
+	}
+}
+
+func TestCreateSessionDoesNotDeleteWhenNotCreated(t *testing.T) {
+	fc := &fakeClient{createErr: errors.New("create failed")}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	if got := fc.deletedNames(); len(got) != 0 {
+		t.Fatalf("expected no delete, got %v", got)
+	}
+}
+
+func TestCreateSessionDoesNotDeleteOnSuccess(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"orig"}}`), nil
+	}))
+
+	fc := &fakeClient{
+		stream:       runningStream("127.0.0.1"),
+		createResult: &browserv1.Browser{ObjectMeta: metav1.ObjectMeta{Name: "br"}},
+	}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second})
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+	if got := fc.deletedNames(); len(got) != 0 {
+		t.Fatalf("expected no delete, got %v", got)
+	}
+}
+
+func TestPlaywrightDeletesBrowserOnFailedEvent(t *testing.T) {
+	stream := newFakeStream()
+	stream.events <- &event.BrowserEvent{
+		Browser: &browserv1.Browser{Status: browserv1.BrowserStatus{Phase: "Failed"}},
+	}
+
+	fc := &fakeClient{
+		stream:       stream,
+		createResult: &browserv1.Browser{ObjectMeta: metav1.ObjectMeta{Name: "br"}},
+	}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+	req := newRequestWithParams(http.MethodGet, "/playwright/chromium/123", nil, map[string]string{"name": "chromium", "version": "123"})
+	rw := httptest.NewRecorder()
+
+	svc.Playwright(rw, req)
+
+	if got := fc.deletedNames(); len(got) != 1 || got[0] != "br" {
+		t.Fatalf("expected browser br to be deleted, got %v", got)
+	}
+}
+
+func TestMcpHandlerInitDeletesBrowserOnFailedEvent(t *testing.T) {
+	stream := newFakeStream()
+	stream.events <- &event.BrowserEvent{
+		Browser: &browserv1.Browser{Status: browserv1.BrowserStatus{Phase: "Failed"}},
+	}
+
+	fc := &fakeClient{
+		stream:       stream,
+		createResult: &browserv1.Browser{ObjectMeta: metav1.ObjectMeta{Name: "br"}},
+		deleteErr:    errors.New("delete failed"),
+	}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+	req := httptest.NewRequest(http.MethodPost, "/mcp?browser=chromium&version=123", nil)
+	rw := httptest.NewRecorder()
+
+	svc.McpHandler(rw, req)
+
+	assertMcpError(t, rw, http.StatusInternalServerError, -32603)
+	if got := fc.deletedNames(); len(got) != 1 || got[0] != "br" {
+		t.Fatalf("expected browser br to be deleted, got %v", got)
+	}
+}
+
 func TestProxySessionMissingId(t *testing.T) {
 	svc := NewService(&fakeClient{}, ServiceConfig{})
 	req := newRequestWithParams(http.MethodGet, "/wd/hub/session", nil, nil)
@@ -573,7 +756,7 @@ func TestPlaywrightStreamClosed(t *testing.T) {
 			ObjectMeta: metav1.ObjectMeta{Name: "br"},
 		},
 	}
-	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: 50 * time.Millisecond})
 	req := newRequestWithParams(
 		http.MethodGet,
 		"/playwright",
@@ -587,7 +770,7 @@ func TestPlaywrightStreamClosed(t *testing.T) {
 	if rw.Code != http.StatusInternalServerError {
 		t.Fatalf("expected status 500, got %d", rw.Code)
 	}
-	if !strings.Contains(rw.Body.String(), "browser event stream closed unexpectedly") {
+	if !strings.Contains(rw.Body.String(), "browser startup timed out (browser br)") {
 		t.Fatalf("unexpected body: %q", rw.Body.String())
 	}
 }
@@ -635,7 +818,7 @@ func TestPlaywrightEventError(t *testing.T) {
 			ObjectMeta: metav1.ObjectMeta{Name: "br"},
 		},
 	}
-	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: 50 * time.Millisecond})
 	req := newRequestWithParams(
 		http.MethodGet,
 		"/playwright",
@@ -649,12 +832,12 @@ func TestPlaywrightEventError(t *testing.T) {
 	if rw.Code != http.StatusInternalServerError {
 		t.Fatalf("expected status 500, got %d", rw.Code)
 	}
-	if !strings.Contains(rw.Body.String(), "browser event stream error") {
+	if !strings.Contains(rw.Body.String(), "browser startup timed out (browser br)") {
 		t.Fatalf("unexpected body: %q", rw.Body.String())
 	}
 }
 
-func TestPlaywrightContextDone(t *testing.T) {
+func TestPlaywrightClientGone(t *testing.T) {
 	stream := newFakeStream()
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
@@ -672,10 +855,10 @@ func TestPlaywrightContextDone(t *testing.T) {
 
 	svc.Playwright(rw, req)
 
-	if rw.Code != http.StatusInternalServerError {
-		t.Fatalf("expected status 500, got %d", rw.Code)
+	if rw.Code != statusClientClosedRequest {
+		t.Fatalf("expected status 499, got %d", rw.Code)
 	}
-	if !strings.Contains(rw.Body.String(), "context cancelled") {
+	if !strings.Contains(rw.Body.String(), "client disconnected") {
 		t.Fatalf("unexpected body: %q", rw.Body.String())
 	}
 }
@@ -899,7 +1082,7 @@ func TestMcpHandlerInitStreamClosed(t *testing.T) {
 		stream:       stream,
 		createResult: &browserv1.Browser{ObjectMeta: metav1.ObjectMeta{Name: "br"}},
 	}
-	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: 50 * time.Millisecond})
 	req := httptest.NewRequest(http.MethodPost, "/mcp?browser=chromium&version=123", nil)
 	rw := httptest.NewRecorder()
 
@@ -936,7 +1119,7 @@ func TestMcpHandlerInitFailedEvent(t *testing.T) {
 	}
 }
 
-func TestMcpHandlerInitContextDone(t *testing.T) {
+func TestMcpHandlerInitClientGone(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cancel()
 
@@ -950,10 +1133,10 @@ func TestMcpHandlerInitContextDone(t *testing.T) {
 
 	svc.McpHandler(rw, req)
 
-	if rw.Code != http.StatusInternalServerError {
-		t.Fatalf("expected status 500, got %d", rw.Code)
+	if rw.Code != statusClientClosedRequest {
+		t.Fatalf("expected status 499, got %d", rw.Code)
 	}
-	if !strings.Contains(rw.Body.String(), "context cancelled") {
+	if !strings.Contains(rw.Body.String(), "client disconnected") {
 		t.Fatalf("unexpected body: %q", rw.Body.String())
 	}
 }
@@ -1060,7 +1243,7 @@ func TestCreateBrowserSetOptionsError(t *testing.T) {
 	rw := httptest.NewRecorder()
 
 	opts := map[string]any{"bad": make(chan int)}
-	if _, _, ok := svc.createBrowser(rw, req, "chromium", "123", opts, writeMcpWaitError); ok {
+	if _, _, _, ok := svc.createBrowser(rw, req, "chromium", "123", opts, sessionOptions{}, writeMcpWaitError); ok {
 		t.Fatal("expected createBrowser to fail on unmarshalable options")
 	}
 	if rw.Code != http.StatusBadRequest {
@@ -1353,15 +1536,20 @@ func TestWriteCreateSessionWaitError(t *testing.T) {
 			waitErr:  &browserError{kind: browserFailed},
 			expected: selenium.Error("browser failed to start", ErrInternal),
 		},
+		{
+			name:     "browser failed with reason",
+			waitErr:  &browserError{kind: browserFailed, name: "br", reason: "ImagePullBackOff", message: "chrome:999.0 not found"},
+			expected: selenium.Error("browser failed to start", errors.New("ImagePullBackOff: chrome:999.0 not found (browser br)")),
+		},
 		{
 			name:     "stream error",
 			waitErr:  &browserError{kind: browserStreamError, err: streamErr},
 			expected: selenium.ErrUnknown(streamErr),
 		},
 		{
-			name:     "context done",
-			waitErr:  &browserError{kind: browserContextDone},
-			expected: selenium.ErrUnknown(ErrInternal),
+			name:     "startup timeout",
+			waitErr:  &browserError{kind: browserStartTimeout, name: "br"},
+			expected: selenium.ErrTimeout(errors.New("browser startup timed out (browser br)")),
 		},
 		{
 			name:     "unknown kind",
@@ -1379,6 +1567,24 @@ func TestWriteCreateSessionWaitError(t *testing.T) {
 	}
 }
 
+func TestWriteWaitErrorClientGone(t *testing.T) {
+	waitErr := &browserError{kind: browserClientGone, err: ErrClientDisconnected}
+
+	rw := httptest.NewRecorder()
+	writeCreateSessionWaitError(rw, waitErr)
+	verifyResponseError(t, rw, statusClientClosedRequest, selenium.ErrUnknown(ErrClientDisconnected))
+
+	rw = httptest.NewRecorder()
+	writePlaywrightWaitError(rw, waitErr)
+	if rw.Code != statusClientClosedRequest || strings.TrimSpace(rw.Body.String()) != "client disconnected" {
+		t.Fatalf("unexpected playwright response: %d %q", rw.Code, rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	writeMcpWaitError(rw, waitErr)
+	assertMcpError(t, rw, statusClientClosedRequest, -32603)
+}
+
 func TestWritePlaywrightWaitError(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -1405,15 +1611,20 @@ func TestWritePlaywrightWaitError(t *testing.T) {
 			waitErr:  &browserError{kind: browserFailed},
 			expected: "browser failed to start",
 		},
+		{
+			name:     "browser failed with reason",
+			waitErr:  &browserError{kind: browserFailed, name: "br", reason: "Unschedulable", message: "insufficient memory"},
+			expected: "browser failed to start: Unschedulable: insufficient memory (browser br)",
+		},
 		{
 			name:     "stream error",
 			waitErr:  &browserError{kind: browserStreamError, err: errors.New("stream failed")},
 			expected: "browser event stream error",
 		},
 		{
-			name:     "context done",
-			waitErr:  &browserError{kind: browserContextDone},
-			expected: "context cancelled, stopping browser event stream",
+			name:     "startup timeout",
+			waitErr:  &browserError{kind: browserStartTimeout, name: "br"},
+			expected: "browser startup timed out (browser br)",
 		},
 		{
 			name:     "unknown kind",
@@ -1468,9 +1679,9 @@ func TestWriteMcpWaitError(t *testing.T) {
 			expected: "browser event stream error",
 		},
 		{
-			name:     "context done",
-			waitErr:  &browserError{kind: browserContextDone},
-			expected: "context cancelled, stopping browser event stream",
+			name:     "startup timeout",
+			waitErr:  &browserError{kind: browserStartTimeout},
+			expected: "browser startup timed out",
 		},
 		{
 			name:     "unknown kind",
@@ -1517,6 +1728,10 @@ type fakeClient struct {
 	stream       browserclient.EventStream
 	streamErr    error
 	eventsOpts   []event.EventsOption
+	deleteErr    error
+
+	mu      sync.Mutex
+	deleted []string
 }
 
 func (f *fakeClient) Create(ctx context.Context, namespace string, browser *browserv1.Browser) (*browserv1.Browser, error) {
@@ -1534,7 +1749,16 @@ func (f *fakeClient) Get(ctx context.Context, namespace, name string) (*browserv
 }
 
 func (f *fakeClient) Delete(ctx context.Context, namespace, name string) error {
-	return nil
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, name)
+	return f.deleteErr
+}
+
+func (f *fakeClient) deletedNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.deleted...)
 }
 
 func (f *fakeClient) List(ctx context.Context, namespace string) ([]*browserv1.Browser, error) {
@@ -1562,6 +1786,18 @@ func (c *captureClient) Create(ctx context.Context, namespace string, browser *b
 	return c.fakeClient.Create(ctx, namespace, browser)
 }
 
+type cancelOnCreateClient struct {
+	fakeClient
+	cancel context.CancelFunc
+	name   string
+}
+
+func (c *cancelOnCreateClient) Create(ctx context.Context, namespace string, browser *browserv1.Browser) (*browserv1.Browser, error) {
+	c.name = browser.GetName()
+	c.cancel()
+	return nil, ctx.Err()
+}
+
 type fakeStream struct {
 	events    chan *event.BrowserEvent
 	errs      chan error
@@ -1784,8 +2020,9 @@ func (s *singleChannelStream) Errors() <-chan error               { return s.err
 func (s *singleChannelStream) Close()                             {}
 
 // TestCreateSessionErrorStreamClosed covers the stream.Errors() !ok branch in
-// createBrowserAndWait. Only the errors channel is closed; events channel stays
-// open so the select is forced to pick the errors case.
+// waitForBrowser. Only the errors channel is closed; events channel stays
+// open so the select is forced to pick the errors case. The stream is
+// reopened until the startup deadline.
 func TestCreateSessionErrorStreamClosed(t *testing.T) {
 	stream := newClosedErrorsStream()
 
@@ -1795,18 +2032,19 @@ func TestCreateSessionErrorStreamClosed(t *testing.T) {
 			ObjectMeta: browserv1.Browser{}.ObjectMeta,
 		},
 	}
-	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: 50 * time.Millisecond})
 	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
 	rw := httptest.NewRecorder()
 
 	svc.CreateSession(rw, req)
 
-	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrUnknown(ErrInternal))
+	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrTimeout(errors.New("browser startup timed out")))
 }
 
 // TestCreateSessionEventStreamClosed covers the stream.Events() !ok branch in
-// createBrowserAndWait. Only the events channel is closed; errors channel stays
-// open so the select is forced to pick the events case.
+// waitForBrowser. Only the events channel is closed; errors channel stays
+// open so the select is forced to pick the events case. The stream is
+// reopened until the startup deadline.
 func TestCreateSessionEventStreamClosed(t *testing.T) {
 	stream := newClosedEventsStream()
 
@@ -1816,11 +2054,231 @@ func TestCreateSessionEventStreamClosed(t *testing.T) {
 			ObjectMeta: browserv1.Browser{}.ObjectMeta,
 		},
 	}
-	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: 50 * time.Millisecond})
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrTimeout(errors.New("browser startup timed out")))
+}
+
+func queueConfig(maxSessions int) admission.Config {
+	return admission.Config{
+		MaxSessions:  maxSessions,
+		QueueTimeout: 20 * time.Millisecond,
+		RetryAfter:   5 * time.Second,
+		Classes:      map[string]int{"ci": 0, "interactive": 10},
+	}
+}
+
+type listClient struct {
+	fakeClient
+	browsers []*browserv1.Browser
+}
+
+func (c *listClient) List(ctx context.Context, namespace string) ([]*browserv1.Browser, error) {
+	return c.browsers, nil
+}
+
+func runningBrowser(name string) *browserv1.Browser {
+	return &browserv1.Browser{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     browserv1.BrowserStatus{Phase: "Running", PodIP: "127.0.0.1"},
+	}
+}
+
+func TestCreateSessionQueueTimeout(t *testing.T) {
+	fc := &listClient{browsers: []*browserv1.Browser{runningBrowser("a"), {Status: browserv1.BrowserStatus{Phase: "Pending"}}}}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second, Queue: queueConfig(1)})
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	verifyResponseError(t, rw, http.StatusServiceUnavailable, selenium.ErrSessionNotCreated(admission.ErrQueueTimeout))
+	if got := rw.Header().Get("Retry-After"); got != "5" {
+		t.Fatalf("expected Retry-After 5, got %q", got)
+	}
+}
+
+func TestCreateSessionQueueAdmits(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"orig"}}`), nil
+	}))
+
+	fc := &listClient{
+		fakeClient: fakeClient{stream: runningStream("127.0.0.1")},
+		browsers:   []*browserv1.Browser{{Status: browserv1.BrowserStatus{Phase: "Pending"}}},
+	}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second, Queue: queueConfig(1)})
 	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
 	rw := httptest.NewRecorder()
 
 	svc.CreateSession(rw, req)
 
-	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrUnknown(ErrInternal))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+	if svc.queue.Len() != 0 {
+		t.Fatalf("expected empty queue, got %d", svc.queue.Len())
+	}
+}
+
+func TestCreateSessionQueueUnknownPriorityClass(t *testing.T) {
+	body := `{"capabilities":{"alwaysMatch":{"browserName":"chrome","browserVersion":"120","selenosis:options":{"priorityClass":"vip"}}}}`
+	svc := NewService(&listClient{}, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second, Queue: queueConfig(1)})
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(body), nil)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rw.Code)
+	}
+	if !strings.Contains(rw.Body.String(), "unknown priority class") {
+		t.Fatalf("unexpected body: %q", rw.Body.String())
+	}
+}
+
+func TestCreateSessionPriorityClassNotAnnotated(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"orig"}}`), nil
+	}))
+
+	body := `{"capabilities":{"alwaysMatch":{"browserName":"chrome","browserVersion":"120","selenosis:options":{"priorityClass":"ci","labels":{"team":"qa"}}}}}`
+	fc := &captureClient{fakeClient: fakeClient{stream: runningStream("127.0.0.1")}}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second, Queue: queueConfig(1)})
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(body), nil)
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+	ann := fc.created.ObjectMeta.Annotations[browserv1.SelenosisOptionsAnnotationKey]
+	if strings.Contains(ann, "priorityClass") || !strings.Contains(ann, "team") {
+		t.Fatalf("unexpected options annotation: %q", ann)
+	}
+}
+
+func TestPlaywrightQueueTimeout(t *testing.T) {
+	fc := &listClient{browsers: []*browserv1.Browser{runningBrowser("a")}}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second, Queue: queueConfig(1)})
+	req := newRequestWithParams(http.MethodGet, "/playwright/chromium/123?priorityClass=interactive", nil, map[string]string{"name": "chromium", "version": "123"})
+	rw := httptest.NewRecorder()
+
+	svc.Playwright(rw, req)
+
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d", rw.Code)
+	}
+	if !strings.Contains(rw.Body.String(), "session not created: queue timeout") {
+		t.Fatalf("unexpected body: %q", rw.Body.String())
+	}
+	if rw.Header().Get("Retry-After") == "" {
+		t.Fatal("expected Retry-After header")
+	}
+}
+
+func TestMcpHandlerInitQueueTimeout(t *testing.T) {
+	fc := &listClient{browsers: []*browserv1.Browser{runningBrowser("a")}}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second, Queue: queueConfig(1)})
+	req := httptest.NewRequest(http.MethodPost, "/mcp?browser=chromium&version=123", nil)
+	rw := httptest.NewRecorder()
+
+	svc.McpHandler(rw, req)
+
+	assertMcpError(t, rw, http.StatusServiceUnavailable, -32603)
+	if !strings.Contains(rw.Body.String(), "queue timeout") {
+		t.Fatalf("unexpected body: %q", rw.Body.String())
+	}
+	if rw.Header().Get("Retry-After") != "5" {
+		t.Fatalf("expected Retry-After 5, got %q", rw.Header().Get("Retry-After"))
+	}
+}
+
+func TestCreateSessionQuotaExceeded(t *testing.T) {
+	owned := runningBrowser("a")
+	owned.Labels = map[string]string{browserv1.SelenosisOwnerLabelKey: "alice"}
+	owned.Spec.BrowserName = "chrome"
+
+	fc := &listClient{browsers: []*browserv1.Browser{owned}}
+	svc := NewService(fc, ServiceConfig{
+		Namespace:           "ns",
+		BrowserStartTimeout: time.Second,
+		Quotas:              []quota.Rule{{Name: "per-user", PerOwner: true, MaxSessions: 1}},
+	})
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	req = req.WithContext(auth.WithOwner(req.Context(), auth.Owner{Name: "alice"}))
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	verifyResponseError(t, rw, http.StatusTooManyRequests, selenium.ErrSessionNotCreated(&quota.ExceededError{Rule: "per-user", MaxSessions: 1}))
+	if fc.deletedNames() != nil {
+		t.Fatalf("expected no browser to be touched, got %v", fc.deletedNames())
+	}
+}
+
+func TestCreateSessionQuotaAllowsOtherOwner(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"orig"}}`), nil
+	}))
+
+	owned := runningBrowser("a")
+	owned.Labels = map[string]string{browserv1.SelenosisOwnerLabelKey: "alice"}
+
+	fc := &listClient{fakeClient: fakeClient{stream: runningStream("127.0.0.1")}, browsers: []*browserv1.Browser{owned}}
+	svc := NewService(fc, ServiceConfig{
+		Namespace:           "ns",
+		SidecarPort:         "4444",
+		BrowserStartTimeout: time.Second,
+		Quotas:              []quota.Rule{{Name: "per-user", PerOwner: true, MaxSessions: 1}},
+	})
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	req = req.WithContext(auth.WithOwner(req.Context(), auth.Owner{Name: "bob"}))
+	rw := httptest.NewRecorder()
+
+	svc.CreateSession(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+}
+
+func TestPlaywrightQuotaExceeded(t *testing.T) {
+	fc := &listClient{browsers: []*browserv1.Browser{{Spec: browserv1.BrowserSpec{BrowserName: "chromium"}}}}
+	svc := NewService(fc, ServiceConfig{
+		Namespace:           "ns",
+		BrowserStartTimeout: time.Second,
+		Quotas:              []quota.Rule{{Name: "chromium", BrowserName: "chromium", MaxSessions: 1}},
+	})
+	req := newRequestWithParams(http.MethodGet, "/playwright/chromium/123", nil, map[string]string{"name": "chromium", "version": "123"})
+	rw := httptest.NewRecorder()
+
+	svc.Playwright(rw, req)
+
+	if rw.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rw.Code)
+	}
+	if !strings.Contains(rw.Body.String(), "quota exceeded") {
+		t.Fatalf("unexpected body: %q", rw.Body.String())
+	}
+}
+
+func TestMcpHandlerInitQuotaExceeded(t *testing.T) {
+	fc := &listClient{browsers: []*browserv1.Browser{{Status: browserv1.BrowserStatus{Phase: "Pending"}}}}
+	svc := NewService(fc, ServiceConfig{
+		Namespace:           "ns",
+		BrowserStartTimeout: time.Second,
+		Quotas:              []quota.Rule{{Name: "all", MaxSessions: 1}},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/mcp?browser=chromium&version=123", nil)
+	rw := httptest.NewRecorder()
+
+	svc.McpHandler(rw, req)
+
+	assertMcpError(t, rw, http.StatusTooManyRequests, jsonrpc.QuotaExceeded)
 }
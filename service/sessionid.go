@@ -0,0 +1,242 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/selenosis/v2/pkg/ipuuid"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrLegacySessionID   = errors.New("legacy session id not accepted")
+	ErrSessionIDOutdated = errors.New("session id outdated")
+)
+
+// parseSessionID returns the pod IP a session id routes to and, for signed
+// ids, the name of the Browser it was issued for.
+func (s *Service) parseSessionID(sessionId string) (net.IP, string, error) {
+	if uid, err := uuid.Parse(sessionId); err == nil {
+		if s.sessionIDs != nil && !s.config.LegacySessionIDs {
+			return nil, "", ErrLegacySessionID
+		}
+		return ipuuid.UUIDToIP(uid), "", nil
+	}
+
+	if s.sessionIDs == nil {
+		return nil, "", errors.ErrUnsupported
+	}
+	ip, nonce, err := s.sessionIDs.Decode(sessionId)
+	if err != nil {
+		return nil, "", err
+	}
+	return ip, nonce.String(), nil
+}
+
+// sessionID returns the id handed to clients for the session of the named
+// Browser at ip: signed when a secret is configured, else the sidecar's own.
+func (s *Service) sessionID(ip net.IP, name string) (string, error) {
+	if s.sessionIDs == nil {
+		return sidecarSessionID(ip)
+	}
+	nonce, err := uuid.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	return s.sessionIDs.Encode(ip, nonce)
+}
+
+// sidecarSessionID is the id the sidecar knows its session by, the pod IP
+// written as a UUID.
+func sidecarSessionID(ip net.IP) (string, error) {
+	uid, err := ipuuid.IPToUUID(ip)
+	if err != nil {
+		return "", err
+	}
+	return uid.String(), nil
+}
+
+// signSessionID replaces the sidecar's session id in a session create
+// response with the signed one.
+func (s *Service) signSessionID(header http.Header, body []byte, name, podIP string) ([]byte, error) {
+	if s.sessionIDs == nil {
+		return body, nil
+	}
+
+	ip := net.ParseIP(podIP)
+	plain, err := sidecarSessionID(ip)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := s.sessionID(ip, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Get("Mcp-Session-Id") == plain {
+		header.Set("Mcp-Session-Id", signed)
+	}
+	return bytes.ReplaceAll(body, []byte(plain), []byte(signed)), nil
+}
+
+// liveSession returns the live Browser at ip. A signed id must name the
+// Browser that is there now, so that ids of deleted Browsers whose IP was
+// handed on are refused. Without a registry, legacy ids are not checked and
+// no Browser is returned.
+func (s *Service) liveSession(ctx context.Context, ip net.IP, name string) (*browserv1.Browser, error) {
+	if s.registry != nil {
+		b, err := s.registry.lookup(ctx, ip)
+		if err != nil {
+			return nil, err
+		}
+		if name != "" && b.GetName() != name {
+			return nil, ErrSessionIDOutdated
+		}
+		return b, nil
+	}
+
+	if name == "" {
+		return nil, nil
+	}
+	b, err := s.client.Get(ctx, s.config.Namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil || !liveBrowser(b) || b.Status.PodIP != ip.String() {
+		return nil, ErrSessionIDOutdated
+	}
+	return b, nil
+}
+
+// sidecarPath replaces a signed session id in the path p with the id the
+// sidecar knows the session by.
+func sidecarPath(p, sessionId string, ip net.IP) string {
+	plain, err := sidecarSessionID(ip)
+	if err != nil || plain == sessionId {
+		return p
+	}
+	return strings.Replace(p, "/"+sessionId, "/"+plain, 1)
+}
+
+// signSessionResponse puts the signed session id into a successful session
+// create response of the sidecar.
+func (s *Service) signSessionResponse(resp *http.Response, name, podIP string) error {
+	if s.sessionIDs == nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if body, err = s.signSessionID(resp.Header, body, name, podIP); err != nil {
+		return err
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// signedResponse returns a response modifier that puts sessionId, the id
+// the client knows the session by, in place of the sidecar's own id in the
+// headers and body of every response of the session. Bodies are rewritten
+// as they stream, so event streams are not held back.
+func signedResponse(sessionId string, ip net.IP) func(*http.Response) error {
+	plain, err := sidecarSessionID(ip)
+	return func(resp *http.Response) error {
+		if err != nil || plain == sessionId {
+			return nil
+		}
+
+		for _, values := range resp.Header {
+			for i, v := range values {
+				values[i] = strings.ReplaceAll(v, plain, sessionId)
+			}
+		}
+		resp.Body = newIDReplacer(resp.Body, plain, sessionId)
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return nil
+	}
+}
+
+// chainResponseModifiers runs the response modifiers in order until one of
+// them fails.
+func chainResponseModifiers(modifiers ...func(*http.Response) error) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		for _, modify := range modifiers {
+			if err := modify(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// idReplacer replaces one session id with another in a body as it is read.
+// Only a tail that may be the start of an id split across reads is held
+// back.
+type idReplacer struct {
+	body     io.ReadCloser
+	old, new []byte
+	chunk    []byte
+	pending  []byte
+	out      []byte
+	err      error
+}
+
+func newIDReplacer(body io.ReadCloser, old, new string) *idReplacer {
+	return &idReplacer{body: body, old: []byte(old), new: []byte(new), chunk: make([]byte, 32*1024)}
+}
+
+func (r *idReplacer) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		n, err := r.body.Read(r.chunk)
+		r.pending = append(r.pending, r.chunk[:n]...)
+		r.err = err
+		r.replace()
+	}
+
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// replace moves pending input to the output with ids replaced, keeping back
+// a tail that could still become an id while the body has more to come.
+func (r *idReplacer) replace() {
+	keep := 0
+	if r.err == nil {
+		tail := r.pending
+		if i := bytes.LastIndex(tail, r.old); i >= 0 {
+			tail = tail[i+len(r.old):]
+		}
+		for k := min(len(tail), len(r.old)-1); k > 0; k-- {
+			if bytes.HasSuffix(tail, r.old[:k]) {
+				keep = k
+				break
+			}
+		}
+	}
+
+	cut := len(r.pending) - keep
+	r.out = append(r.out, bytes.ReplaceAll(r.pending[:cut], r.old, r.new)...)
+	r.pending = append(r.pending[:0], r.pending[cut:]...)
+}
+
+func (r *idReplacer) Close() error {
+	return r.body.Close()
+}
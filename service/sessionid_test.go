@@ -0,0 +1,231 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	"github.com/alcounit/selenosis/v2/pkg/sessionid"
+	"github.com/google/uuid"
+)
+
+const testSidecarSessionID = "00000000-0000-0000-0000-ffff7f000001"
+
+func (c *ipClient) Get(ctx context.Context, namespace, name string) (*browserv1.Browser, error) {
+	if c.browser.GetName() != name {
+		return nil, errors.New("not found")
+	}
+	return c.browser, nil
+}
+
+func signedService(client *ipClient, legacy bool) *Service {
+	return NewService(client, ServiceConfig{SidecarPort: "4444", SessionIDSecret: []byte("secret"), LegacySessionIDs: legacy})
+}
+
+func signedSessionID(t *testing.T, ip, name string) string {
+	t.Helper()
+	id, err := sessionid.New([]byte("secret")).Encode(net.ParseIP(ip), uuid.MustParse(name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestParseSessionID(t *testing.T) {
+	name := uuid.NewString()
+	signed := signedSessionID(t, "127.0.0.1", name)
+	forged, _ := sessionid.New([]byte("other")).Encode(net.ParseIP("127.0.0.1"), uuid.MustParse(name))
+
+	plain := NewService(&fakeClient{}, ServiceConfig{})
+	if ip, browser, err := plain.parseSessionID(testSidecarSessionID); err != nil || !ip.Equal(net.ParseIP("127.0.0.1")) || browser != "" {
+		t.Fatalf("unexpected legacy result: %v %q %v", ip, browser, err)
+	}
+	if _, _, err := plain.parseSessionID(signed); err == nil {
+		t.Fatal("expected signed id to be refused without a secret")
+	}
+
+	svc := signedService(&ipClient{}, false)
+	ip, browser, err := svc.parseSessionID(signed)
+	if err != nil || !ip.Equal(net.ParseIP("127.0.0.1")) || browser != name {
+		t.Fatalf("unexpected signed result: %v %q %v", ip, browser, err)
+	}
+	if _, _, err := svc.parseSessionID(testSidecarSessionID); !errors.Is(err, ErrLegacySessionID) {
+		t.Fatalf("expected ErrLegacySessionID, got %v", err)
+	}
+	if _, _, err := svc.parseSessionID(forged); !errors.Is(err, sessionid.ErrForged) {
+		t.Fatalf("expected ErrForged, got %v", err)
+	}
+
+	compat := signedService(&ipClient{}, true)
+	if _, _, err := compat.parseSessionID(testSidecarSessionID); err != nil {
+		t.Fatalf("expected legacy id to be accepted in compatibility mode, got %v", err)
+	}
+}
+
+func TestCreateSessionSignsSessionID(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"`+testSidecarSessionID+`","capabilities":{"webSocketUrl":"ws://hub/session/`+testSidecarSessionID+`/se/bidi"}}}`), nil
+	}))
+
+	fc := &captureClient{fakeClient: fakeClient{stream: runningStream("127.0.0.1")}}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second, SessionIDSecret: []byte("secret")})
+
+	rw := httptest.NewRecorder()
+	svc.CreateSession(rw, newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil))
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+	body := rw.Body.String()
+	if strings.Contains(body, testSidecarSessionID) {
+		t.Fatalf("expected sidecar session id to be replaced: %s", body)
+	}
+
+	signed := signedSessionID(t, "127.0.0.1", fc.created.GetName())
+	if strings.Count(body, signed) != 2 {
+		t.Fatalf("expected signed session id in session id and webSocketUrl: %s", body)
+	}
+	if cl := rw.Header().Get("Content-Length"); cl != "" && cl != strconv.Itoa(len(body)) {
+		t.Fatalf("unexpected Content-Length %s for %d bytes", cl, len(body))
+	}
+}
+
+func TestProxySessionSignedSessionID(t *testing.T) {
+	var sidecarPath string
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sidecarPath = req.URL.Path
+		return response(http.StatusNotFound, `{"value":{"error":"no such window","message":"session `+testSidecarSessionID+`"}}`), nil
+	}))
+
+	name := uuid.NewString()
+	svc := signedService(newIPClient(name, "127.0.0.1"), false)
+	signed := signedSessionID(t, "127.0.0.1", name)
+
+	req := newRequestWithParams(http.MethodGet, "/wd/hub/session/"+signed+"/url", nil, map[string]string{"sessionId": signed})
+	rw := httptest.NewRecorder()
+	svc.ProxySession(rw, req)
+
+	if rw.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if sidecarPath != "/session/"+testSidecarSessionID+"/url" {
+		t.Fatalf("expected sidecar session id in path, got %s", sidecarPath)
+	}
+	if body := rw.Body.String(); strings.Contains(body, testSidecarSessionID) || !strings.Contains(body, signed) {
+		t.Fatalf("expected signed session id in response, got %s", body)
+	}
+}
+
+func TestProxySessionOutdatedSessionID(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Fatal("expected outdated session not to be proxied")
+		return nil, nil
+	}))
+
+	// the IP now belongs to another Browser
+	svc := signedService(newIPClient(uuid.NewString(), "127.0.0.1"), false)
+	signed := signedSessionID(t, "127.0.0.1", uuid.NewString())
+
+	req := newRequestWithParams(http.MethodGet, "/wd/hub/session/"+signed+"/url", nil, map[string]string{"sessionId": signed})
+	rw := httptest.NewRecorder()
+	svc.ProxySession(rw, req)
+
+	verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(errors.New("not found")))
+}
+
+func TestProxySessionOutdatedSessionIDWithRegistry(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		t.Fatal("expected outdated session not to be proxied")
+		return nil, nil
+	}))
+
+	svc := NewService(newIPClient(uuid.NewString(), "127.0.0.1"), ServiceConfig{SidecarPort: "4444", SessionIDSecret: []byte("secret"), SessionRegistry: true})
+	signed := signedSessionID(t, "127.0.0.1", uuid.NewString())
+
+	req := newRequestWithParams(http.MethodGet, "/wd/hub/session/"+signed+"/url", nil, map[string]string{"sessionId": signed})
+	rw := httptest.NewRecorder()
+	svc.ProxySession(rw, req)
+
+	verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrSessionIDOutdated))
+}
+
+func TestMcpHandlerSignedSessionID(t *testing.T) {
+	var sidecarHeader string
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		sidecarHeader = req.Header.Get("Mcp-Session-Id")
+		header := http.Header{"Content-Type": {"text/event-stream"}, "Mcp-Session-Id": {testSidecarSessionID}}
+		body := "data: {\"sessionId\":\"" + testSidecarSessionID + "\"}\n\n"
+		return &http.Response{StatusCode: http.StatusOK, Header: header, Body: io.NopCloser(strings.NewReader(body))}, nil
+	}))
+
+	name := uuid.NewString()
+	svc := signedService(newIPClient(name, "127.0.0.1"), false)
+	signed := signedSessionID(t, "127.0.0.1", name)
+
+	req := httptest.NewRequest(http.MethodPost, "/mcp", nil)
+	req.Header.Set("Mcp-Session-Id", signed)
+	rw := httptest.NewRecorder()
+	svc.McpHandler(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if sidecarHeader != testSidecarSessionID {
+		t.Fatalf("expected sidecar session id, got %q", sidecarHeader)
+	}
+	if got := rw.Header().Get("Mcp-Session-Id"); got != signed {
+		t.Fatalf("expected signed Mcp-Session-Id, got %q", got)
+	}
+	if body := rw.Body.String(); body != "data: {\"sessionId\":\""+signed+"\"}\n\n" {
+		t.Fatalf("expected signed session id in event stream, got %s", body)
+	}
+}
+
+// chunkedReader returns one chunk per read.
+type chunkedReader struct {
+	chunks []string
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestIDReplacerAcrossReads(t *testing.T) {
+	old, new := testSidecarSessionID, "signed"
+	src := &chunkedReader{chunks: []string{
+		"a " + old[:10],
+		old[10:] + " b " + old + " " + old[:3],
+		"x\n",
+		old[:20],
+	}}
+
+	r := newIDReplacer(io.NopCloser(src), old, new)
+	first := make([]byte, 64)
+	n, err := r.Read(first)
+	if err != nil || string(first[:n]) != "a " {
+		t.Fatalf("expected text before a split id without holding it back, got %q, %v", first[:n], err)
+	}
+
+	rest, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(rest); got != "signed b signed "+old[:3]+"x\n"+old[:20] {
+		t.Fatalf("unexpected body: %q", got)
+	}
+}
@@ -0,0 +1,317 @@
+package service
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	logctx "github.com/alcounit/browser-controller/pkg/log"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	"github.com/go-chi/chi/v5"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var ErrNoSessionSelector = errors.New("owner or labelSelector is required")
+
+// sessionView is the JSON view of a session.
+type sessionView struct {
+	ID             string            `json:"id,omitempty"`
+	Name           string            `json:"name"`
+	BrowserName    string            `json:"browserName"`
+	BrowserVersion string            `json:"browserVersion"`
+	Owner          string            `json:"owner,omitempty"`
+	Phase          string            `json:"phase,omitempty"`
+	Reason         string            `json:"reason,omitempty"`
+	Age            string            `json:"age"`
+	Labels         map[string]string `json:"labels,omitempty"`
+}
+
+type sessionList struct {
+	Sessions []sessionView `json:"sessions"`
+}
+
+// sessionFilter selects sessions by the query parameters owner, browser
+// (name or name/version), labelSelector and phase.
+type sessionFilter struct {
+	owner    string
+	browser  string
+	selector labels.Selector
+	phase    string
+
+	// restricted limits non-admins to the sessions of caller
+	caller     string
+	restricted bool
+}
+
+func parseSessionFilter(req *http.Request) (sessionFilter, error) {
+	q := req.URL.Query()
+	f := sessionFilter{
+		owner:    q.Get("owner"),
+		browser:  q.Get("browser"),
+		phase:    q.Get("phase"),
+		selector: labels.Everything(),
+	}
+
+	if v := q.Get("labelSelector"); v != "" {
+		selector, err := labels.Parse(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid labelSelector: %w", err)
+		}
+		f.selector = selector
+	}
+
+	if !auth.IsAdmin(req.Context()) {
+		owner, _ := auth.OwnerFrom(req.Context())
+		f.caller, f.restricted = owner.Name, true
+	}
+	return f, nil
+}
+
+func (f sessionFilter) matches(v sessionView, b *browserv1.Browser) bool {
+	if f.restricted && v.Owner != f.caller || f.owner != "" && v.Owner != f.owner {
+		return false
+	}
+	if f.phase != "" && !strings.EqualFold(v.Phase, f.phase) {
+		return false
+	}
+	if f.browser != "" && f.browser != v.BrowserName && f.browser != poolKey(v.BrowserName, v.BrowserVersion) {
+		return false
+	}
+	return f.selector.Matches(labels.Set(v.Labels))
+}
+
+// sessionView describes the session of b. Sessions that have no pod IP yet
+// have no id.
+func (s *Service) sessionView(b *browserv1.Browser, now time.Time) sessionView {
+	v := sessionView{
+		Name:           b.GetName(),
+		BrowserName:    b.Spec.BrowserName,
+		BrowserVersion: b.Spec.BrowserVersion,
+		Owner:          s.browserOwner(b),
+		Phase:          string(b.Status.Phase),
+		Reason:         b.Status.Reason,
+		Labels:         sessionLabels(b),
+	}
+	if created := b.GetCreationTimestamp(); !created.IsZero() {
+		v.Age = now.Sub(created.Time).Truncate(time.Second).String()
+	}
+	if ip := net.ParseIP(b.Status.PodIP); ip != nil {
+		v.ID, _ = s.sessionID(ip, b.GetName())
+	}
+	return v
+}
+
+// ListSessions answers with the sessions that match the query parameters,
+// oldest first. Non-admins only see their own sessions.
+func (s *Service) ListSessions(rw http.ResponseWriter, req *http.Request) {
+	log := logctx.FromContext(req.Context())
+
+	filter, err := parseSessionFilter(req)
+	if err != nil {
+		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(err))
+		return
+	}
+
+	browsers, err := s.client.List(req.Context(), s.config.Namespace)
+	if err != nil {
+		log.Err(err).Msg("failed to list browsers")
+		writeErrorResponse(rw, http.StatusInternalServerError, selenium.ErrUnknown(err))
+		return
+	}
+
+	slices.SortFunc(browsers, func(a, b *browserv1.Browser) int {
+		return cmp.Or(
+			a.GetCreationTimestamp().Compare(b.GetCreationTimestamp().Time),
+			strings.Compare(a.GetName(), b.GetName()),
+		)
+	})
+
+	now := time.Now()
+	list := sessionList{Sessions: []sessionView{}}
+	for _, b := range browsers {
+		if b == nil || !s.isSession(b) {
+			continue
+		}
+		if v := s.sessionView(b, now); filter.matches(v, b) {
+			list.Sessions = append(list.Sessions, v)
+		}
+	}
+
+	writeJSON(rw, http.StatusOK, list)
+}
+
+// GetSession answers with a single session. Sessions of other users are
+// reported as unknown to non-admins.
+func (s *Service) GetSession(rw http.ResponseWriter, req *http.Request) {
+	log := logctx.FromContext(req.Context())
+
+	sessionId := chi.URLParam(req, "sessionId")
+	b, err := s.sessionBrowser(req, sessionId)
+	if errors.Is(err, ErrSessionNotFound) {
+		log.Warn().Str("sessionId", sessionId).Msg("session not found")
+		writeErrorResponse(rw, http.StatusNotFound, selenium.ErrInvalidSessionId(err))
+		return
+	}
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionId).Msg("failed to look up session")
+		writeErrorResponse(rw, http.StatusInternalServerError, selenium.ErrUnknown(err))
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, s.sessionView(b, time.Now()))
+}
+
+// sessionBrowser finds the Browser of a session that the caller may see.
+func (s *Service) sessionBrowser(req *http.Request, sessionId string) (*browserv1.Browser, error) {
+	b, err := s.lookupSession(req.Context(), sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if !auth.IsAdmin(req.Context()) {
+		owner, _ := auth.OwnerFrom(req.Context())
+		if s.browserOwner(b) != owner.Name {
+			return nil, ErrSessionNotFound
+		}
+	}
+	return b, nil
+}
+
+// lookupSession finds the Browser of a session regardless of its owner.
+func (s *Service) lookupSession(ctx context.Context, sessionId string) (*browserv1.Browser, error) {
+	ip, name, err := s.parseSessionID(sessionId)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+
+	b, err := s.browserByIP(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" && b.GetName() != name || !s.isSession(b) {
+		return nil, ErrSessionNotFound
+	}
+	return b, nil
+}
+
+type deletedSessions struct {
+	Deleted []sessionView   `json:"deleted"`
+	Failed  []failedSession `json:"failed,omitempty"`
+}
+
+// failedSession is a session that could not be deleted, with the reason.
+type failedSession struct {
+	sessionView
+	Error string `json:"error"`
+}
+
+// DeleteSession deletes the Browser of a session. Sessions of other users
+// are reported as unknown to non-admins, as by GetSession.
+func (s *Service) DeleteSession(rw http.ResponseWriter, req *http.Request) {
+	log := logctx.FromContext(req.Context())
+
+	sessionId := chi.URLParam(req, "sessionId")
+	b, err := s.sessionBrowser(req, sessionId)
+	if errors.Is(err, ErrSessionNotFound) {
+		log.Warn().Str("sessionId", sessionId).Msg("session not found")
+		writeErrorResponse(rw, http.StatusNotFound, selenium.ErrInvalidSessionId(err))
+		return
+	}
+	if err != nil {
+		log.Err(err).Str("sessionId", sessionId).Msg("failed to look up session")
+		writeErrorResponse(rw, http.StatusInternalServerError, selenium.ErrUnknown(err))
+		return
+	}
+
+	v := s.sessionView(b, time.Now())
+	if err := s.deleteSession(req, b); err != nil {
+		writeErrorResponse(rw, http.StatusInternalServerError, selenium.ErrUnknown(err))
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, v)
+}
+
+// DeleteSessions deletes the sessions selected by owner or labelSelector,
+// optionally narrowed by browser and phase. Non-admins only delete their own
+// sessions. When only some deletes fail, it answers 207 with the result of
+// each session.
+func (s *Service) DeleteSessions(rw http.ResponseWriter, req *http.Request) {
+	log := logctx.FromContext(req.Context())
+
+	filter, err := parseSessionFilter(req)
+	if err == nil && filter.owner == "" && filter.selector.Empty() {
+		err = ErrNoSessionSelector
+	}
+	if err != nil {
+		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(err))
+		return
+	}
+
+	browsers, err := s.client.List(req.Context(), s.config.Namespace)
+	if err != nil {
+		log.Err(err).Msg("failed to list browsers")
+		writeErrorResponse(rw, http.StatusInternalServerError, selenium.ErrUnknown(err))
+		return
+	}
+
+	now := time.Now()
+	result := deletedSessions{Deleted: []sessionView{}}
+	for _, b := range browsers {
+		if b == nil || !s.isSession(b) {
+			continue
+		}
+		v := s.sessionView(b, now)
+		if !filter.matches(v, b) {
+			continue
+		}
+		if err := s.deleteSession(req, b); err != nil {
+			result.Failed = append(result.Failed, failedSession{sessionView: v, Error: err.Error()})
+			continue
+		}
+		result.Deleted = append(result.Deleted, v)
+	}
+
+	status := http.StatusOK
+	switch {
+	case len(result.Failed) > 0 && len(result.Deleted) > 0:
+		status = http.StatusMultiStatus
+	case len(result.Failed) > 0:
+		status = http.StatusInternalServerError
+	}
+	writeJSON(rw, status, result)
+}
+
+// deleteSession deletes the Browser of a session and writes an audit record
+// of who deleted it.
+func (s *Service) deleteSession(req *http.Request, b *browserv1.Browser) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), browserDeleteTimeout)
+	defer cancel()
+
+	err := s.client.Delete(ctx, s.config.Namespace, b.GetName())
+
+	log := logctx.FromContext(req.Context())
+	actor, _ := auth.OwnerFrom(req.Context())
+	ev := log.Info()
+	if err != nil {
+		ev = log.Error().Err(err)
+	}
+	ev.Str("audit", "session.delete").
+		Str("actor", actor.Name).
+		Bool("admin", auth.IsAdmin(req.Context())).
+		Str("remoteAddr", req.RemoteAddr).
+		Str("name", b.GetName()).
+		Str("owner", s.browserOwner(b)).
+		Str("browser", poolKey(b.Spec.BrowserName, b.Spec.BrowserVersion)).
+		Bool("success", err == nil).
+		Msg("session delete requested")
+	return err
+}
@@ -0,0 +1,373 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	"github.com/google/uuid"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// listedBrowser builds a Browser the way createBrowser does: session labels
+// only end up in the selenosis options annotation.
+func listedBrowser(name, owner, browser, version, phase, podIP string, age time.Duration, labels map[string]string) *browserv1.Browser {
+	var opts map[string]any
+	if len(labels) > 0 {
+		opts = map[string]any{"labels": labels}
+	}
+	ann, err := setSelenosisOptions(nil, opts)
+	if err != nil {
+		panic(err)
+	}
+	return &browserv1.Browser{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Labels:            map[string]string{browserv1.SelenosisOwnerLabelKey: owner},
+			Annotations:       ann,
+			CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+		},
+		Spec:   browserv1.BrowserSpec{BrowserName: browser, BrowserVersion: version},
+		Status: browserv1.BrowserStatus{Phase: corev1.PodPhase(phase), PodIP: podIP},
+	}
+}
+
+func newListClient() *listClient {
+	return &listClient{browsers: []*browserv1.Browser{
+		listedBrowser("b3", "alice", "firefox", "125.0", "Pending", "", time.Second, nil),
+		listedBrowser("b1", "alice", "chrome", "120.0", "Running", "127.0.0.1", time.Hour, map[string]string{"team": "web"}),
+		listedBrowser("b2", "bob", "chrome", "121.0", "Running", "127.0.0.2", time.Minute, map[string]string{"team": "api"}),
+	}}
+}
+
+func listSessions(t *testing.T, svc *Service, query string, owner *auth.Owner) []sessionView {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/selenosis/v1/sessions"+query, nil)
+	if owner != nil {
+		req = req.WithContext(auth.WithOwner(req.Context(), *owner))
+	}
+	rw := httptest.NewRecorder()
+	svc.ListSessions(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+	var list sessionList
+	if err := json.NewDecoder(rw.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	return list.Sessions
+}
+
+func sessionNames(sessions []sessionView) []string {
+	var names []string
+	for _, v := range sessions {
+		names = append(names, v.Name)
+	}
+	return names
+}
+
+func TestListSessions(t *testing.T) {
+	svc := NewService(newListClient(), ServiceConfig{})
+
+	sessions := listSessions(t, svc, "", nil)
+	if got := sessionNames(sessions); !slices.Equal(got, []string{"b1", "b2", "b3"}) {
+		t.Fatalf("expected sessions oldest first, got %v", got)
+	}
+
+	b1 := sessions[0]
+	if b1.ID != testSidecarSessionID || b1.BrowserName != "chrome" || b1.BrowserVersion != "120.0" ||
+		b1.Owner != "alice" || b1.Phase != "Running" || b1.Labels["team"] != "web" || b1.Age != "1h0m0s" {
+		t.Fatalf("unexpected session: %+v", b1)
+	}
+	if sessions[2].ID != "" {
+		t.Fatalf("expected pending session to have no id, got %q", sessions[2].ID)
+	}
+}
+
+func TestListSessionsFilters(t *testing.T) {
+	svc := NewService(newListClient(), ServiceConfig{})
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"?owner=alice", []string{"b1", "b3"}},
+		{"?browser=chrome", []string{"b1", "b2"}},
+		{"?browser=chrome/121.0", []string{"b2"}},
+		{"?phase=pending", []string{"b3"}},
+		{"?labelSelector=team%3Dweb", []string{"b1"}},
+		{"?labelSelector=team", []string{"b1", "b2"}},
+		{"?owner=alice&browser=chrome", []string{"b1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			if got := sessionNames(listSessions(t, svc, tt.query, nil)); !slices.Equal(got, tt.expected) {
+				t.Fatalf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestListSessionsInvalidSelector(t *testing.T) {
+	svc := NewService(newListClient(), ServiceConfig{})
+
+	rw := httptest.NewRecorder()
+	svc.ListSessions(rw, httptest.NewRequest(http.MethodGet, "/selenosis/v1/sessions?labelSelector=%3D%3D", nil))
+
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d", rw.Code)
+	}
+}
+
+func TestListSessionsNonAdmin(t *testing.T) {
+	svc := NewService(newListClient(), ServiceConfig{})
+
+	if got := sessionNames(listSessions(t, svc, "", &auth.Owner{Name: "bob"})); !slices.Equal(got, []string{"b2"}) {
+		t.Fatalf("expected only bob's session, got %v", got)
+	}
+	if got := listSessions(t, svc, "?owner=alice", &auth.Owner{Name: "bob"}); len(got) != 0 {
+		t.Fatalf("expected no sessions of others, got %v", sessionNames(got))
+	}
+	if got := listSessions(t, svc, "?owner=alice", &auth.Owner{Name: "root", Admin: true}); len(got) != 2 {
+		t.Fatalf("expected admin to see alice's sessions, got %v", sessionNames(got))
+	}
+}
+
+func getSession(t *testing.T, svc *Service, id string, owner *auth.Owner) *httptest.ResponseRecorder {
+	t.Helper()
+	req := newRequestWithParams(http.MethodGet, "/selenosis/v1/sessions/"+id, nil, map[string]string{"sessionId": id})
+	if owner != nil {
+		req = req.WithContext(auth.WithOwner(req.Context(), *owner))
+	}
+	rw := httptest.NewRecorder()
+	svc.GetSession(rw, req)
+	return rw
+}
+
+func TestGetSession(t *testing.T) {
+	svc := NewService(newListClient(), ServiceConfig{})
+
+	rw := getSession(t, svc, testSidecarSessionID, &auth.Owner{Name: "alice"})
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+	var v sessionView
+	if err := json.NewDecoder(rw.Body).Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "b1" || v.ID != testSidecarSessionID {
+		t.Fatalf("unexpected session: %+v", v)
+	}
+
+	for name, rw := range map[string]*httptest.ResponseRecorder{
+		"other user": getSession(t, svc, testSidecarSessionID, &auth.Owner{Name: "bob"}),
+		"unknown":    getSession(t, svc, uuid.Nil.String(), nil),
+		"invalid":    getSession(t, svc, "abc", nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrSessionNotFound))
+		})
+	}
+}
+
+func TestGetSessionSignedID(t *testing.T) {
+	name := uuid.NewString()
+	fc := &listClient{browsers: []*browserv1.Browser{
+		listedBrowser(name, "alice", "chrome", "120.0", "Running", "127.0.0.1", time.Minute, nil),
+	}}
+	svc := NewService(fc, ServiceConfig{SessionIDSecret: []byte("secret")})
+
+	sessions := listSessions(t, svc, "", nil)
+	if len(sessions) != 1 || sessions[0].ID != signedSessionID(t, "127.0.0.1", name) {
+		t.Fatalf("expected signed session id, got %+v", sessions)
+	}
+
+	if rw := getSession(t, svc, sessions[0].ID, nil); rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+	if rw := getSession(t, svc, signedSessionID(t, "127.0.0.1", uuid.NewString()), nil); rw.Code != http.StatusNotFound {
+		t.Fatalf("expected outdated id to be unknown, got %d", rw.Code)
+	}
+}
+
+func deleteSession(t *testing.T, svc *Service, id string, owner *auth.Owner) *httptest.ResponseRecorder {
+	t.Helper()
+	req := newRequestWithParams(http.MethodDelete, "/selenosis/v1/sessions/"+id, nil, map[string]string{"sessionId": id})
+	if owner != nil {
+		req = req.WithContext(auth.WithOwner(req.Context(), *owner))
+	}
+	rw := httptest.NewRecorder()
+	svc.DeleteSession(rw, req)
+	return rw
+}
+
+func TestDeleteSession(t *testing.T) {
+	fc := newListClient()
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", EnforceOwnership: true})
+
+	rw := deleteSession(t, svc, testSidecarSessionID, &auth.Owner{Name: "bob"})
+	verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrSessionNotFound))
+	if deleted := fc.deletedNames(); len(deleted) != 0 {
+		t.Fatalf("expected no delete by other user, got %v", deleted)
+	}
+
+	rw = deleteSession(t, svc, testSidecarSessionID, &auth.Owner{Name: "alice"})
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+	if deleted := fc.deletedNames(); !slices.Equal(deleted, []string{"b1"}) {
+		t.Fatalf("expected b1 to be deleted, got %v", deleted)
+	}
+}
+
+func TestDeleteSessionOwnershipNotEnforced(t *testing.T) {
+	fc := newListClient()
+	svc := NewService(fc, ServiceConfig{Namespace: "ns"})
+
+	// non-admins may not delete what they may not see
+	rw := deleteSession(t, svc, testSidecarSessionID, &auth.Owner{Name: "bob"})
+	verifyResponseError(t, rw, http.StatusNotFound, selenium.ErrInvalidSessionId(ErrSessionNotFound))
+	if deleted := fc.deletedNames(); len(deleted) != 0 {
+		t.Fatalf("expected no delete by other user, got %v", deleted)
+	}
+
+	if rw := deleteSession(t, svc, testSidecarSessionID, &auth.Owner{Name: "root", Admin: true}); rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+	if deleted := fc.deletedNames(); !slices.Equal(deleted, []string{"b1"}) {
+		t.Fatalf("expected b1 to be deleted, got %v", deleted)
+	}
+}
+
+func TestDeleteSessionFailure(t *testing.T) {
+	fc := newListClient()
+	fc.deleteErr = errors.New("boom")
+	svc := NewService(fc, ServiceConfig{Namespace: "ns"})
+
+	rw := deleteSession(t, svc, testSidecarSessionID, nil)
+	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrUnknown(fc.deleteErr))
+}
+
+func deleteSessions(t *testing.T, svc *Service, query string, owner *auth.Owner) (*httptest.ResponseRecorder, deletedSessions) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodDelete, "/selenosis/v1/sessions"+query, nil)
+	if owner != nil {
+		req = req.WithContext(auth.WithOwner(req.Context(), *owner))
+	}
+	rw := httptest.NewRecorder()
+	svc.DeleteSessions(rw, req)
+
+	var result deletedSessions
+	if rw.Code == http.StatusOK || rw.Code == http.StatusMultiStatus || rw.Code == http.StatusInternalServerError {
+		if err := json.NewDecoder(rw.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rw, result
+}
+
+func TestDeleteSessionsBySelector(t *testing.T) {
+	tests := []struct {
+		query    string
+		owner    *auth.Owner
+		expected []string
+	}{
+		{"?labelSelector=team%3Dweb", nil, []string{"b1"}},
+		{"?owner=alice", nil, []string{"b1", "b3"}},
+		{"?owner=alice&phase=running", nil, []string{"b1"}},
+		{"?labelSelector=team", &auth.Owner{Name: "bob"}, []string{"b2"}},
+		{"?owner=alice", &auth.Owner{Name: "bob"}, nil},
+		{"?labelSelector=team", &auth.Owner{Name: "root", Admin: true}, []string{"b1", "b2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			fc := newListClient()
+			// non-admins are limited to their own sessions even without
+			// enforced ownership
+			svc := NewService(fc, ServiceConfig{Namespace: "ns"})
+
+			rw, result := deleteSessions(t, svc, tt.query, tt.owner)
+			if rw.Code != http.StatusOK {
+				t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+			}
+			deleted := fc.deletedNames()
+			slices.Sort(deleted)
+			if !slices.Equal(deleted, tt.expected) {
+				t.Fatalf("expected %v to be deleted, got %v", tt.expected, deleted)
+			}
+			if len(result.Deleted) != len(tt.expected) {
+				t.Fatalf("expected %d deleted sessions in response, got %+v", len(tt.expected), result)
+			}
+		})
+	}
+}
+
+func TestDeleteSessionsRequiresSelector(t *testing.T) {
+	fc := newListClient()
+	svc := NewService(fc, ServiceConfig{Namespace: "ns"})
+
+	for _, query := range []string{"", "?browser=chrome", "?labelSelector=%3D%3D"} {
+		rw, _ := deleteSessions(t, svc, query, nil)
+		if rw.Code != http.StatusBadRequest {
+			t.Fatalf("%q: expected status 400, got %d", query, rw.Code)
+		}
+	}
+	if deleted := fc.deletedNames(); len(deleted) != 0 {
+		t.Fatalf("expected nothing to be deleted, got %v", deleted)
+	}
+}
+
+func TestDeleteSessionsFailure(t *testing.T) {
+	fc := newListClient()
+	fc.deleteErr = errors.New("boom")
+	svc := NewService(fc, ServiceConfig{Namespace: "ns"})
+
+	rw, result := deleteSessions(t, svc, "?owner=bob", nil)
+	if rw.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", rw.Code)
+	}
+	if len(result.Deleted) != 0 || len(result.Failed) != 1 || result.Failed[0].Name != "b2" || result.Failed[0].Error != "boom" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+}
+
+// failingDeleteClient fails to delete the Browser named fail.
+type failingDeleteClient struct {
+	*listClient
+	fail string
+}
+
+func (c *failingDeleteClient) Delete(ctx context.Context, namespace, name string) error {
+	if name == c.fail {
+		return errors.New("boom")
+	}
+	return c.listClient.Delete(ctx, namespace, name)
+}
+
+func TestDeleteSessionsPartialFailure(t *testing.T) {
+	fc := &failingDeleteClient{listClient: newListClient(), fail: "b1"}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns"})
+
+	rw, result := deleteSessions(t, svc, "?labelSelector=team", nil)
+	if rw.Code != http.StatusMultiStatus {
+		t.Fatalf("expected status 207, got %d", rw.Code)
+	}
+	if len(result.Deleted) != 1 || result.Deleted[0].Name != "b2" {
+		t.Fatalf("expected b2 to be deleted, got %+v", result.Deleted)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].Name != "b1" || result.Failed[0].Error != "boom" {
+		t.Fatalf("expected b1 to fail with its reason, got %+v", result.Failed)
+	}
+}
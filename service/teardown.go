@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/rs/zerolog"
+)
+
+var ErrSessionNotFound = errors.New("no browser found for session")
+
+// teardownBrowser deletes the named Browser once the session's client is
+// done with it, after the teardown grace period, instead of leaving it to the
+// idle timeout of the sidecar. A Browser that has been connected to again in
+// the meantime is kept. A negative grace period disables teardown.
+func (s *Service) teardownBrowser(log zerolog.Logger, name string) {
+	if s.config.TeardownGrace < 0 {
+		return
+	}
+
+	log.Info().Str("name", name).Dur("grace", s.config.TeardownGrace).Msg("scheduling browser teardown")
+	time.AfterFunc(s.config.TeardownGrace, func() {
+		if s.conns.active(name) {
+			log.Info().Str("name", name).Msg("browser connected again, teardown cancelled")
+			return
+		}
+		s.deleteBrowser(context.Background(), log, name)
+	})
+}
+
+// teardownTarget returns the name of the Browser of the session at ip,
+// taken from its session id when signed. It is looked up when the request
+// arrives, as by the time the session has ended the pod IP may belong to
+// another Browser. Without teardown it returns "".
+func (s *Service) teardownTarget(ctx context.Context, log zerolog.Logger, ip net.IP, name string) string {
+	if s.config.TeardownGrace < 0 || name != "" {
+		return name
+	}
+	b, err := s.browserByIP(ctx, ip)
+	if err != nil {
+		log.Err(err).Str("ip", ip.String()).Msg("failed to look up browser for teardown")
+		return ""
+	}
+	return b.GetName()
+}
+
+// teardownOnSuccess returns a response modifier that tears the named
+// Browser down once the sidecar confirmed that its session ended.
+func (s *Service) teardownOnSuccess(log zerolog.Logger, name string) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if name != "" && resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			s.teardownBrowser(log, name)
+		}
+		return nil
+	}
+}
+
+// browserByIP returns the live Browser at ip. Browsers that ended keep their
+// pod IP, which may have been handed to a new one since. The Browsers known
+// to the registry or the session feed are looked at before the namespace is
+// listed.
+func (s *Service) browserByIP(ctx context.Context, ip net.IP) (*browserv1.Browser, error) {
+	if s.registry != nil {
+		return s.registry.lookup(ctx, ip)
+	}
+	if s.feed != nil {
+		if b := s.feed.liveAt(ip); b != nil {
+			return b, nil
+		}
+	}
+
+	browsers, err := s.client.List(ctx, s.config.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range browsers {
+		if b != nil && b.Status.PodIP == ip.String() && liveBrowser(b) {
+			return b, nil
+		}
+	}
+	return nil, ErrSessionNotFound
+}
+
+// browserConns counts the client connections to each Browser. Playwright
+// clients with the same Idempotency-Key share one, which is only torn down
+// after the last of them disconnected.
+type browserConns struct {
+	mu    sync.Mutex
+	count map[string]int
+}
+
+func newBrowserConns() *browserConns {
+	return &browserConns{count: map[string]int{}}
+}
+
+func (c *browserConns) acquire(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count[name]++
+}
+
+// release returns whether the last connection to name was released.
+func (c *browserConns) release(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.count[name]--
+	if c.count[name] > 0 {
+		return false
+	}
+	delete(c.count, name)
+	return true
+}
+
+func (c *browserConns) active(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count[name] > 0
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/selenosis/v2/pkg/ipuuid"
+	"github.com/rs/zerolog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ipClient lists a single running Browser with the given pod IP.
+type ipClient struct {
+	fakeClient
+	browser *browserv1.Browser
+}
+
+func newIPClient(name, podIP string) *ipClient {
+	return &ipClient{browser: &browserv1.Browser{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     browserv1.BrowserStatus{Phase: "Running", PodIP: podIP},
+	}}
+}
+
+func (c *ipClient) List(ctx context.Context, namespace string) ([]*browserv1.Browser, error) {
+	return []*browserv1.Browser{c.browser}, nil
+}
+
+func sessionDeleteRequest(t *testing.T, suffix string) *http.Request {
+	t.Helper()
+	uid, err := ipuuid.IPToUUID(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionId := uid.String()
+	return newRequestWithParams(http.MethodDelete, "/wd/hub/session/"+sessionId+suffix, nil, map[string]string{"sessionId": sessionId})
+}
+
+func TestProxySessionDeleteTearsDownBrowser(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":null}`), nil
+	}))
+
+	fc := newIPClient("br", "127.0.0.1")
+	svc := NewService(fc, ServiceConfig{SidecarPort: "4444"})
+
+	rw := httptest.NewRecorder()
+	svc.ProxySession(rw, sessionDeleteRequest(t, ""))
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rw.Code)
+	}
+	waitUntil(t, func() bool { return len(fc.deletedNames()) == 1 })
+	if got := fc.deletedNames(); got[0] != "br" {
+		t.Fatalf("expected br to be deleted, got %v", got)
+	}
+}
+
+func TestProxySessionDeleteKeepsBrowser(t *testing.T) {
+	tests := []struct {
+		name   string
+		suffix string
+		status int
+		grace  time.Duration
+	}{
+		{"failed delete", "", http.StatusInternalServerError, 0},
+		{"window delete", "/window", http.StatusOK, 0},
+		{"teardown disabled", "", http.StatusOK, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				return response(tt.status, `{"value":null}`), nil
+			}))
+
+			fc := newIPClient("br", "127.0.0.1")
+			svc := NewService(fc, ServiceConfig{SidecarPort: "4444", TeardownGrace: tt.grace})
+
+			svc.ProxySession(httptest.NewRecorder(), sessionDeleteRequest(t, tt.suffix))
+
+			time.Sleep(20 * time.Millisecond)
+			if got := fc.deletedNames(); len(got) != 0 {
+				t.Fatalf("expected no browser to be deleted, got %v", got)
+			}
+		})
+	}
+}
+
+func TestMcpHandlerDeleteTearsDownBrowser(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, ``), nil
+	}))
+
+	fc := newIPClient("br", "127.0.0.1")
+	svc := NewService(fc, ServiceConfig{SidecarPort: "4444"})
+
+	rw := httptest.NewRecorder()
+	svc.McpHandler(rw, mcpProxyRequest(t, http.MethodDelete, "/mcp"))
+
+	waitUntil(t, func() bool { return len(fc.deletedNames()) == 1 })
+}
+
+func TestTeardownBrowserWaitsForGrace(t *testing.T) {
+	fc := &fakeClient{}
+	svc := NewService(fc, ServiceConfig{TeardownGrace: 50 * time.Millisecond})
+
+	svc.teardownBrowser(zerolog.Nop(), "br")
+
+	if got := fc.deletedNames(); len(got) != 0 {
+		t.Fatalf("expected deletion to wait for the grace period, got %v", got)
+	}
+	waitUntil(t, func() bool { return len(fc.deletedNames()) == 1 })
+}
+
+func TestProxySessionDeleteTearsDownBrowserOfRequest(t *testing.T) {
+	fc := newIPClient("br", "127.0.0.1")
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		// the pod is gone by the time the sidecar answers and its IP
+		// belongs to a new Browser
+		fc.browser = listedBrowser("next", "", "chrome", "120.0", "Running", "127.0.0.1", 0, nil)
+		return response(http.StatusOK, `{"value":null}`), nil
+	}))
+
+	svc := NewService(fc, ServiceConfig{SidecarPort: "4444"})
+	svc.ProxySession(httptest.NewRecorder(), sessionDeleteRequest(t, ""))
+
+	waitUntil(t, func() bool { return len(fc.deletedNames()) == 1 })
+	if got := fc.deletedNames(); got[0] != "br" {
+		t.Fatalf("expected br to be deleted, got %v", got)
+	}
+}
+
+func TestBrowserByIPSkipsEndedBrowsers(t *testing.T) {
+	svc := NewService(&listClient{browsers: []*browserv1.Browser{
+		listedBrowser("old", "", "chrome", "120.0", "Succeeded", "127.0.0.1", time.Hour, nil),
+		listedBrowser("new", "", "chrome", "120.0", "Running", "127.0.0.1", 0, nil),
+	}}, ServiceConfig{})
+
+	b, err := svc.browserByIP(context.Background(), net.ParseIP("127.0.0.1"))
+	if err != nil || b.GetName() != "new" {
+		t.Fatalf("expected new, got %v, %v", b, err)
+	}
+}
+
+func TestTeardownBrowserKeepsSharedBrowser(t *testing.T) {
+	fc := &fakeClient{}
+	svc := NewService(fc, ServiceConfig{TeardownGrace: 20 * time.Millisecond})
+
+	svc.conns.acquire("br")
+	svc.conns.acquire("br")
+	if svc.conns.release("br") {
+		t.Fatal("expected the second connection to keep the browser")
+	}
+
+	// a client reconnected during the grace period
+	svc.teardownBrowser(zerolog.Nop(), "br")
+	time.Sleep(50 * time.Millisecond)
+	if got := fc.deletedNames(); len(got) != 0 {
+		t.Fatalf("expected no browser to be deleted, got %v", got)
+	}
+
+	if !svc.conns.release("br") {
+		t.Fatal("expected the last connection to be released")
+	}
+	svc.teardownBrowser(zerolog.Nop(), "br")
+	waitUntil(t, func() bool { return len(fc.deletedNames()) == 1 })
+}
+
+func TestPlaywrightDialFailureReleasesBrowser(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	fc := &fakeClient{stream: runningStream("127.0.0.1")}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", SidecarPort: port, BrowserStartTimeout: time.Second})
+	req := newRequestWithParams(http.MethodGet, "/playwright/chromium/123", nil, map[string]string{"name": "chromium", "version": "123"})
+	rw := httptest.NewRecorder()
+
+	svc.Playwright(rw, req)
+
+	if rw.Code != http.StatusBadGateway {
+		t.Fatalf("expected status 502, got %d", rw.Code)
+	}
+	waitUntil(t, func() bool { return len(fc.deletedNames()) == 1 })
+	if name := fc.deletedNames()[0]; svc.conns.active(name) {
+		t.Fatalf("expected the connection to %s to be released", name)
+	}
+}
+
+func TestTeardownTargetDisabled(t *testing.T) {
+	wc := newWatchClient()
+	svc := NewService(wc, ServiceConfig{TeardownGrace: -1})
+
+	if name := svc.teardownTarget(t.Context(), zerolog.Nop(), net.ParseIP("127.0.0.1"), ""); name != "" {
+		t.Fatalf("expected no teardown target, got %q", name)
+	}
+	if wc.lists != 0 {
+		t.Fatalf("expected no list without teardown, got %d", wc.lists)
+	}
+}
+
+func TestBrowserByIPFromFeed(t *testing.T) {
+	wc := newWatchClient()
+	svc := NewService(wc, ServiceConfig{SessionEvents: true})
+	svc.feed.resync([]*browserv1.Browser{
+		listedBrowser("old", "", "chrome", "120.0", "Succeeded", "127.0.0.1", time.Hour, nil),
+		listedBrowser("br", "", "chrome", "120.0", "Running", "127.0.0.1", 0, nil),
+	})
+
+	b, err := svc.browserByIP(t.Context(), net.ParseIP("127.0.0.1"))
+	if err != nil || b.GetName() != "br" {
+		t.Fatalf("expected br, got %v, %v", b, err)
+	}
+	if wc.lists != 0 {
+		t.Fatalf("expected the known Browsers to be used, got %d lists", wc.lists)
+	}
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// startupTimeout picks the startup timeout for a session: the one requested
+// by the client if any, otherwise the operator default for the browser, and
+// never more than the configured maximum.
+func (s *Service) startupTimeout(name, version string, so sessionOptions) time.Duration {
+	timeout := s.config.BrowserStartTimeout
+	if d, ok := s.config.BrowserStartTimeouts[poolKey(name, version)]; ok {
+		timeout = d
+	} else if d, ok := s.config.BrowserStartTimeouts[name]; ok {
+		timeout = d
+	}
+
+	limit := s.config.MaxBrowserStartTimeout
+	if limit <= 0 {
+		// without an explicit maximum clients may only shorten the default
+		limit = timeout
+	}
+
+	if so.StartupTimeout > 0 {
+		timeout = so.StartupTimeout
+	}
+	return min(timeout, limit)
+}
+
+// ParseStartupTimeouts parses per-browser startup timeouts such as
+// "chrome=30s,android=10m,chrome/120.0=45s". A key is a browser name, or a
+// name and version separated by a slash.
+func ParseStartupTimeouts(s string) (map[string]time.Duration, error) {
+	return parseDurations("startup timeout", s)
+}
+
+func parseDurations(what, s string) (map[string]time.Duration, error) {
+	durations := map[string]time.Duration{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(item, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid %s %q", what, item)
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s for %q: %w", what, key, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("invalid %s for %q: must be positive", what, key)
+		}
+		durations[key] = d
+	}
+	return durations, nil
+}
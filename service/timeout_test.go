@@ -0,0 +1,100 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStartupTimeout(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{
+		BrowserStartTimeout: time.Minute,
+		BrowserStartTimeouts: map[string]time.Duration{
+			"android":     10 * time.Minute,
+			"chrome":      30 * time.Second,
+			"chrome/99.0": 45 * time.Second,
+		},
+		MaxBrowserStartTimeout: 15 * time.Minute,
+	})
+
+	tests := []struct {
+		name      string
+		browser   string
+		version   string
+		requested time.Duration
+		expected  time.Duration
+	}{
+		{"global default", "firefox", "120", 0, time.Minute},
+		{"per browser default", "android", "14", 0, 10 * time.Minute},
+		{"per version default", "chrome", "99.0", 0, 45 * time.Second},
+		{"requested shorter", "android", "14", time.Minute, time.Minute},
+		{"requested longer", "chrome", "120", 5 * time.Minute, 5 * time.Minute},
+		{"requested above max", "chrome", "120", time.Hour, 15 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := svc.startupTimeout(tt.browser, tt.version, sessionOptions{StartupTimeout: tt.requested})
+			if got != tt.expected {
+				t.Fatalf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestStartupTimeoutWithoutMax(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{
+		BrowserStartTimeout:  time.Minute,
+		BrowserStartTimeouts: map[string]time.Duration{"android": 10 * time.Minute},
+	})
+
+	if got := svc.startupTimeout("chrome", "", sessionOptions{StartupTimeout: time.Hour}); got != time.Minute {
+		t.Fatalf("expected request to be capped at the default, got %s", got)
+	}
+	if got := svc.startupTimeout("android", "", sessionOptions{StartupTimeout: 20 * time.Second}); got != 20*time.Second {
+		t.Fatalf("expected shorter request to be honoured, got %s", got)
+	}
+}
+
+func TestCreateSessionRequestedStartupTimeout(t *testing.T) {
+	fc := &fakeClient{
+		stream:       newFakeStream(),
+		createResult: &browserv1.Browser{ObjectMeta: metav1.ObjectMeta{Name: "br"}},
+	}
+	svc := NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Minute})
+
+	body := `{"capabilities":{"alwaysMatch":{"browserName":"chrome","browserVersion":"120","selenosis:options":{"startupTimeout":"10ms"}}}}`
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(body), nil)
+	rw := httptest.NewRecorder()
+
+	start := time.Now()
+	svc.CreateSession(rw, req)
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected requested timeout to apply, took %s", elapsed)
+	}
+	verifyResponseError(t, rw, http.StatusInternalServerError, selenium.ErrTimeout(errors.New("browser startup timed out (browser br)")))
+}
+
+func TestParseStartupTimeouts(t *testing.T) {
+	timeouts, err := ParseStartupTimeouts(" chrome=30s, android=10m ,chrome/99.0=45s,")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(timeouts) != 3 || timeouts["chrome"] != 30*time.Second || timeouts["android"] != 10*time.Minute || timeouts["chrome/99.0"] != 45*time.Second {
+		t.Fatalf("unexpected timeouts: %v", timeouts)
+	}
+
+	for _, bad := range []string{"chrome", "=1m", "chrome=soon", "chrome=0s"} {
+		if _, err := ParseStartupTimeouts(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const serverTimingHeader = "Server-Timing"
+
+type startupPhase int
+
+const (
+	phaseCreateAccepted startupPhase = iota
+	phasePending
+	phaseRunning
+	phaseSidecarResponse
+	numStartupPhases
+)
+
+// startupPhaseNames are the Server-Timing metric names and log fields of the
+// startup phases, with a description for the header.
+var startupPhaseNames = [numStartupPhases]struct{ metric, field, desc string }{
+	phaseCreateAccepted:  {"create", "createAccepted", "create accepted"},
+	phasePending:         {"pending", "pending", "browser pending"},
+	phaseRunning:         {"running", "running", "browser running"},
+	phaseSidecarResponse: {"sidecar", "sidecarResponse", "sidecar response"},
+}
+
+// startupTimings records when a session startup reached each phase, relative
+// to the arrival of the request. Phases the startup skipped, such as create
+// and pending for a pooled browser, are left out.
+type startupTimings struct {
+	start time.Time
+
+	mu    sync.Mutex
+	marks [numStartupPhases]time.Duration
+}
+
+type startupTimingsKey struct{}
+
+// withStartupTimings starts recording the timings of the startup run for req
+// and returns the request carrying them.
+func withStartupTimings(req *http.Request) *http.Request {
+	t := &startupTimings{start: time.Now()}
+	ctx := context.WithValue(req.Context(), startupTimingsKey{}, t)
+	ctx = withStartupTrace(ctx, &startupTrace{
+		Created: func(string) { t.mark(phaseCreateAccepted) },
+		Pending: func(string) { t.mark(phasePending) },
+		Running: func(string) { t.mark(phaseRunning) },
+	})
+	return req.WithContext(ctx)
+}
+
+func startupTimingsFrom(ctx context.Context) *startupTimings {
+	t, _ := ctx.Value(startupTimingsKey{}).(*startupTimings)
+	return t
+}
+
+func (t *startupTimings) mark(phase startupPhase) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.marks[phase] == 0 {
+		t.marks[phase] = max(time.Since(t.start), time.Nanosecond)
+	}
+}
+
+func (t *startupTimings) snapshot() [numStartupPhases]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.marks
+}
+
+// header formats the timings as a Server-Timing header value.
+func (t *startupTimings) header() string {
+	var metrics []string
+	for phase, d := range t.snapshot() {
+		if d == 0 {
+			continue
+		}
+		name := startupPhaseNames[phase]
+		metrics = append(metrics, fmt.Sprintf("%s;desc=%q;dur=%.1f", name.metric, name.desc, float64(d)/float64(time.Millisecond)))
+	}
+	return strings.Join(metrics, ", ")
+}
+
+func (t *startupTimings) log(log zerolog.Logger) {
+	fields := zerolog.Dict()
+	for phase, d := range t.snapshot() {
+		if d != 0 {
+			fields.Dur(startupPhaseNames[phase].field, d)
+		}
+	}
+	log.Info().Dict("startupTimings", fields).Msg("session startup timings")
+}
+
+// sidecarResponded marks the sidecar response and adds the timings to the
+// response headers.
+func (t *startupTimings) sidecarResponded(log zerolog.Logger, header http.Header) {
+	if t == nil {
+		return
+	}
+	t.mark(phaseSidecarResponse)
+	header.Add(serverTimingHeader, t.header())
+	t.log(log)
+}
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/browser-service/pkg/event"
+)
+
+func TestStartupTimingsHeader(t *testing.T) {
+	timings := &startupTimings{start: time.Now()}
+	timings.marks[phaseCreateAccepted] = 12 * time.Millisecond
+	timings.marks[phaseRunning] = 1500 * time.Millisecond
+
+	want := `create;desc="create accepted";dur=12.0, running;desc="browser running";dur=1500.0`
+	if got := timings.header(); got != want {
+		t.Fatalf("unexpected header:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestStartupTimingsKeepFirstMark(t *testing.T) {
+	timings := &startupTimings{start: time.Now().Add(-time.Second)}
+	timings.mark(phasePending)
+	first := timings.snapshot()[phasePending]
+	timings.mark(phasePending)
+
+	if got := timings.snapshot()[phasePending]; got != first {
+		t.Fatalf("expected first mark to be kept, got %v and %v", first, got)
+	}
+}
+
+func TestCreateSessionServerTiming(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"s1"}}`), nil
+	}))
+
+	stream := newFakeStream()
+	stream.events <- &event.BrowserEvent{Browser: &browserv1.Browser{Status: browserv1.BrowserStatus{Phase: "Pending"}}}
+	stream.events <- &event.BrowserEvent{Browser: &browserv1.Browser{Status: browserv1.BrowserStatus{Phase: "Running", PodIP: "127.0.0.1"}}}
+	svc := NewService(&fakeClient{stream: stream}, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: time.Second})
+
+	req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+	rw := httptest.NewRecorder()
+	svc.CreateSession(rw, req)
+
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+
+	header := rw.Header().Get(serverTimingHeader)
+	for _, metric := range []string{"create;", "pending;", "running;", "sidecar;"} {
+		if !strings.Contains(header, metric) {
+			t.Fatalf("expected %s metric in Server-Timing, got %q", strings.TrimSuffix(metric, ";"), header)
+		}
+	}
+}
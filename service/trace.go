@@ -0,0 +1,52 @@
+package service
+
+import "context"
+
+// startupTrace holds hooks that are called as a browser startup progresses,
+// in the spirit of net/http/httptrace. Any hook may be nil.
+type startupTrace struct {
+	// Queued is called when the startup waits for an admission slot.
+	Queued func()
+	// Created is called once browser-service accepted the Browser.
+	Created func(name string)
+	// Pending is called when the Browser is first reported as Pending.
+	Pending func(name string)
+	// Running is called when the Browser is reported as Running, or when a
+	// running Browser is claimed from the pool.
+	Running func(name string)
+}
+
+type startupTraceKey struct{}
+
+func withStartupTrace(ctx context.Context, t *startupTrace) context.Context {
+	return context.WithValue(ctx, startupTraceKey{}, t)
+}
+
+func startupTraceFrom(ctx context.Context) *startupTrace {
+	t, _ := ctx.Value(startupTraceKey{}).(*startupTrace)
+	return t
+}
+
+func (t *startupTrace) queued() {
+	if t != nil && t.Queued != nil {
+		t.Queued()
+	}
+}
+
+func (t *startupTrace) created(name string) {
+	if t != nil && t.Created != nil {
+		t.Created(name)
+	}
+}
+
+func (t *startupTrace) pending(name string) {
+	if t != nil && t.Pending != nil {
+		t.Pending(name)
+	}
+}
+
+func (t *startupTrace) running(name string) {
+	if t != nil && t.Running != nil {
+		t.Running(name)
+	}
+}
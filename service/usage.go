@@ -0,0 +1,168 @@
+package service
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	logctx "github.com/alcounit/browser-controller/pkg/log"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	"github.com/alcounit/selenosis/v2/pkg/selenium"
+	"github.com/alcounit/selenosis/v2/pkg/usage"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var ErrUsageDisabled = errors.New("usage accounting is disabled")
+
+type usageReport struct {
+	From    time.Time   `json:"from,omitzero"`
+	To      time.Time   `json:"to"`
+	GroupBy string      `json:"groupBy"`
+	Rows    []usage.Row `json:"rows"`
+}
+
+func usageSession(v sessionView) usage.Session {
+	return usage.Session{
+		Name:           v.Name,
+		Owner:          v.Owner,
+		BrowserName:    v.BrowserName,
+		BrowserVersion: v.BrowserVersion,
+		Labels:         v.Labels,
+	}
+}
+
+// recordUsage accounts a session from the time it runs until it ends or
+// its Browser is deleted. It is called by the session feed. Pooled Browsers
+// are only accounted once claimed on this replica, like in syncUsage; the
+// replica that hands one out accounts it.
+func (s *Service) recordUsage(e *sessionEvent) error {
+	if s.config.Usage == nil {
+		return nil
+	}
+
+	switch e.Type {
+	case strings.ToLower(string(corev1.PodRunning)):
+		if _, pooled := e.browser.GetLabels()[PoolLabelKey]; pooled && !e.claimed {
+			return nil
+		}
+		return s.config.Usage.Start(usageSession(e.Session), e.Time)
+	case SessionEventDeleted, strings.ToLower(string(corev1.PodFailed)), strings.ToLower(string(corev1.PodSucceeded)):
+		return s.config.Usage.Stop(e.Session.Name, e.Time)
+	}
+	return nil
+}
+
+// syncUsage reconciles the usage ledger with a fresh list of Browsers, for
+// the changes missed while the hub was down or disconnected. Sessions found
+// running are accounted from the creation of their Browser, and those that
+// are gone or no longer running as ended now. Pooled Browsers are only
+// accounted from their claim by the session feed, since they may have
+// waited in the pool since their creation, but once accounted they are kept
+// for as long as they run.
+func (s *Service) syncUsage(browsers []*browserv1.Browser, now time.Time) error {
+	if s.config.Usage == nil {
+		return nil
+	}
+
+	running := map[string]bool{}
+	var errs []error
+	for _, b := range browsers {
+		if b == nil || b.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		running[b.GetName()] = true
+		if _, pooled := b.GetLabels()[PoolLabelKey]; pooled || !s.isSession(b) {
+			continue
+		}
+		start := b.GetCreationTimestamp().Time
+		if start.IsZero() {
+			start = now
+		}
+		errs = append(errs, s.config.Usage.Start(usageSession(s.sessionView(b, now)), start))
+	}
+
+	for _, name := range s.config.Usage.Running() {
+		if !running[name] {
+			errs = append(errs, s.config.Usage.Stop(name, now))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func parseUsageTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, v)
+}
+
+// Usage reports the session counts and browser-minutes between the from
+// and to query parameters, grouped by owner, browser or label:KEY, as JSON
+// or, with format=csv or an Accept of text/csv, as CSV. Non-admins only
+// get their own usage.
+func (s *Service) Usage(rw http.ResponseWriter, req *http.Request) {
+	log := logctx.FromContext(req.Context())
+
+	if s.config.Usage == nil {
+		http.Error(rw, ErrUsageDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	q := req.URL.Query()
+	query := usage.Query{To: now, GroupBy: "owner"}
+
+	var err error
+	if v := q.Get("from"); v != "" {
+		if query.From, err = parseUsageTime(v); err != nil {
+			writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(fmt.Errorf("invalid from %q", v)))
+			return
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if query.To, err = parseUsageTime(v); err != nil {
+			writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(fmt.Errorf("invalid to %q", v)))
+			return
+		}
+	}
+	if query.To.Before(query.From) {
+		writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(errors.New("from is after to")))
+		return
+	}
+	if v := q.Get("groupBy"); v != "" {
+		if query.GroupBy, err = usage.ParseGroupBy(v); err != nil {
+			writeErrorResponse(rw, http.StatusBadRequest, selenium.ErrInvalidArgument(err))
+			return
+		}
+	}
+
+	if !auth.IsAdmin(req.Context()) {
+		owner, _ := auth.OwnerFrom(req.Context())
+		query.Owner = owner.Name
+	}
+
+	rows := s.config.Usage.Report(query, now)
+
+	if q.Get("format") == "csv" || q.Get("format") == "" && strings.Contains(req.Header.Get("Accept"), "text/csv") {
+		rw.Header().Set("Content-Type", "text/csv")
+		rw.WriteHeader(http.StatusOK)
+
+		w := csv.NewWriter(rw)
+		w.Write([]string{string(query.GroupBy), "sessions", "browser_minutes"})
+		for _, row := range rows {
+			w.Write([]string{row.Key, strconv.Itoa(row.Sessions), strconv.FormatFloat(row.BrowserMinutes, 'f', 2, 64)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Err(err).Msg("failed to write usage report")
+		}
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, usageReport{From: query.From, To: query.To, GroupBy: string(query.GroupBy), Rows: rows})
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	"github.com/alcounit/browser-service/pkg/event"
+	"github.com/alcounit/selenosis/v2/pkg/auth"
+	"github.com/alcounit/selenosis/v2/pkg/usage"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func usageService(t *testing.T) (*Service, *usage.Ledger) {
+	t.Helper()
+	ledger, err := usage.Open(filepath.Join(t.TempDir(), "usage.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ledger.Close() })
+	return NewService(&fakeClient{}, ServiceConfig{Usage: ledger}), ledger
+}
+
+func TestUsageRecordedFromEvents(t *testing.T) {
+	svc, ledger := usageService(t)
+	svc.feed.resync(nil)
+
+	labels := map[string]string{"team": "web"}
+	svc.feed.apply(feedEvent(event.EventTypeAdded, listedBrowser("b1", "alice", "chrome", "120.0", "Pending", "", 0, labels)))
+	if got := ledger.Running(); len(got) != 0 {
+		t.Fatalf("expected pending session not to be accounted, got %v", got)
+	}
+
+	svc.feed.apply(feedEvent(event.EventTypeModified, listedBrowser("b1", "alice", "chrome", "120.0", "Running", "127.0.0.1", 0, labels)))
+	if got := ledger.Running(); !slices.Equal(got, []string{"b1"}) {
+		t.Fatalf("expected b1 to be accounted, got %v", got)
+	}
+
+	svc.feed.apply(feedEvent(event.EventTypeDeleted, listedBrowser("b1", "alice", "chrome", "120.0", "Running", "127.0.0.1", 0, labels)))
+	if got := ledger.Running(); len(got) != 0 {
+		t.Fatalf("expected b1 to have stopped, got %v", got)
+	}
+
+	rows := ledger.Report(usage.Query{To: time.Now(), GroupBy: "label:team"}, time.Now())
+	if len(rows) != 1 || rows[0].Key != "web" || rows[0].Sessions != 1 {
+		t.Fatalf("unexpected report: %+v", rows)
+	}
+}
+
+func TestUsageSync(t *testing.T) {
+	svc, ledger := usageService(t)
+	ledger.Start(usage.Session{Name: "gone", Owner: "bob"}, time.Now().Add(-time.Hour))
+
+	svc.feed.resync([]*browserv1.Browser{
+		listedBrowser("b1", "alice", "chrome", "120.0", "Running", "127.0.0.1", time.Hour, nil),
+		listedBrowser("b2", "alice", "chrome", "120.0", "Pending", "", time.Minute, nil),
+	})
+
+	if got := ledger.Running(); !slices.Equal(got, []string{"b1"}) {
+		t.Fatalf("expected only b1 to be running, got %v", got)
+	}
+	rows := ledger.Report(usage.Query{To: time.Now(), GroupBy: "owner"}, time.Now())
+	if len(rows) != 2 || rows[0].Key != "alice" || rows[0].BrowserMinutes < 59 {
+		t.Fatalf("expected b1 to be accounted since its creation, got %+v", rows)
+	}
+}
+
+func TestUsageSyncKeepsClaimedPooledSessions(t *testing.T) {
+	ledger, err := usage.Open(filepath.Join(t.TempDir(), "usage.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ledger.Close() })
+	svc := NewService(&fakeClient{}, ServiceConfig{
+		Usage: ledger,
+		Pool:  PoolConfig{Browsers: []PoolBrowser{{BrowserName: "chrome", BrowserVersion: "120", Size: 1}}},
+	})
+
+	// claimed before the restart, after an hour in the pool
+	ledger.Start(usage.Session{Name: "claimed", BrowserName: "chrome"}, time.Now().Add(-time.Minute))
+	claimed := pooledBrowser("claimed", "127.0.0.1")
+	claimed.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+	unclaimed := pooledBrowser("unclaimed", "127.0.0.2")
+	unclaimed.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+
+	svc.feed.resync([]*browserv1.Browser{claimed, unclaimed})
+
+	if got := ledger.Running(); !slices.Equal(got, []string{"claimed"}) {
+		t.Fatalf("expected only the claimed session to be running, got %v", got)
+	}
+	rows := ledger.Report(usage.Query{To: time.Now(), GroupBy: "browser"}, time.Now())
+	if len(rows) != 1 || rows[0].Sessions != 1 || rows[0].BrowserMinutes > 2 {
+		t.Fatalf("expected the claimed session to be accounted from its claim, got %+v", rows)
+	}
+}
+
+func TestUsagePooledFromClaim(t *testing.T) {
+	ledger, err := usage.Open(filepath.Join(t.TempDir(), "usage.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ledger.Close() })
+	svc := NewService(&fakeClient{}, ServiceConfig{
+		Usage: ledger,
+		Pool:  PoolConfig{Browsers: []PoolBrowser{{BrowserName: "chrome", BrowserVersion: "120", Size: 1}}},
+	})
+	svc.feed.resync(nil)
+
+	// started by another replica, idle or handed out there
+	svc.feed.apply(feedEvent(event.EventTypeAdded, pooledBrowser("other", "127.0.0.1")))
+	if got := ledger.Running(); len(got) != 0 {
+		t.Fatalf("expected a pooled browser of another replica not to be accounted, got %v", got)
+	}
+
+	// claimed here before its event arrived
+	svc.feed.claimed("mine")
+	svc.feed.apply(feedEvent(event.EventTypeAdded, pooledBrowser("mine", "127.0.0.2")))
+	if got := ledger.Running(); !slices.Equal(got, []string{"mine"}) {
+		t.Fatalf("expected only the claimed browser to be accounted, got %v", got)
+	}
+
+	svc.feed.apply(feedEvent(event.EventTypeDeleted, pooledBrowser("mine", "127.0.0.2")))
+	if got := ledger.Running(); len(got) != 0 {
+		t.Fatalf("expected the claimed browser to have stopped, got %v", got)
+	}
+	if svc.feed.claims["mine"] {
+		t.Fatal("expected the claim to be forgotten with its browser")
+	}
+}
+
+func usageRequest(svc *Service, query string, header http.Header, owner *auth.Owner) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/selenosis/v1/usage"+query, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if owner != nil {
+		req = req.WithContext(auth.WithOwner(req.Context(), *owner))
+	}
+	rw := httptest.NewRecorder()
+	svc.Usage(rw, req)
+	return rw
+}
+
+func TestUsageReport(t *testing.T) {
+	svc, ledger := usageService(t)
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ledger.Start(usage.Session{Name: "a", Owner: "alice", BrowserName: "chrome", BrowserVersion: "120.0"}, from.Add(time.Hour))
+	ledger.Stop("a", from.Add(time.Hour+30*time.Minute))
+	ledger.Start(usage.Session{Name: "b", Owner: "bob", BrowserName: "chrome", BrowserVersion: "120.0"}, from.Add(2*time.Hour))
+	ledger.Stop("b", from.Add(2*time.Hour+15*time.Minute))
+
+	rw := usageRequest(svc, "?from=2026-01-01&to=2026-01-02", nil, nil)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+	var report usageReport
+	if err := json.NewDecoder(rw.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	expected := []usage.Row{{Key: "alice", Sessions: 1, BrowserMinutes: 30}, {Key: "bob", Sessions: 1, BrowserMinutes: 15}}
+	if report.GroupBy != "owner" || !report.From.Equal(from) || !slices.Equal(report.Rows, expected) {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	rw = usageRequest(svc, "?groupBy=browser&format=csv", nil, nil)
+	if ct := rw.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Fatalf("expected csv, got %q", ct)
+	}
+	if got, want := rw.Body.String(), "browser,sessions,browser_minutes\nchrome/120.0,2,45.00\n"; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+
+	rw = usageRequest(svc, "", http.Header{"Accept": {"text/csv"}}, &auth.Owner{Name: "bob"})
+	if got, want := rw.Body.String(), "owner,sessions,browser_minutes\nbob,1,15.00\n"; got != want {
+		t.Fatalf("expected only bob's usage %q, got %q", want, got)
+	}
+}
+
+func TestUsageReportInvalidQuery(t *testing.T) {
+	svc, _ := usageService(t)
+
+	for _, query := range []string{"?from=yesterday", "?to=1", "?from=2026-02-01&to=2026-01-01", "?groupBy=team"} {
+		if rw := usageRequest(svc, query, nil, nil); rw.Code != http.StatusBadRequest {
+			t.Fatalf("%q: expected status 400, got %d", query, rw.Code)
+		}
+	}
+}
+
+func TestUsageDisabled(t *testing.T) {
+	svc := NewService(&fakeClient{}, ServiceConfig{})
+
+	if rw := usageRequest(svc, "", nil, nil); rw.Code != http.StatusNotFound || !strings.Contains(rw.Body.String(), ErrUsageDisabled.Error()) {
+		t.Fatalf("expected status 404, got %d", rw.Code)
+	}
+}
@@ -0,0 +1,168 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
+	"github.com/alcounit/browser-service/pkg/event"
+	"github.com/rs/zerolog"
+)
+
+const (
+	streamReconnectMinBackoff = 250 * time.Millisecond
+	streamReconnectMaxBackoff = 5 * time.Second
+	// sharedStreamPollInterval is how often a Browser waited for through the
+	// shared watcher is polled as well.
+	sharedStreamPollInterval = 5 * time.Second
+)
+
+// awaitBrowser waits for the named Browser to run. When the event stream
+// breaks, it polls the Browser and reopens the stream with backoff, so that
+// only the startup deadline or a Failed Browser end the wait. A subscription
+// of the shared watcher never breaks, even while the watcher is down, so the
+// Browser is polled all along instead. Streams opened here are closed here;
+// stream itself is left to the caller.
+func (s *Service) awaitBrowser(ctx context.Context, logger zerolog.Logger, stream browserclient.EventStream, browserName string) (string, *browserError) {
+	if sub, ok := stream.(*watchSubscription); ok {
+		polled := s.pollSubscription(ctx, logger, sub, browserName, sharedStreamPollInterval)
+		defer polled.Close()
+		stream = polled
+	}
+
+	var opened browserclient.EventStream
+	defer func() {
+		if opened != nil {
+			opened.Close()
+		}
+	}()
+
+	current := stream
+	backoff := streamReconnectMinBackoff
+	for {
+		podIP, waitErr := waitForBrowser(ctx, logger, current, browserName)
+		if waitErr == nil || (waitErr.kind != browserStreamClosed && waitErr.kind != browserStreamError) {
+			return podIP, waitErr
+		}
+
+		if opened != nil {
+			opened.Close()
+			opened = nil
+		}
+
+		for opened == nil {
+			if podIP, waitErr, done := s.pollBrowser(ctx, logger, browserName); done {
+				return podIP, waitErr
+			}
+
+			logger.Warn().Str("name", browserName).Dur("backoff", backoff).Msg("reconnecting browser event stream")
+
+			timer := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return "", contextDoneError(ctx, logger, browserName)
+			case <-timer.C:
+			}
+			backoff = min(backoff*2, streamReconnectMaxBackoff)
+
+			next, err := s.browserEvents(ctx, browserName)
+			if err != nil {
+				logger.Err(err).Str("name", browserName).Msg("failed to reopen browser event stream")
+				continue
+			}
+			opened = next
+			backoff = streamReconnectMinBackoff
+		}
+		current = opened
+
+		// the Browser may have changed while the stream was down
+		if podIP, waitErr, done := s.pollBrowser(ctx, logger, browserName); done {
+			return podIP, waitErr
+		}
+	}
+}
+
+// pollBrowser looks up the phase of the named Browser and reports whether
+// the wait for it is over.
+func (s *Service) pollBrowser(ctx context.Context, logger zerolog.Logger, browserName string) (string, *browserError, bool) {
+	b, err := s.client.Get(ctx, s.config.Namespace, browserName)
+	if err != nil {
+		logger.Err(err).Str("name", browserName).Msg("failed to poll browser")
+		return "", nil, false
+	}
+	if b == nil {
+		return "", nil, false
+	}
+
+	switch b.Status.Phase {
+	case "Failed":
+		logger.Error().
+			Str("name", browserName).
+			Str("statusReason", b.Status.Reason).
+			Str("statusMessage", b.Status.Message).
+			Msg("browser failed to start")
+		return "", &browserError{kind: browserFailed, name: browserName, reason: b.Status.Reason, message: b.Status.Message}, true
+
+	case "Running":
+		logger.Info().Str("name", browserName).Msg("browser successfully started")
+		startupTraceFrom(ctx).running(browserName)
+		return b.Status.PodIP, nil, true
+	}
+	return "", nil, false
+}
+
+// polledStream adds the states of a Browser, polled every interval, to the
+// events of stream.
+type polledStream struct {
+	stream browserclient.EventStream
+	events chan *event.BrowserEvent
+	cancel context.CancelFunc
+}
+
+func (p *polledStream) Events() <-chan *event.BrowserEvent { return p.events }
+func (p *polledStream) Errors() <-chan error               { return p.stream.Errors() }
+func (p *polledStream) Close()                             { p.cancel() }
+
+// pollSubscription returns a stream of the events of sub and of the states
+// of the named Browser, polled every interval. Closing it leaves sub open.
+func (s *Service) pollSubscription(ctx context.Context, logger zerolog.Logger, sub browserclient.EventStream, browserName string, interval time.Duration) browserclient.EventStream {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &polledStream{stream: sub, events: make(chan *event.BrowserEvent), cancel: cancel}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			var e *event.BrowserEvent
+			select {
+			case <-ctx.Done():
+				return
+			case next, ok := <-sub.Events():
+				if !ok {
+					close(p.events)
+					return
+				}
+				e = next
+			case <-ticker.C:
+				b, err := s.client.Get(ctx, s.config.Namespace, browserName)
+				if err != nil {
+					logger.Err(err).Str("name", browserName).Msg("failed to poll browser")
+					continue
+				}
+				if b == nil {
+					continue
+				}
+				e = &event.BrowserEvent{EventType: event.EventTypeModified, Browser: b}
+			}
+
+			select {
+			case p.events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return p
+}
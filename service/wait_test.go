@@ -0,0 +1,122 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
+	"github.com/rs/zerolog"
+)
+
+// pollClient answers Get with the Browser in get, once polls reaches after.
+type pollClient struct {
+	sequenceClient
+	get   *browserv1.Browser
+	after int32
+	polls atomic.Int32
+}
+
+func (c *pollClient) Get(ctx context.Context, namespace, name string) (*browserv1.Browser, error) {
+	if c.polls.Add(1) < c.after {
+		return nil, errors.New("not yet")
+	}
+	return c.get, nil
+}
+
+func brokenStream() *fakeStream {
+	stream := newFakeStream()
+	stream.errs <- errors.New("connection reset")
+	return stream
+}
+
+func awaitService(fc browserclient.Client) *Service {
+	return NewService(fc, ServiceConfig{Namespace: "ns", BrowserStartTimeout: time.Second})
+}
+
+func TestAwaitBrowserPollsWhileStreamIsDown(t *testing.T) {
+	fc := &pollClient{
+		sequenceClient: sequenceClient{streams: []browserclient.EventStream{brokenStream()}},
+		get:            &browserv1.Browser{Status: browserv1.BrowserStatus{Phase: "Running", PodIP: "127.0.0.5"}},
+		after:          2,
+	}
+	svc := awaitService(fc)
+
+	podIP, waitErr := svc.awaitBrowser(context.Background(), zerolog.Nop(), brokenStream(), "br")
+	if waitErr != nil {
+		t.Fatalf("unexpected error: %+v", waitErr)
+	}
+	if podIP != "127.0.0.5" {
+		t.Fatalf("expected pod IP from poll, got %q", podIP)
+	}
+}
+
+func TestAwaitBrowserReconnectsStream(t *testing.T) {
+	fc := &pollClient{
+		sequenceClient: sequenceClient{streams: []browserclient.EventStream{runningStream("127.0.0.6")}},
+	}
+	svc := awaitService(fc)
+
+	stream := newFakeStream()
+	stream.Close()
+
+	podIP, waitErr := svc.awaitBrowser(context.Background(), zerolog.Nop(), stream, "br")
+	if waitErr != nil {
+		t.Fatalf("unexpected error: %+v", waitErr)
+	}
+	if podIP != "127.0.0.6" {
+		t.Fatalf("expected pod IP from reopened stream, got %q", podIP)
+	}
+}
+
+func TestAwaitBrowserFailsOnFailedPoll(t *testing.T) {
+	fc := &pollClient{
+		sequenceClient: sequenceClient{streams: []browserclient.EventStream{brokenStream()}},
+		get:            &browserv1.Browser{Status: browserv1.BrowserStatus{Phase: "Failed", Reason: "Unschedulable"}},
+	}
+	svc := awaitService(fc)
+
+	_, waitErr := svc.awaitBrowser(context.Background(), zerolog.Nop(), brokenStream(), "br")
+	if waitErr == nil || waitErr.kind != browserFailed || waitErr.reason != "Unschedulable" {
+		t.Fatalf("expected failed browser, got %+v", waitErr)
+	}
+}
+
+func TestAwaitBrowserTimesOut(t *testing.T) {
+	fc := &pollClient{sequenceClient: sequenceClient{streams: []browserclient.EventStream{brokenStream()}}}
+	svc := awaitService(fc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, waitErr := svc.awaitBrowser(ctx, zerolog.Nop(), brokenStream(), "br")
+	if waitErr == nil || waitErr.kind != browserStartTimeout {
+		t.Fatalf("expected timeout, got %+v", waitErr)
+	}
+}
+
+func TestAwaitBrowserPollsSharedSubscription(t *testing.T) {
+	fc := &pollClient{get: &browserv1.Browser{Status: browserv1.BrowserStatus{Phase: "Running", PodIP: "127.0.0.7"}}}
+	svc := awaitService(fc)
+
+	// the shared watcher is down, so the subscription stays silent
+	sub := newBrowserWatcher(fc, "ns").subscribe("br")
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	polled := svc.pollSubscription(ctx, zerolog.Nop(), sub, "br", 10*time.Millisecond)
+	defer polled.Close()
+
+	podIP, waitErr := svc.awaitBrowser(ctx, zerolog.Nop(), polled, "br")
+	if waitErr != nil {
+		t.Fatalf("unexpected error: %+v", waitErr)
+	}
+	if podIP != "127.0.0.7" {
+		t.Fatalf("expected pod IP from poll, got %q", podIP)
+	}
+}
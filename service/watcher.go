@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	logctx "github.com/alcounit/browser-controller/pkg/log"
+	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
+	"github.com/alcounit/browser-service/pkg/event"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// EventsModeShared waits for browsers on one event stream per replica.
+	EventsModeShared = "shared"
+	// EventsModePerRequest opens an event stream for every startup.
+	EventsModePerRequest = "per-request"
+
+	watcherMinBackoff = 500 * time.Millisecond
+	watcherMaxBackoff = 30 * time.Second
+
+	// watchSubscriptionBuffer is the number of events kept for a slow
+	// subscriber before the oldest are dropped.
+	watchSubscriptionBuffer = 16
+)
+
+var errWatchStreamClosed = errors.New("browser event stream closed")
+
+// browserEvents returns a stream of the events of the named Browser. It has
+// to be opened before the Browser is created, so that no event is missed.
+func (s *Service) browserEvents(ctx context.Context, name string) (browserclient.EventStream, error) {
+	if s.watcher != nil && s.config.EventsMode == EventsModeShared {
+		return s.watcher.subscribe(name), nil
+	}
+	return s.client.Events(ctx, s.config.Namespace, browserclient.WithName(name))
+}
+
+// browserWatcher keeps a single event stream open for all Browsers of the
+// namespace and fans its events out to the subscribers of each Browser and
+// to the listeners that follow all of them.
+type browserWatcher struct {
+	client    browserclient.Client
+	namespace string
+	listeners []watchListener
+
+	mu   sync.Mutex
+	subs map[string]map[*watchSubscription]struct{}
+}
+
+// watchListener follows every Browser of the namespace. resync is called
+// with a fresh list whenever the watcher subscribes, apply with every event.
+type watchListener interface {
+	resync(browsers []*browserv1.Browser)
+	apply(e *event.BrowserEvent)
+}
+
+func newBrowserWatcher(client browserclient.Client, namespace string) *browserWatcher {
+	return &browserWatcher{
+		client:    client,
+		namespace: namespace,
+		subs:      map[string]map[*watchSubscription]struct{}{},
+	}
+}
+
+// listen registers l. It has to be called before run.
+func (w *browserWatcher) listen(l watchListener) {
+	w.listeners = append(w.listeners, l)
+}
+
+// run watches the namespace until ctx is done, resubscribing with backoff
+// whenever the stream breaks.
+func (w *browserWatcher) run(ctx context.Context) {
+	log := logctx.FromContext(ctx)
+
+	backoff := watcherMinBackoff
+	for {
+		connected, err := w.watch(ctx, log)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = watcherMinBackoff
+		}
+
+		log.Warn().Err(err).Dur("backoff", backoff).Msg("browser watcher disconnected, resubscribing")
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, watcherMaxBackoff)
+	}
+}
+
+// watch consumes one event stream. After subscribing it lists the Browsers,
+// when anyone follows them, so that events missed while disconnected are
+// delivered as well.
+func (w *browserWatcher) watch(ctx context.Context, log zerolog.Logger) (bool, error) {
+	stream, err := w.client.Events(ctx, w.namespace)
+	if err != nil {
+		return false, err
+	}
+	defer stream.Close()
+
+	log.Info().Msg("browser watcher subscribed")
+
+	if err := w.resync(ctx); err != nil {
+		log.Err(err).Msg("failed to resync browser watcher")
+	}
+
+	for {
+		select {
+		case e, ok := <-stream.Events():
+			if !ok {
+				return true, errWatchStreamClosed
+			}
+			if e != nil && e.Browser != nil {
+				w.dispatch(e)
+			}
+
+		case err, ok := <-stream.Errors():
+			if !ok {
+				return true, errWatchStreamClosed
+			}
+			if err != nil {
+				return true, err
+			}
+
+		case <-ctx.Done():
+			return true, ctx.Err()
+		}
+	}
+}
+
+func (w *browserWatcher) resync(ctx context.Context) error {
+	w.mu.Lock()
+	waiting := len(w.subs)
+	w.mu.Unlock()
+	if waiting == 0 && len(w.listeners) == 0 {
+		return nil
+	}
+
+	browsers, err := w.client.List(ctx, w.namespace)
+	if err != nil {
+		return err
+	}
+	for _, l := range w.listeners {
+		l.resync(browsers)
+	}
+	for _, b := range browsers {
+		if b != nil {
+			w.deliver(&event.BrowserEvent{EventType: event.EventTypeModified, Browser: b})
+		}
+	}
+	return nil
+}
+
+func (w *browserWatcher) dispatch(e *event.BrowserEvent) {
+	w.deliver(e)
+	for _, l := range w.listeners {
+		l.apply(e)
+	}
+}
+
+// deliver hands e to the subscribers of its Browser.
+func (w *browserWatcher) deliver(e *event.BrowserEvent) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for sub := range w.subs[e.Browser.GetName()] {
+		sub.deliver(e)
+	}
+}
+
+func (w *browserWatcher) subscribe(name string) *watchSubscription {
+	sub := &watchSubscription{
+		watcher: w,
+		name:    name,
+		events:  make(chan *event.BrowserEvent, watchSubscriptionBuffer),
+		errs:    make(chan error),
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.subs[name] == nil {
+		w.subs[name] = map[*watchSubscription]struct{}{}
+	}
+	w.subs[name][sub] = struct{}{}
+	return sub
+}
+
+func (w *browserWatcher) unsubscribe(sub *watchSubscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.subs[sub.name], sub)
+	if len(w.subs[sub.name]) == 0 {
+		delete(w.subs, sub.name)
+	}
+}
+
+var _ browserclient.EventStream = (*watchSubscription)(nil)
+
+// watchSubscription is the event stream of one Browser on a browserWatcher.
+// Its error channel never fires: stream errors are handled by the watcher.
+type watchSubscription struct {
+	watcher *browserWatcher
+	name    string
+	events  chan *event.BrowserEvent
+	errs    chan error
+
+	// last identifies the last delivered state, to drop the duplicates
+	// a resync produces.
+	last string
+}
+
+func (s *watchSubscription) Events() <-chan *event.BrowserEvent { return s.events }
+func (s *watchSubscription) Errors() <-chan error               { return s.errs }
+func (s *watchSubscription) Close()                             { s.watcher.unsubscribe(s) }
+
+// deliver is called with the watcher lock held.
+func (s *watchSubscription) deliver(e *event.BrowserEvent) {
+	state := browserState(e)
+	if state == s.last {
+		return
+	}
+	s.last = state
+
+	for {
+		select {
+		case s.events <- e:
+			return
+		default:
+		}
+		// drop the oldest event, the latest state matters most
+		select {
+		case <-s.events:
+		default:
+		}
+	}
+}
+
+func browserState(e *event.BrowserEvent) string {
+	b := e.Browser
+	return b.GetResourceVersion() + "/" + string(b.Status.Phase) + "/" + b.Status.PodIP
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	browserv1 "github.com/alcounit/browser-controller/apis/browser/v1"
+	browserclient "github.com/alcounit/browser-service/pkg/client/browser"
+	"github.com/alcounit/browser-service/pkg/event"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// watchClient hands out the streams sent on streams, one per Events call.
+type watchClient struct {
+	fakeClient
+	streams chan *fakeStream
+	created chan string
+
+	listMu sync.Mutex
+	list   []*browserv1.Browser
+	lists  int
+}
+
+func newWatchClient() *watchClient {
+	return &watchClient{streams: make(chan *fakeStream), created: make(chan string, 1)}
+}
+
+func (c *watchClient) Events(ctx context.Context, namespace string, opts ...event.EventsOption) (browserclient.EventStream, error) {
+	if len(opts) != 0 {
+		return nil, context.Canceled
+	}
+	select {
+	case s := <-c.streams:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *watchClient) Create(ctx context.Context, namespace string, browser *browserv1.Browser) (*browserv1.Browser, error) {
+	c.created <- browser.GetName()
+	return browser, nil
+}
+
+func (c *watchClient) List(ctx context.Context, namespace string) ([]*browserv1.Browser, error) {
+	c.listMu.Lock()
+	defer c.listMu.Unlock()
+	c.lists++
+	return c.list, nil
+}
+
+func browserEvent(name, rv, phase, podIP string) *event.BrowserEvent {
+	return &event.BrowserEvent{
+		EventType: event.EventTypeModified,
+		Browser: &browserv1.Browser{
+			ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: rv},
+			Status:     browserv1.BrowserStatus{Phase: corev1.PodPhase(phase), PodIP: podIP},
+		},
+	}
+}
+
+func nextEvent(t *testing.T, stream browserclient.EventStream) *event.BrowserEvent {
+	t.Helper()
+	select {
+	case e := <-stream.Events():
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return nil
+	}
+}
+
+func expectNoEvent(t *testing.T, stream browserclient.EventStream) {
+	t.Helper()
+	select {
+	case e := <-stream.Events():
+		t.Fatalf("unexpected event for %s: %s", e.Browser.GetName(), e.Browser.Status.Phase)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBrowserWatcherFansOutByName(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newWatchClient()
+	w := newBrowserWatcher(c, "ns")
+	a, b := w.subscribe("a"), w.subscribe("b")
+	defer a.Close()
+
+	go w.run(ctx)
+
+	stream := newFakeStream()
+	c.streams <- stream
+	stream.events <- browserEvent("b", "1", "Running", "127.0.0.2")
+	stream.events <- browserEvent("a", "2", "Pending", "")
+	stream.events <- browserEvent("c", "3", "Running", "127.0.0.3")
+
+	if e := nextEvent(t, a); e.Browser.GetName() != "a" || e.Browser.Status.Phase != "Pending" {
+		t.Fatalf("unexpected event for a: %+v", e.Browser)
+	}
+	if e := nextEvent(t, b); e.Browser.GetName() != "b" || e.Browser.Status.Phase != "Running" {
+		t.Fatalf("unexpected event for b: %+v", e.Browser)
+	}
+
+	b.Close()
+	stream.events <- browserEvent("b", "4", "Failed", "")
+	expectNoEvent(t, a)
+	if _, ok := w.subs["b"]; ok {
+		t.Fatal("expected closed subscription to be removed")
+	}
+}
+
+func TestBrowserWatcherResubscribesAndDedupes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newWatchClient()
+	c.list = []*browserv1.Browser{browserEvent("a", "7", "Running", "127.0.0.1").Browser}
+
+	w := newBrowserWatcher(c, "ns")
+	sub := w.subscribe("a")
+	defer sub.Close()
+
+	go w.run(ctx)
+
+	first := newFakeStream()
+	c.streams <- first
+	if e := nextEvent(t, sub); e.Browser.Status.Phase != "Running" {
+		t.Fatalf("expected resync to deliver Running, got %s", e.Browser.Status.Phase)
+	}
+	first.Close()
+
+	second := newFakeStream()
+	select {
+	case c.streams <- second:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected watcher to resubscribe")
+	}
+
+	// the resync after resubscribing and the replayed event are duplicates
+	second.events <- browserEvent("a", "7", "Running", "127.0.0.1")
+	expectNoEvent(t, sub)
+
+	second.events <- browserEvent("a", "8", "Failed", "")
+	if e := nextEvent(t, sub); e.Browser.Status.Phase != "Failed" {
+		t.Fatalf("expected Failed, got %s", e.Browser.Status.Phase)
+	}
+}
+
+func TestCreateSessionSharedEvents(t *testing.T) {
+	setTestTransport(t, roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return response(http.StatusOK, `{"value":{"sessionId":"s1"}}`), nil
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := newWatchClient()
+	svc := NewService(c, ServiceConfig{Namespace: "ns", SidecarPort: "4444", BrowserStartTimeout: 2 * time.Second, EventsMode: EventsModeShared})
+	go svc.Run(ctx)
+
+	stream := newFakeStream()
+	c.streams <- stream
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := newRequestWithParams(http.MethodPost, "/wd/hub/session", bytes.NewBufferString(validCapsBody()), nil)
+		rw := httptest.NewRecorder()
+		svc.CreateSession(rw, req)
+		done <- rw
+	}()
+
+	name := <-c.created
+	stream.events <- browserEvent(name, "1", "Running", "127.0.0.1")
+
+	rw := <-done
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rw.Code, rw.Body.String())
+	}
+}